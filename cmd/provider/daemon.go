@@ -21,10 +21,12 @@ import (
 	"github.com/ipni/index-provider/cmd/provider/internal/config"
 	"github.com/ipni/index-provider/engine"
 	"github.com/ipni/index-provider/engine/policy"
+	"github.com/ipni/index-provider/metrics"
 	adminserver "github.com/ipni/index-provider/server/admin/http"
 	droutingserver "github.com/ipni/index-provider/server/delegatedrouting/server"
 	"github.com/ipni/index-provider/supplier"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mitchellh/go-homedir"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/urfave/cli/v2"
@@ -73,6 +75,23 @@ func daemonCommand(cctx *cli.Context) error {
 		return err
 	}
 
+	// Start the metrics server first so that metrics are collected from the
+	// start.
+	var metricsSvr *metrics.Server
+	if cfg.Metrics.ListenMultiaddr != "" {
+		metricsAddr, err := cfg.Metrics.ListenNetAddr()
+		if err != nil {
+			return err
+		}
+		metricsSvr, err = metrics.NewServer(metricsAddr)
+		if err != nil {
+			return err
+		}
+		if err = metricsSvr.Start(); err != nil {
+			return err
+		}
+	}
+
 	syncPolicy, err := policy.New(cfg.Ingest.SyncPolicy.Allow, cfg.Ingest.SyncPolicy.Except)
 	if err != nil {
 		return err
@@ -128,8 +147,13 @@ func daemonCommand(cctx *cli.Context) error {
 		return err
 	}
 
+	var pubKinds []engine.PublisherKind
+	for _, kind := range cfg.Ingest.Publishers() {
+		pubKinds = append(pubKinds, engine.PublisherKind(kind))
+	}
+
 	// Starting provider core
-	eng, err := engine.New(
+	engOpts := []engine.Option{
 		engine.WithDatastore(ds),
 		engine.WithDataTransfer(dt),
 		engine.WithDirectAnnounce(cfg.DirectAnnounce.URLs...),
@@ -137,12 +161,29 @@ func daemonCommand(cctx *cli.Context) error {
 		engine.WithEntriesCacheCapacity(cfg.Ingest.LinkCacheSize),
 		engine.WithChainedEntries(cfg.Ingest.LinkedChunkSize),
 		engine.WithTopicName(cfg.Ingest.PubSubTopic),
-		engine.WithPublisherKind(engine.PublisherKind(cfg.Ingest.PublisherKind)),
+		engine.WithPublisherKind(pubKinds...),
 		engine.WithHttpPublisherListenAddr(httpListenAddr),
 		engine.WithHttpPublisherAnnounceAddr(cfg.Ingest.HttpPublisher.AnnounceMultiaddr),
 		engine.WithSyncPolicy(syncPolicy),
 		engine.WithRetrievalAddrs(cfg.ProviderServer.RetrievalMultiaddrs...),
-	)
+	}
+	for token, id := range cfg.Ingest.HttpPublisher.BearerTokens {
+		tokenPeer, err := peer.Decode(id)
+		if err != nil {
+			return fmt.Errorf("bad peer ID %q for http publisher bearer token: %s", id, err)
+		}
+		engOpts = append(engOpts, engine.WithHttpPublisherBearerToken(token, tokenPeer))
+	}
+	if cfg.Ingest.LinkedChunkByteSize != 0 {
+		engOpts = append(engOpts, engine.WithByteBoundedChainedEntries(cfg.Ingest.LinkedChunkByteSize, cfg.Ingest.LinkedChunkSize))
+	}
+	if cfg.Ingest.LinkCacheByteSize != 0 {
+		engOpts = append(engOpts, engine.WithEntriesCacheByteCapacity(cfg.Ingest.LinkCacheByteSize))
+	}
+	if cfg.Ingest.ListerAuditInterval != 0 {
+		engOpts = append(engOpts, engine.WithListerAudit(time.Duration(cfg.Ingest.ListerAuditInterval), cfg.Ingest.ListerAuditBatchSize))
+	}
+	eng, err := engine.New(engOpts...)
 	if err != nil {
 		return err
 	}
@@ -288,6 +329,12 @@ func daemonCommand(cctx *cli.Context) error {
 			finalErr = ErrDaemonStop
 		}
 	}
+	if metricsSvr != nil {
+		if err = metricsSvr.Shutdown(shutdownCtx); err != nil {
+			log.Errorw("Error shutting down metrics server.", "err", err)
+			finalErr = ErrDaemonStop
+		}
+	}
 	log.Infow("node stopped")
 	return finalErr
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-libipfs/routing/http/client"
+	"github.com/ipld/go-car/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/go-libipni/test"
+	"github.com/ipni/index-provider/cmd/provider/internal/config"
+	"github.com/ipni/index-provider/engine"
+	droutingserver "github.com/ipni/index-provider/server/delegatedrouting/server"
+	"github.com/ipni/index-provider/supplier"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDaemon_CarSupplierAndDelegatedRoutingListers registers the CAR supplier
+// and the delegated routing listener on the same engine, in the same order and
+// with the same default configuration as the daemon, and checks that the
+// multihashes of each are looked up from its own lister.
+func TestDaemon_CarSupplierAndDelegatedRoutingListers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	eng, err := engine.New(engine.WithDatastore(ds))
+	require.NoError(t, err)
+	require.NoError(t, eng.Start(ctx))
+	defer eng.Shutdown()
+
+	cs := supplier.NewCarSupplier(eng, ds, car.ZeroLengthSectionAsEOF(false))
+	defer cs.Close()
+
+	// Pick a free port for the delegated routing server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	droutingAddr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	cfg := config.NewDelegatedRouting()
+	require.Empty(t, cfg.ProviderID)
+	droutingSrv, err := droutingserver.New(
+		time.Duration(cfg.CidTtl),
+		1,
+		cfg.SnapshotSize,
+		cfg.DsPageSize,
+		cfg.ProviderID,
+		cfg.Addrs,
+		eng,
+		ds,
+		droutingserver.WithListenAddr(droutingAddr),
+	)
+	require.NoError(t, err)
+	go droutingSrv.Start()
+	defer droutingSrv.Shutdown(ctx)
+
+	// The CAR supplier still looks up the multihashes of its CARs.
+	carAdCid, err := cs.Put(ctx, []byte("car"), "../../testdata/sample-v1.car", metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+
+	// The listener looks up the multihashes of its chunks. With a chunk size
+	// of one, providing a second CID publishes the chunk of the first.
+	pID, priv, _ := test.RandomIdentity()
+	c, err := client.New("http://"+droutingAddr, client.WithIdentity(priv), client.WithProviderInfo(pID, test.RandomMultiaddrs(1)))
+	require.NoError(t, err)
+	for _, k := range test.RandomCids(2) {
+		_, err = c.ProvideBitswap(ctx, []cid.Cid{k}, time.Hour)
+		require.NoError(t, err)
+	}
+
+	_, ad, err := eng.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, ad)
+	require.Equal(t, pID.String(), ad.Provider)
+	require.Equal(t, carAdCid, ad.PreviousID.(cidlink.Link).Cid)
+}
@@ -28,6 +28,31 @@ func doHttpPostReq(ctx context.Context, path string, req interface{}) (resp *htt
 	return cl.Do(httpReq)
 }
 
+// doHttpGetReq sends a GET request to the given path and decodes the JSON
+// response body into res if the response status is OK.
+//
+// This function is intended for internal use in CLI to interact with the admin server.
+func doHttpGetReq(ctx context.Context, path string, res io.ReaderFrom) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	cl := &http.Client{}
+	resp, err := cl.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errFromHttpResp(resp)
+	}
+	if _, err := res.ReadFrom(resp.Body); err != nil {
+		return fmt.Errorf("received ok response from server but cannot decode response body. %v", err)
+	}
+	return nil
+}
+
 // errFromHttpResp constructs an error from a HTTP response.
 // The error message consists of the textual value of HTTP status, followed by a whitespace,
 // followed and the fully read response body.
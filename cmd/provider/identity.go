@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/ipni/index-provider/cmd/provider/internal/config"
+	"github.com/ipni/index-provider/engine"
+	"github.com/libp2p/go-libp2p"
+	"github.com/urfave/cli/v2"
+)
+
+var IdentityCmd = &cli.Command{
+	Name:        "identity",
+	Aliases:     []string{"id"},
+	Usage:       "Manages the identity of the provider.",
+	Subcommands: []*cli.Command{identityRotateSubCmd},
+}
+
+var identityRotateSubCmd = &cli.Command{
+	Name:  "rotate",
+	Usage: "Rotates the key used to sign advertisements.",
+	Description: `Generates a new identity and moves the content advertised by the provider to it.
+
+An advertisement attested to by both the current and the new identities is
+published, followed by advertisements that put the currently advertised content
+under the new peer ID and remove it from the current one. The identity in the
+config file is then replaced by the new identity.
+
+The new identity is written to a file next to the config file before the
+advertisements are published, and the file is removed once the config file is
+saved. If that file is left behind, the rotation did not complete; if the
+advertisements were published, copy the identity from it into the config file,
+and delete it in either case before rotating again.
+
+The provider daemon must not be running. Once it is restarted with the new
+identity, use the announce command to notify indexers of the new advertisements.`,
+	Action: doIdentityRotate,
+}
+
+func doIdentityRotate(cctx *cli.Context) error {
+	configFile, err := config.Filename("")
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		if errors.Is(err, config.ErrNotInitialized) {
+			return errors.New("reference provider is not initialized\nTo initialize, run using the \"init\" command")
+		}
+		return fmt.Errorf("cannot load config file: %w", err)
+	}
+	identityFile := configFile + ".new-identity"
+	if _, err = os.Stat(identityFile); err == nil {
+		return fmt.Errorf("a previous key rotation did not complete; resolve it using the identity in %s, then delete that file", identityFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	oldID, oldKey, err := cfg.Identity.DecodeOrCreate(cctx.App.Writer)
+	if err != nil {
+		return err
+	}
+
+	// The host is only used to identify the provider; it does not listen.
+	h, err := libp2p.New(libp2p.Identity(oldKey), libp2p.NoListenAddrs)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if cfg.Datastore.Type != "levelds" {
+		return fmt.Errorf("only levelds datastore type supported, %q not supported", cfg.Datastore.Type)
+	}
+	dataStorePath, err := config.Path("", cfg.Datastore.Dir)
+	if err != nil {
+		return err
+	}
+	ds, err := leveldb.NewDatastore(dataStorePath, nil)
+	if err != nil {
+		return fmt.Errorf("cannot open datastore; make sure the provider daemon is not running: %w", err)
+	}
+	defer ds.Close()
+
+	retrievalAddrs := cfg.ProviderServer.RetrievalMultiaddrs
+	if len(retrievalAddrs) == 0 {
+		retrievalAddrs = []string{cfg.ProviderServer.ListenMultiaddr}
+	}
+	eng, err := engine.New(
+		engine.WithDatastore(ds),
+		engine.WithHost(h),
+		engine.WithEntriesCacheCapacity(cfg.Ingest.LinkCacheSize),
+		engine.WithChainedEntries(cfg.Ingest.LinkedChunkSize),
+		engine.WithRetrievalAddrs(retrievalAddrs...),
+	)
+	if err != nil {
+		return err
+	}
+	if err = eng.Start(cctx.Context); err != nil {
+		return err
+	}
+	defer eng.Shutdown()
+
+	newIdentity, err := config.CreateIdentity(cctx.App.Writer)
+	if err != nil {
+		return err
+	}
+	newID, newKey, err := newIdentity.DecodeOrCreate(cctx.App.Writer)
+	if err != nil {
+		return err
+	}
+
+	// Persist the new identity before the datastore refers to it, so that it
+	// is not lost if the config file cannot be saved.
+	if err = writeIdentityFile(identityFile, newIdentity); err != nil {
+		return fmt.Errorf("cannot save new identity: %w", err)
+	}
+
+	adCid, err := eng.RotateKey(cctx.Context, newKey)
+	if err != nil {
+		if rmErr := os.Remove(identityFile); rmErr != nil {
+			return fmt.Errorf("failed to rotate key: %w; also failed to remove %s: %s", err, identityFile, rmErr)
+		}
+		return fmt.Errorf("failed to rotate key: %w", err)
+	}
+
+	cfg.Identity = newIdentity
+	if err = cfg.Save(configFile); err != nil {
+		return fmt.Errorf("rotated key but failed to save config; the new identity is in %s: %w", identityFile, err)
+	}
+	if err = os.Remove(identityFile); err != nil {
+		fmt.Fprintf(cctx.App.ErrWriter, "Failed to remove %s: %s\n", identityFile, err)
+	}
+
+	fmt.Fprintf(cctx.App.Writer, "Rotated provider identity from %s to %s\n", oldID, newID)
+	fmt.Fprintf(cctx.App.Writer, "Latest advertisement: %s\n", adCid)
+	return nil
+}
+
+// writeIdentityFile writes the given identity to a new file that only the
+// current user can read.
+func writeIdentityFile(path string, identity config.Identity) error {
+	buf, err := config.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
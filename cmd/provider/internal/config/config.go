@@ -19,6 +19,7 @@ type Config struct {
 	Bootstrap        Bootstrap
 	DirectAnnounce   DirectAnnounce
 	DelegatedRouting DelegatedRouting
+	Metrics          Metrics
 }
 
 const (
@@ -103,6 +104,7 @@ func Load(filePath string) (*Config, error) {
 		ProviderServer:   NewProviderServer(),
 		DirectAnnounce:   NewDirectAnnounce(),
 		DelegatedRouting: NewDelegatedRouting(),
+		Metrics:          NewMetrics(),
 	}
 
 	if err = json.NewDecoder(f).Decode(&cfg); err != nil {
@@ -13,6 +13,10 @@ type HttpPublisher struct {
 	// ListenMultiaddr is the address of the interface to listen for HTTP
 	// requests for advertisements.
 	ListenMultiaddr string
+	// BearerTokens maps the bearer tokens accepted by the HTTP publisher to
+	// the IDs of the peers they authenticate. Requests are allowed or denied
+	// by the Ingest.SyncPolicy according to the peer they authenticate as.
+	BearerTokens map[string]string `json:",omitempty"`
 }
 
 // NewHttpPublisher instantiates a new config with default values.
@@ -6,6 +6,8 @@ const (
 	// Multihashes are 128 bytes so 16384 results in 0.25MiB chunk when full.
 	defaultLinkedChunkSize = 16384
 	defaultPubSubTopic     = "/indexer/ingest/mainnet"
+	// Audit 16 context IDs per lister audit interval.
+	defaultListerAuditBatchSize = 16
 )
 
 type PublisherKind string
@@ -21,11 +23,21 @@ type Ingest struct {
 	// LRU eviction.  If a single linked list has more links than the cache can
 	// hold, the cache is resized to be able to hold all links.
 	LinkCacheSize int
+	// LinkCacheByteSize is the maximum total size in bytes of the chunks that
+	// the link cache stores before LRU eviction. If set, it takes precedence
+	// over LinkCacheSize.
+	LinkCacheByteSize int64 `json:",omitempty"`
 	// LinkedChunkSize is the number of multihashes in each chunk of in the
 	// advertised entries linked list.  If multihashes are 128 bytes, then
 	// setting LinkedChunkSize = 16384 will result in blocks of about 2Mb when
 	// full.
 	LinkedChunkSize int
+	// LinkedChunkByteSize is the maximum size in bytes of each encoded chunk
+	// in the advertised entries linked list. If set, multihashes are packed
+	// into each chunk until either LinkedChunkByteSize or LinkedChunkSize is
+	// reached, which bounds the size of the blocks when multihashes vary in
+	// length.
+	LinkedChunkByteSize int `json:",omitempty"`
 	// PubSubTopic used to advertise ingestion announcements.
 	PubSubTopic string
 	// PurgeLinkCache tells whether to purge the link cache on daemon startup.
@@ -36,21 +48,34 @@ type Ingest struct {
 
 	// PublisherKind specifies which dagsync.Publisher implementation to use.
 	PublisherKind PublisherKind
+	// PublisherKinds specifies several dagsync.Publisher implementations to
+	// run side by side, e.g. both "dtsync" and "http". If set, it takes
+	// precedence over PublisherKind.
+	PublisherKinds []PublisherKind `json:",omitempty"`
 
 	// SyncPolicy configures which indexers are allowed to sync advertisements
 	// with this provider over a data transfer session.
 	SyncPolicy Policy
+
+	// ListerAuditInterval is the interval at which randomly picked advertised
+	// context IDs are checked for whether the multihashes listed for them
+	// still match the advertised entries. Zero disables the checks.
+	ListerAuditInterval Duration `json:",omitempty"`
+	// ListerAuditBatchSize is the number of context IDs checked per
+	// ListerAuditInterval.
+	ListerAuditBatchSize int `json:",omitempty"`
 }
 
 // NewIngest instantiates a new Ingest configuration with default values.
 func NewIngest() Ingest {
 	return Ingest{
-		LinkCacheSize:   defaultLinkCacheSize,
-		LinkedChunkSize: defaultLinkedChunkSize,
-		PubSubTopic:     defaultPubSubTopic,
-		HttpPublisher:   NewHttpPublisher(),
-		PublisherKind:   DTSyncPublisherKind,
-		SyncPolicy:      NewPolicy(),
+		LinkCacheSize:        defaultLinkCacheSize,
+		LinkedChunkSize:      defaultLinkedChunkSize,
+		PubSubTopic:          defaultPubSubTopic,
+		HttpPublisher:        NewHttpPublisher(),
+		PublisherKind:        DTSyncPublisherKind,
+		SyncPolicy:           NewPolicy(),
+		ListerAuditBatchSize: defaultListerAuditBatchSize,
 	}
 }
 
@@ -65,4 +90,15 @@ func (c *Ingest) PopulateDefaults() {
 	if c.PubSubTopic == "" {
 		c.PubSubTopic = defaultPubSubTopic
 	}
+	if c.ListerAuditBatchSize == 0 {
+		c.ListerAuditBatchSize = defaultListerAuditBatchSize
+	}
+}
+
+// Publishers returns the kinds of publisher to run.
+func (c *Ingest) Publishers() []PublisherKind {
+	if len(c.PublisherKinds) != 0 {
+		return c.PublisherKinds
+	}
+	return []PublisherKind{c.PublisherKind}
 }
@@ -27,6 +27,7 @@ func InitWithIdentity(identity Identity) (*Config, error) {
 		ProviderServer:   NewProviderServer(),
 		AdminServer:      NewAdminServer(),
 		DelegatedRouting: NewDelegatedRouting(),
+		Metrics:          NewMetrics(),
 	}, nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/ipfs/go-cid"
@@ -22,7 +23,7 @@ var (
 	ListCmd = &cli.Command{
 		Name:        "list",
 		Aliases:     []string{"ls"},
-		Subcommands: []*cli.Command{listAdSubCmd, listCarSubCmd},
+		Subcommands: []*cli.Command{listAdSubCmd, listCarSubCmd, listContextIDSubCmd},
 	}
 
 	adCid      = cid.Undef
@@ -73,6 +74,28 @@ var (
 			adminAPIFlag,
 		},
 	}
+
+	listContextIDProvider string
+	listContextIDSubCmd   = &cli.Command{
+		Name:    "contextid",
+		Aliases: []string{"ctxid"},
+		Usage:   "Lists the context IDs currently advertised by an standalone instance of index-provider daemon.",
+		Description: `Lists the context IDs that have been put but not removed since, along with their entries CID,
+metadata and the CID of the advertisement that last put them.
+
+If the key option is specified, only the context ID matching the key is looked up.`,
+		Action: doListContextIDs,
+		Flags: []cli.Flag{
+			adminAPIFlag,
+			&cli.StringFlag{
+				Name:        "provider",
+				Usage:       "The ID of the provider for which to list context IDs. If not specified the default provider is used.",
+				Aliases:     []string{"p"},
+				Destination: &listContextIDProvider,
+			},
+			keyFlag,
+		},
+	}
 )
 
 func beforeGetAdvertisements(cctx *cli.Context) error {
@@ -210,3 +233,45 @@ func doListCars(cctx *cli.Context) error {
 	_, err = cctx.App.Writer.Write(b.Bytes())
 	return err
 }
+
+func doListContextIDs(cctx *cli.Context) error {
+	q := url.Values{}
+	if listContextIDProvider != "" {
+		q.Set("provider", listContextIDProvider)
+	}
+
+	var infos []adminserver.ContextIDRes
+	if cctx.IsSet(keyFlag.Name) {
+		if _, err := base64.StdEncoding.DecodeString(keyFlagValue); err != nil {
+			return errors.New("key is not a valid base64 encoded string")
+		}
+		q.Set("contextid", keyFlagValue)
+		var res adminserver.ContextIDRes
+		if err := doHttpGetReq(cctx.Context, adminAPIFlagValue+"/admin/contextid?"+q.Encode(), &res); err != nil {
+			return err
+		}
+		infos = append(infos, res)
+	} else {
+		var res adminserver.ListContextIDsRes
+		if err := doHttpGetReq(cctx.Context, adminAPIFlagValue+"/admin/list/contextid?"+q.Encode(), &res); err != nil {
+			return err
+		}
+		infos = res.ContextIDs
+	}
+
+	var b bytes.Buffer
+	for _, info := range infos {
+		b.WriteString(fmt.Sprintf("ContextID:    %s\n", base64.StdEncoding.EncodeToString(info.ContextID)))
+		b.WriteString(fmt.Sprintf("ProviderID:   %s\n", info.Provider))
+		b.WriteString(fmt.Sprintf("Entries:      %s\n", info.Entries))
+		b.WriteString(fmt.Sprintf("Metadata:     %s\n", base64.StdEncoding.EncodeToString(info.Metadata)))
+		if info.AdvId.Defined() {
+			b.WriteString(fmt.Sprintf("Last Ad:      %s\n", info.AdvId))
+		} else {
+			b.WriteString("Last Ad:      unknown\n")
+		}
+		b.WriteString("\n")
+	}
+	_, err := cctx.App.Writer.Write(b.Bytes())
+	return err
+}
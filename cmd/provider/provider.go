@@ -46,6 +46,7 @@ func run() int {
 			ConnectCmd,
 			DaemonCmd,
 			FindCmd,
+			IdentityCmd,
 			ImportCmd,
 			IndexCmd,
 			InitCmd,
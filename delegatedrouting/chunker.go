@@ -10,6 +10,11 @@ import (
 	"github.com/ipfs/go-cid"
 )
 
+// contextIDPrefix prefixes the context IDs of the chunks, so that the lookups
+// of their multihashes can be routed to the listener when other listers are
+// registered on the same engine.
+var contextIDPrefix = []byte("delegatedrouting/")
+
 type chunker struct {
 	chunkByContextId map[string]*cidsChunk
 	currentChunk     *cidsChunk
@@ -108,5 +113,5 @@ func (ch *chunker) generateContextID(cidsMap map[cid.Cid]struct{}) []byte {
 		hasher.Write([]byte(c))
 	}
 	hasher.Write(ch.nonceGen())
-	return hasher.Sum(nil)
+	return hasher.Sum(append([]byte{}, contextIDPrefix...))
 }
@@ -1,6 +1,7 @@
 package delegatedrouting
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -139,12 +140,14 @@ func New(ctx context.Context, engine provider.Interface,
 			return nil, fmt.Errorf("multihasLister couldn't find a chunk for contextID %s", contextIDToStr(contextID))
 		},
 	}
-	engine.RegisterMultihashLister(lister.MultihashLister)
-
 	log.Info("Initialising from the datastore")
+	var unprefixedContextIDs [][]byte
 	err := listener.dsWrapper.initialiseFromTheDatastore(ctx, func(n *cidNode) {
 		listener.cidQueue.recordCidNode(n)
 	}, func(chunk *cidsChunk) {
+		if !bytes.HasPrefix(chunk.ContextID, contextIDPrefix) {
+			unprefixedContextIDs = append(unprefixedContextIDs, chunk.ContextID)
+		}
 		// Do not need to add chunk to the in-memory index as old chunks have been already processed by the engine
 		now := time.Now()
 		for c := range chunk.Cids {
@@ -199,6 +202,19 @@ func New(ctx context.Context, engine provider.Interface,
 		}
 	}
 
+	// Only claim lookups for the context IDs of the chunks if the engine
+	// supports it, so that other listers registered on the same engine, such
+	// as the CAR supplier of the daemon, keep working. Chunks persisted before
+	// their context IDs were prefixed are claimed one by one.
+	if router, ok := engine.(provider.MultihashListerRouter); ok {
+		router.RegisterMultihashListerFor(lister.MultihashLister, "", contextIDPrefix)
+		for _, contextID := range unprefixedContextIDs {
+			router.RegisterMultihashListerFor(lister.MultihashLister, "", contextID)
+		}
+	} else {
+		engine.RegisterMultihashLister(lister.MultihashLister)
+	}
+
 	listener.stats.start()
 
 	// start flush worker
@@ -10,6 +10,8 @@ import (
 	"github.com/ipfs/go-datastore"
 )
 
+var ContextIDPrefix = contextIDPrefix
+
 func ChunkExists(ctx context.Context, listener *Listener, cids []cid.Cid, nonceGen func() []byte) bool {
 	cidsMap := cidsListToMap(cids)
 	ctxID := listener.chunker.generateContextID(cidsMap)
@@ -1391,7 +1391,7 @@ func generateContextID(cids []string, nonce []byte) []byte {
 		hasher.Write([]byte(c))
 	}
 	hasher.Write(nonce)
-	return hasher.Sum(nil)
+	return hasher.Sum(append([]byte{}, drouting.ContextIDPrefix...))
 }
 
 func newCid(s string) cid.Cid {
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const advertisedAddrsPrefix = "map/provAddrs/"
+
+// UpdateAddrs sets the retrieval addresses of the default provider, and
+// publishes an advertisement with no entries and no context ID to signal the
+// new addresses to indexer nodes. The new addresses are only set once the
+// advertisement is published, and are used by all advertisements published
+// from then on.
+//
+// If the default provider has not published any non-removal advertisement
+// yet, there are no addresses to update at indexer nodes: the addresses are
+// set without publishing an advertisement, and cid.Undef is returned with no
+// error. If the addresses are the same as the ones last advertised by the
+// default provider then provider.ErrAlreadyAdvertised is returned.
+func (e *Engine) UpdateAddrs(ctx context.Context, addrs []multiaddr.Multiaddr) (cid.Cid, error) {
+	if len(addrs) == 0 {
+		return cid.Undef, fmt.Errorf("at least one retrieval address must be specified")
+	}
+
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	advertised, found, err := e.getAdvertisedAddrs(ctx, e.providerID())
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !found {
+		e.setRetrievalAddrs(addrs)
+		return cid.Undef, nil
+	}
+	if !addrsDiffer(advertised, addrs) {
+		e.setRetrievalAddrs(addrs)
+		return cid.Undef, provider.ErrAlreadyAdvertised
+	}
+
+	c, err := e.publishAddrsAdv(ctx, addrs)
+	if err != nil {
+		return cid.Undef, err
+	}
+	e.setRetrievalAddrs(addrs)
+	return c, nil
+}
+
+// retrievalAddrs returns the current retrieval addresses of the default
+// provider.
+func (e *Engine) retrievalAddrs() []multiaddr.Multiaddr {
+	e.addrsLk.RLock()
+	defer e.addrsLk.RUnlock()
+	return e.provider.Addrs
+}
+
+func (e *Engine) setRetrievalAddrs(addrs []multiaddr.Multiaddr) {
+	e.addrsLk.Lock()
+	defer e.addrsLk.Unlock()
+	e.provider.Addrs = addrs
+}
+
+// addrsChanged checks whether the current retrieval addresses of the default
+// provider differ from the ones in its latest non-removal advertisement. If
+// there is no such advertisement then the addresses are considered unchanged,
+// since no indexer node can have stale addresses.
+//
+// The caller must hold Engine.cblk.
+func (e *Engine) addrsChanged(ctx context.Context) (bool, error) {
+	advertised, found, err := e.getAdvertisedAddrs(ctx, e.providerID())
+	if err != nil || !found {
+		return false, err
+	}
+	return addrsDiffer(advertised, e.retrievalAddrs()), nil
+}
+
+// addrsDiffer checks whether the given addresses differ from the advertised
+// ones, regardless of their order.
+func addrsDiffer(advertised []string, addrs []multiaddr.Multiaddr) bool {
+	if len(addrs) != len(advertised) {
+		return true
+	}
+	set := make(map[string]struct{}, len(advertised))
+	for _, a := range advertised {
+		set[a] = struct{}{}
+	}
+	for _, a := range addrs {
+		if _, ok := set[a.String()]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// putAdvertisedAddrs records the addresses of the given advertisement as the
+// ones last advertised by its provider, unless it is a removal. The record is
+// written to w, which is the journal of the publish in progress.
+func (e *Engine) putAdvertisedAddrs(ctx context.Context, w datastore.Write, adv schema.Advertisement) error {
+	if adv.IsRm {
+		return nil
+	}
+	value, err := json.Marshal(adv.Addresses)
+	if err != nil {
+		return err
+	}
+	return w.Put(ctx, datastore.NewKey(advertisedAddrsPrefix+adv.Provider), value)
+}
+
+// getAdvertisedAddrs returns the addresses last advertised by the given
+// provider in a non-removal advertisement, and whether there is such an
+// advertisement.
+func (e *Engine) getAdvertisedAddrs(ctx context.Context, p peer.ID) ([]string, bool, error) {
+	value, err := e.ds.Get(ctx, datastore.NewKey(advertisedAddrsPrefix+p.String()))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("could not get advertised retrieval addresses: %w", err)
+	}
+	var addrs []string
+	if err = json.Unmarshal(value, &addrs); err != nil {
+		return nil, false, fmt.Errorf("could not decode advertised retrieval addresses: %w", err)
+	}
+	return addrs, true, nil
+}
+
+// publishAddrsAdv publishes an advertisement with the given retrieval
+// addresses of the default provider, no entries and no context ID.
+//
+// The caller must hold Engine.cblk.
+func (e *Engine) publishAddrsAdv(ctx context.Context, addrs []multiaddr.Multiaddr) (cid.Cid, error) {
+	// The advertisement requires a valid metadata even though it is not used.
+	md := metadata.Default.New()
+	mdBytes, err := md.MarshalBinary()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	stringAddrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		stringAddrs = append(stringAddrs, addr.String())
+	}
+	adv := schema.Advertisement{
+		Provider:  e.providerID().String(),
+		Addresses: stringAddrs,
+		Entries:   schema.NoEntries,
+		Metadata:  mdBytes,
+	}
+
+	prevAdvID, err := e.getLatestAdCid(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not get latest advertisement: %s", err)
+	}
+	if prevAdvID != cid.Undef {
+		adv.PreviousID = cidlink.Link{Cid: prevAdvID}
+	}
+	if err = adv.Sign(e.signingKey()); err != nil {
+		return cid.Undef, err
+	}
+
+	c, err := e.publishLocal(ctx, &publishJournal{}, adv)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to publish advertisement locally: %w", err)
+	}
+	log.Infow("Published retrieval addresses update", "adCid", c, "addrs", stringAddrs)
+
+	e.announce(ctx, c)
+	return c, nil
+}
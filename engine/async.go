@@ -0,0 +1,551 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	publishQueuePrefix = "async/queue/"
+
+	// maxRetainedPublishTasks is the number of finished publish tasks that
+	// are kept around to be looked up by ID.
+	maxRetainedPublishTasks = 1024
+)
+
+var (
+	// ErrPublishTaskNotFound signals that no publish task exists with a given
+	// ID, or that it finished too long ago to still be retained.
+	ErrPublishTaskNotFound = errors.New("publish task not found")
+
+	errPublishInterrupted = errors.New("engine shut down before publish completed; it resumes once the engine is restarted")
+	errEngineNotStarted   = errors.New("engine is not started")
+)
+
+// PublishState is the state of a publish queued via Engine.NotifyPutAsync.
+type PublishState int
+
+const (
+	// PublishQueued indicates that the publish is waiting for a worker.
+	PublishQueued PublishState = iota
+	// PublishRunning indicates that the multihashes are being chunked, or the
+	// advertisement is being linked into the chain.
+	PublishRunning
+	// PublishDone indicates that the advertisement was published.
+	PublishDone
+	// PublishFailed indicates that the publish failed.
+	PublishFailed
+)
+
+func (s PublishState) String() string {
+	switch s {
+	case PublishQueued:
+		return "queued"
+	case PublishRunning:
+		return "running"
+	case PublishDone:
+		return "done"
+	case PublishFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// PublishTask is a handle on a publish queued via Engine.NotifyPutAsync, which
+// can be waited on, or polled via Engine.GetPublishTask.
+type PublishTask struct {
+	// ID uniquely identifies the task. IDs of tasks queued later sort after.
+	ID string
+
+	rec  publishRecord
+	done chan struct{}
+	// restored is true if the publish was restored from the datastore on
+	// start, and listerGen is the publishQueue.listerGen as of when it was
+	// last picked up by a worker.
+	restored  bool
+	listerGen int
+
+	lk    sync.Mutex
+	state PublishState
+	adCid cid.Cid
+	err   error
+}
+
+// PublishTaskStatus is a snapshot of the status of a PublishTask.
+type PublishTaskStatus struct {
+	ID    string
+	State PublishState
+	// AdCid is the CID of the published advertisement once done.
+	AdCid cid.Cid
+	// Err is the cause of failure once failed.
+	Err error
+}
+
+// PublishQueueStatus describes the queue of asynchronous publishes.
+//
+// See: Engine.PublishQueueStatus.
+type PublishQueueStatus struct {
+	// Queued is the number of publishes waiting for a worker, i.e. the depth
+	// of the queue, including the publishes restored on start that wait for
+	// their multihash lister to be registered.
+	Queued int
+	// Running is the number of publishes being processed by a worker.
+	Running int
+	// Workers is the number of workers.
+	Workers int
+}
+
+// publishRecord is the persisted form of a queued publish.
+type publishRecord struct {
+	// Provider is empty for the default provider, in which case the retrieval
+	// addresses are the ones current at the time of publishing.
+	Provider  string    `json:"p,omitempty"`
+	Addrs     []string  `json:"a,omitempty"`
+	ContextID []byte    `json:"c"`
+	Metadata  []byte    `json:"m"`
+	Expiry    time.Time `json:"x"`
+}
+
+// Wait blocks until the publish is done or failed, or the context is
+// cancelled, and returns the CID of the published advertisement.
+func (t *PublishTask) Wait(ctx context.Context) (cid.Cid, error) {
+	select {
+	case <-ctx.Done():
+		return cid.Undef, ctx.Err()
+	case <-t.done:
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.adCid, t.err
+}
+
+// Done returns a channel that is closed once the publish is done or failed.
+func (t *PublishTask) Done() <-chan struct{} {
+	return t.done
+}
+
+// Status returns the current status of the publish.
+func (t *PublishTask) Status() PublishTaskStatus {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return PublishTaskStatus{
+		ID:    t.ID,
+		State: t.state,
+		AdCid: t.adCid,
+		Err:   t.err,
+	}
+}
+
+func (t *PublishTask) setState(state PublishState) {
+	t.lk.Lock()
+	t.state = state
+	t.lk.Unlock()
+}
+
+func (t *PublishTask) finish(adCid cid.Cid, err error) {
+	t.lk.Lock()
+	t.adCid = adCid
+	t.err = err
+	t.state = PublishDone
+	if err != nil {
+		t.state = PublishFailed
+	}
+	t.lk.Unlock()
+	close(t.done)
+}
+
+// publishQueue durably queues publishes, and processes them with a pool of
+// workers. The multihashes of each publish are chunked concurrently, while
+// linking the advertisements into the chain is serialized by the chain lock.
+type publishQueue struct {
+	e       *Engine
+	workers int
+
+	// lk guards the fields below.
+	lk       sync.Mutex
+	pending  []*PublishTask
+	tasks    map[string]*PublishTask
+	finished []string
+	running  int
+	lastID   int64
+	// parked holds the restored publishes that wait for their multihash
+	// lister, and listerGen counts the multihash lister registrations.
+	parked    []*PublishTask
+	listerGen int
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newPublishQueue creates a publish queue, restores the publishes that were
+// queued but not yet published from the datastore, and starts the workers.
+func (e *Engine) newPublishQueue(ctx context.Context) (*publishQueue, error) {
+	q := &publishQueue{
+		e:       e,
+		workers: e.asyncWorkers,
+		tasks:   make(map[string]*PublishTask),
+		wake:    make(chan struct{}, 1),
+	}
+
+	// Keys sort in the order publishes were queued.
+	results, err := e.ds.Query(ctx, query.Query{
+		Prefix: datastore.NewKey(publishQueuePrefix).String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not query publish queue: %w", err)
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("could not query publish queue: %w", r.Error)
+		}
+		var rec publishRecord
+		if err = json.Unmarshal(r.Value, &rec); err != nil {
+			return nil, fmt.Errorf("could not decode queued publish: %w", err)
+		}
+		t := newPublishTask(datastore.RawKey(r.Key).BaseNamespace(), rec)
+		t.restored = true
+		if id, err := strconv.ParseInt(t.ID, 16, 64); err == nil && id > q.lastID {
+			q.lastID = id
+		}
+		q.pending = append(q.pending, t)
+		q.tasks[t.ID] = t
+	}
+	if len(q.pending) != 0 {
+		log.Infow("Restored queued publishes", "count", len(q.pending))
+	}
+
+	wctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.run(wctx)
+	}
+	q.notify()
+	return q, nil
+}
+
+func newPublishTask(id string, rec publishRecord) *PublishTask {
+	return &PublishTask{
+		ID:    id,
+		rec:   rec,
+		done:  make(chan struct{}),
+		state: PublishQueued,
+	}
+}
+
+// enqueue durably records the given publish, and queues it for a worker.
+func (q *publishQueue) enqueue(ctx context.Context, rec publishRecord) (*PublishTask, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	// Use the time as the ID so that IDs sort in the order publishes are
+	// queued, across restarts.
+	id := time.Now().UnixNano()
+	if id <= q.lastID {
+		id = q.lastID + 1
+	}
+	q.lastID = id
+	t := newPublishTask(fmt.Sprintf("%016x", id), rec)
+	if err = q.e.ds.Put(ctx, publishQueueKey(t.ID), b); err != nil {
+		return nil, fmt.Errorf("could not store queued publish: %w", err)
+	}
+	q.pending = append(q.pending, t)
+	q.tasks[t.ID] = t
+	q.notifyLocked()
+	return t, nil
+}
+
+func publishQueueKey(id string) datastore.Key {
+	return datastore.NewKey(publishQueuePrefix + id)
+}
+
+func (q *publishQueue) notify() {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.notifyLocked()
+}
+
+// notifyLocked wakes up a worker if there are pending publishes.
+func (q *publishQueue) notifyLocked() {
+	if len(q.pending) == 0 {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the next pending publish, if any.
+func (q *publishQueue) next() *PublishTask {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	t := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	q.running++
+	t.listerGen = q.listerGen
+	t.setState(PublishRunning)
+	// Let other workers pick up the remaining publishes.
+	q.notifyLocked()
+	return t
+}
+
+func (q *publishQueue) run(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+		for t := q.next(); t != nil; t = q.next() {
+			q.process(ctx, t)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// process publishes the advertisement of the given task. Publishes restored on
+// start are parked if their multihash lister is not registered yet.
+func (q *publishQueue) process(ctx context.Context, t *PublishTask) {
+	adCid, err := q.e.publishRecord(ctx, t.rec)
+	if err != nil && ctx.Err() != nil {
+		// The publish is left in the datastore to resume on restart.
+		q.lk.Lock()
+		q.running--
+		q.lk.Unlock()
+		return
+	}
+	if errors.Is(err, provider.ErrNoMultihashLister) && t.restored {
+		// Restored publishes may be picked up before their lister is
+		// registered, so they wait for it, and remain in the datastore.
+		log.Warnw("No multihash lister for restored publish; waiting for one to be registered", "id", t.ID, "contextID", base64.StdEncoding.EncodeToString(t.rec.ContextID))
+		q.park(t)
+		return
+	}
+
+	if derr := q.e.ds.Delete(context.Background(), publishQueueKey(t.ID)); derr != nil {
+		log.Errorw("Failed to delete published publish from queue", "id", t.ID, "err", derr)
+	}
+	if err != nil {
+		log.Warnw("Queued publish failed", "id", t.ID, "contextID", base64.StdEncoding.EncodeToString(t.rec.ContextID), "err", err)
+	}
+	t.finish(adCid, err)
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.running--
+	q.finished = append(q.finished, t.ID)
+	if len(q.finished) > maxRetainedPublishTasks {
+		delete(q.tasks, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
+
+// park puts the given restored task aside until a multihash lister is
+// registered. The task is queued again right away if a lister was registered
+// since it was picked up, as it may be the one it lacked.
+func (q *publishQueue) park(t *PublishTask) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.running--
+	t.setState(PublishQueued)
+	if t.listerGen != q.listerGen {
+		q.pending = append(q.pending, t)
+		q.notifyLocked()
+		return
+	}
+	q.parked = append(q.parked, t)
+}
+
+// listerRegistered queues the parked tasks again, since the multihash lister
+// just registered may be the one they lack.
+func (q *publishQueue) listerRegistered() {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.listerGen++
+	q.pending = append(q.pending, q.parked...)
+	q.parked = nil
+	q.notifyLocked()
+}
+
+func (q *publishQueue) status() PublishQueueStatus {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return PublishQueueStatus{
+		Queued:  len(q.pending) + len(q.parked),
+		Running: q.running,
+		Workers: q.workers,
+	}
+}
+
+func (q *publishQueue) task(id string) (*PublishTask, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	t, ok := q.tasks[id]
+	return t, ok
+}
+
+// close stops the workers, and fails the unfinished tasks. Their publishes
+// remain queued in the datastore, and resume once the engine is restarted.
+func (q *publishQueue) close() {
+	q.cancel()
+	q.wg.Wait()
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for _, t := range q.tasks {
+		select {
+		case <-t.done:
+		default:
+			t.finish(cid.Undef, errPublishInterrupted)
+		}
+	}
+}
+
+// publishRecord chunks the multihashes of the given queued publish without
+// holding the chain lock, then links its advertisement into the chain.
+func (e *Engine) publishRecord(ctx context.Context, rec publishRecord) (cid.Cid, error) {
+	var p peer.ID
+	var addrs []multiaddr.Multiaddr
+	if rec.Provider != "" {
+		var err error
+		if p, err = peer.Decode(rec.Provider); err != nil {
+			return cid.Undef, fmt.Errorf("invalid provider: %w", err)
+		}
+		addrs = make([]multiaddr.Multiaddr, 0, len(rec.Addrs))
+		for _, a := range rec.Addrs {
+			maddr, err := multiaddr.NewMultiaddr(a)
+			if err != nil {
+				return cid.Undef, fmt.Errorf("invalid address: %w", err)
+			}
+			addrs = append(addrs, maddr)
+		}
+	}
+	md := metadata.Default.New()
+	if err := md.UnmarshalBinary(rec.Metadata); err != nil {
+		return cid.Undef, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	// Only chunk context IDs that are not advertised yet; the others reuse
+	// their advertised entries. This is checked again once the chain lock is
+	// held, in case the context ID is advertised meanwhile. The default
+	// provider is only resolved then too, in case its key is rotated.
+	chunkP := p
+	if chunkP == "" {
+		chunkP = e.providerID()
+	}
+	var entries cidlink.Link
+	_, err := e.getKeyCidMap(ctx, chunkP, rec.ContextID)
+	if errors.Is(err, datastore.ErrNotFound) {
+		if entries, err = e.chunkEntries(ctx, chunkP, rec.ContextID); err != nil {
+			return cid.Undef, err
+		}
+	} else if err != nil {
+		return cid.Undef, fmt.Errorf("could not get entries cid by provider + context id: %w", err)
+	}
+	return e.publishAdvForIndex(ctx, p, addrs, rec.ContextID, md, false, rec.Expiry, entries)
+}
+
+// NotifyPutAsync queues the publish of the advertisement that Engine.NotifyPut
+// would publish, and returns as soon as the publish is durably queued.
+//
+// Queued publishes are processed by a pool of workers, which chunk the
+// multihashes of different context IDs concurrently; only linking the
+// advertisements into the chain is serialized. The order in which queued
+// publishes are linked is therefore not guaranteed. Publishes still queued
+// when the engine shuts down resume once it is restarted, and their tasks
+// fail with an error meanwhile. Since the multihash listers are usually
+// registered after the engine is started, restored publishes whose lister is
+// not registered yet wait until one is registered via
+// Engine.RegisterMultihashLister or Engine.RegisterMultihashListerFor.
+// Otherwise, publishes fail the same way as Engine.NotifyPut.
+//
+// The returned task may be waited on, or polled by ID via
+// Engine.GetPublishTask.
+//
+// See: WithAsyncPublishWorkers, Engine.PublishQueueStatus.
+func (e *Engine) NotifyPutAsync(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata, opts ...provider.NotifyOption) (*PublishTask, error) {
+	if e.publishes == nil {
+		return nil, errEngineNotStarted
+	}
+	expiry, err := notifyExpiry(opts)
+	if err != nil {
+		return nil, err
+	}
+	mdBytes, err := md.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rec := publishRecord{
+		ContextID: contextID,
+		Metadata:  mdBytes,
+		Expiry:    expiry,
+	}
+	if provider != nil {
+		rec.Provider = provider.ID.String()
+		for _, a := range provider.Addrs {
+			rec.Addrs = append(rec.Addrs, a.String())
+		}
+	}
+	return e.publishes.enqueue(ctx, rec)
+}
+
+// GetPublishTask returns the task of the publish with the given ID, queued via
+// Engine.NotifyPutAsync. Finished tasks are only retained for a while, after
+// which ErrPublishTaskNotFound is returned.
+func (e *Engine) GetPublishTask(id string) (*PublishTask, error) {
+	if e.publishes == nil {
+		return nil, ErrPublishTaskNotFound
+	}
+	t, ok := e.publishes.task(id)
+	if !ok {
+		return nil, ErrPublishTaskNotFound
+	}
+	return t, nil
+}
+
+// PublishQueueStatus returns the status of the queue of publishes made via
+// Engine.NotifyPutAsync.
+func (e *Engine) PublishQueueStatus() PublishQueueStatus {
+	if e.publishes == nil {
+		return PublishQueueStatus{}
+	}
+	return e.publishes.status()
+}
+
+// listerRegistered resumes the restored publishes that wait for a multihash
+// lister, if the engine is started.
+func (e *Engine) listerRegistered() {
+	if e.publishes != nil {
+		e.publishes.listerRegistered()
+	}
+}
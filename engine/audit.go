@@ -0,0 +1,270 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipni/go-libipni/ingest/schema"
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ListerMismatch describes a context ID for which the registered
+// provider.MultihashLister no longer returns the multihashes that were
+// advertised, as detected by the lister auditor. Indexers that sync the
+// entries of such a context ID once they are evicted from the entries cache
+// fail with ErrEntriesLinkMismatch.
+//
+// See: WithListerAudit, Engine.ListerMismatches.
+type ListerMismatch struct {
+	// Provider is the ID of the provider the context ID is advertised for.
+	Provider peer.ID
+	// ContextID is the advertised context ID.
+	ContextID []byte
+	// Want is the CID of the advertised entries.
+	Want cid.Cid
+	// Got is the CID of the entries chunked from the multihashes currently
+	// returned by the lister, or cid.Undef if it returned none.
+	Got cid.Cid
+	// DetectedAt is the time at which the mismatch was last detected.
+	DetectedAt time.Time
+}
+
+// listerAuditor periodically checks that the registered multihash listers
+// still return the advertised multihashes for a random sample of the
+// advertised context IDs.
+type listerAuditor struct {
+	e *Engine
+
+	// lk guards mismatches, which are keyed by provider and context ID.
+	lk         sync.Mutex
+	mismatches map[string]ListerMismatch
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// auditedContextID is an advertised context ID along with the CID of its
+// advertised entries.
+type auditedContextID struct {
+	provider  peer.ID
+	contextID []byte
+	entries   cid.Cid
+}
+
+func (e *Engine) startListerAuditor() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.auditor = &listerAuditor{
+		e:          e,
+		mismatches: make(map[string]ListerMismatch),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go e.auditor.run(ctx, e.auditInterval, e.auditBatchSize)
+}
+
+func (a *listerAuditor) run(ctx context.Context, interval time.Duration, batchSize int) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.auditSample(ctx, batchSize); err != nil && ctx.Err() == nil {
+			log.Errorw("Failed to audit multihash listers", "err", err)
+		}
+	}
+}
+
+// auditSample audits up to the given number of advertised context IDs,
+// picked at random.
+func (a *listerAuditor) auditSample(ctx context.Context, size int) error {
+	sample, err := a.sample(ctx, size)
+	if err != nil {
+		return err
+	}
+	for _, s := range sample {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = a.audit(ctx, s); err != nil {
+			log.Warnw("Failed to audit multihash lister", "provider", s.provider, "contextID", base64.StdEncoding.EncodeToString(s.contextID), "err", err)
+			metrics.Engine.ListerAudits.Add(ctx, 1, metrics.Attributes.AuditError)
+		}
+	}
+	return nil
+}
+
+// sample picks up to the given number of advertised context IDs uniformly at
+// random, across all providers.
+func (a *listerAuditor) sample(ctx context.Context, size int) ([]auditedContextID, error) {
+	prefix := datastore.NewKey(contextIDIndexPrefix).String()
+	results, err := a.e.ds.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, fmt.Errorf("could not query context IDs: %w", err)
+	}
+	defer results.Close()
+
+	// Reservoir sampling, so that the context IDs need not all be held in
+	// memory.
+	sample := make([]auditedContextID, 0, size)
+	var seen int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("could not query context IDs: %w", r.Error)
+		}
+		seen++
+		i := len(sample)
+		if i == size {
+			if i = rand.Intn(seen); i >= size {
+				continue
+			}
+		}
+		p, contextID, err := a.e.decodeContextIDIndex(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		s := auditedContextID{provider: p, contextID: contextID}
+		if i == len(sample) {
+			sample = append(sample, s)
+		} else {
+			sample[i] = s
+		}
+	}
+
+	// Look up the entries of the sampled context IDs only, skipping the ones
+	// removed meanwhile.
+	sampled := sample[:0]
+	for _, s := range sample {
+		s.entries, err = a.e.getKeyCidMap(ctx, s.provider, s.contextID)
+		if err != nil {
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("could not get entries cid by provider + context id: %w", err)
+		}
+		sampled = append(sampled, s)
+	}
+	return sampled, nil
+}
+
+// audit re-runs the lister of the given context ID, chunks the returned
+// multihashes with a throwaway chunker, and compares the resulting link with
+// the advertised entries.
+func (a *listerAuditor) audit(ctx context.Context, s auditedContextID) error {
+	log := log.With("provider", s.provider, "contextID", base64.StdEncoding.EncodeToString(s.contextID))
+
+	mhLister, err := a.e.multihashLister(s.provider, s.contextID, false)
+	if err != nil {
+		if errors.Is(err, provider.ErrNoMultihashLister) {
+			log.Debug("Skipped auditing context ID with no multihash lister")
+			return nil
+		}
+		return err
+	}
+	mhIter, err := mhLister(ctx, s.provider, s.contextID)
+	if err != nil {
+		return fmt.Errorf("could not list multihashes: %w", err)
+	}
+
+	// Chunk into an ephemeral store so that the entries cache is left as is.
+	store := &memstore.Store{}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	entriesChunker, err := a.e.chunker(&lsys)
+	if err != nil {
+		return fmt.Errorf("could not instantiate chunker: %w", err)
+	}
+	lnk, err := entriesChunker.Chunk(ctx, mhIter)
+	if err != nil {
+		return fmt.Errorf("could not chunk multihashes: %w", err)
+	}
+	got := schema.NoEntries.Cid
+	if lnk != nil {
+		got = lnk.(cidlink.Link).Cid
+	}
+
+	// The context ID may have been removed or updated meanwhile, in which
+	// case the result is moot.
+	current, err := a.e.getKeyCidMap(ctx, s.provider, s.contextID)
+	if err != nil || current != s.entries {
+		a.clear(s.provider, s.contextID)
+		return nil
+	}
+
+	if got == s.entries {
+		metrics.Engine.ListerAudits.Add(ctx, 1, metrics.Attributes.AuditMatch)
+		a.clear(s.provider, s.contextID)
+		return nil
+	}
+
+	metrics.Engine.ListerAudits.Add(ctx, 1, metrics.Attributes.AuditMismatch)
+	mismatch := ListerMismatch{
+		Provider:   s.provider,
+		ContextID:  s.contextID,
+		Want:       s.entries,
+		DetectedAt: time.Now(),
+	}
+	if lnk != nil {
+		mismatch.Got = got
+	}
+	log.Warnw("Multihash lister no longer returns the advertised multihashes; indexers will fail to sync the entries once evicted from cache", "want", mismatch.Want, "got", mismatch.Got)
+	a.lk.Lock()
+	a.mismatches[auditKey(s.provider, s.contextID)] = mismatch
+	a.lk.Unlock()
+	return nil
+}
+
+func (a *listerAuditor) clear(p peer.ID, contextID []byte) {
+	a.lk.Lock()
+	delete(a.mismatches, auditKey(p, contextID))
+	a.lk.Unlock()
+}
+
+func (a *listerAuditor) close() {
+	a.cancel()
+	<-a.done
+}
+
+func auditKey(p peer.ID, contextID []byte) string {
+	return string(p) + "/" + string(contextID)
+}
+
+// ListerMismatches returns the context IDs for which the lister auditor found
+// that the registered multihash lister no longer returns the advertised
+// multihashes, sorted by provider and context ID. A context ID is no longer
+// listed once it is found to match again, or is removed or updated. It
+// returns nil if the lister auditor is not enabled.
+//
+// See: WithListerAudit.
+func (e *Engine) ListerMismatches() []ListerMismatch {
+	if e.auditor == nil {
+		return nil
+	}
+	e.auditor.lk.Lock()
+	defer e.auditor.lk.Unlock()
+	mismatches := make([]ListerMismatch, 0, len(e.auditor.mismatches))
+	for _, m := range e.auditor.mismatches {
+		mismatches = append(mismatches, m)
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return auditKey(mismatches[i].Provider, mismatches[i].ContextID) < auditKey(mismatches[j].Provider, mismatches[j].ContextID)
+	})
+	return mismatches
+}
@@ -2,11 +2,15 @@ package chunker_test
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
 	"github.com/ipni/go-libipni/test"
 	provider "github.com/ipni/index-provider"
 	"github.com/ipni/index-provider/engine/chunker"
@@ -62,6 +66,133 @@ func benchmarkCachedChunker(ctx context.Context, byteSize int64, capacity int, m
 	}
 }
 
+func BenchmarkCachedChunker_Concurrent(b *testing.B) {
+	const capacity = 100
+	const mhCount = 10000
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var mhis [][]multihash.Multihash
+	for i := 0; i < capacity; i++ {
+		mhis = append(mhis, test.RandomMultihashes(mhCount))
+	}
+
+	// Compare the throughput of chunking distinct lists sequentially with chunking them
+	// concurrently, which should improve as long as chunking is not serialized.
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("ChainedEntryChunk/Concurrency_%d", concurrency), benchmarkCachedChunkerConcurrent(ctx, capacity, concurrency, mhis, chunker.NewChainChunkerFunc(16384)))
+	}
+}
+
+func benchmarkCachedChunkerConcurrent(ctx context.Context, capacity, concurrency int, mhis [][]multihash.Multihash, c chunker.NewChunkerFunc) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.SetBytes(int64(concurrency * len(mhis[0]) * 256 / 8)) // multicodec.Sha2_256
+		b.ReportAllocs()
+
+		store := dssync.MutexWrap(datastore.NewMapDatastore())
+		subject, err := chunker.NewCachedEntriesChunker(ctx, store, capacity, c, false)
+		require.NoError(b, err)
+		b.ResetTimer()
+
+		var next int
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			errs := make(chan error, concurrency)
+			for j := 0; j < concurrency; j++ {
+				mhi := provider.SliceMultihashIterator(mhis[next%len(mhis)])
+				next++
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := subject.Chunk(ctx, mhi)
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(b, err)
+			}
+		}
+		b.StopTimer()
+		require.NoError(b, subject.Close())
+	}
+}
+
+func BenchmarkCachedChunker_ConcurrentRegenerate(b *testing.B) {
+	const concurrency = 16
+	const mhCount = 10000
+	const byteSize = mhCount * 256 / 8 // multicodec.Sha2_256
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	mhs := test.RandomMultihashes(mhCount)
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := chunker.NewCachedEntriesChunker(ctx, store, 1, chunker.NewChainChunkerFunc(16384), false)
+	require.NoError(b, err)
+	root, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+	require.NoError(b, err)
+
+	// Regenerate the same evicted DAG as if requested by many indexers at once, which should cost
+	// about as much as regenerating it once.
+	b.SetBytes(byteSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		require.NoError(b, subject.Clear(ctx))
+		b.StartTimer()
+
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := subject.Regenerate(ctx, root, provider.SliceMultihashIterator(mhs))
+				if err != nil || got != root {
+					b.Errorf("failed to regenerate %s: got %v, err %v", root, got, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+	require.NoError(b, subject.Close())
+}
+
+func BenchmarkParallelHamtChunker(b *testing.B) {
+	const mhCount = 10000
+	const byteSize = mhCount * 256 / 8 // multicodec.Sha2_256
+
+	mhs := test.RandomMultihashes(mhCount)
+
+	// Compare building the HAMT serially with building its subtrees concurrently.
+	b.Run("HamtChunker", benchmarkHamtChunker(byteSize, mhs, chunker.NewHamtChunkerFunc(multicodec.Murmur3X64_64, 5, 3)))
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("ParallelHamtChunker/Concurrency_%d", concurrency), benchmarkHamtChunker(byteSize, mhs, chunker.NewParallelHamtChunkerFunc(multicodec.Murmur3X64_64, 5, 3, concurrency, 16384)))
+	}
+}
+
+func benchmarkHamtChunker(byteSize int64, mhs []multihash.Multihash, c chunker.NewChunkerFunc) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.SetBytes(byteSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ls := cidlink.DefaultLinkSystem()
+			store := &memstore.Store{}
+			ls.SetReadStorage(store)
+			ls.SetWriteStorage(store)
+			subject, err := c(&ls)
+			require.NoError(b, err)
+			root, err := subject.Chunk(context.Background(), provider.SliceMultihashIterator(mhs))
+			require.NoError(b, err)
+			require.NotNil(b, root)
+		}
+	}
+}
+
 func BenchmarkRestoreCache_ChainChunker(b *testing.B) {
 	const chunkSize = 1
 	const capacity = 100
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/golang/groupcache/lru"
 	"github.com/ipfs/go-cid"
@@ -19,6 +20,9 @@ import (
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/metrics"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -38,7 +42,9 @@ type (
 	// overlapping portion is not evicted unless all the DAGs that link to it are evicted.
 	//
 	// The number of DAGs cached will be at most equal to the given capacity. The capacity is
-	// immutable. DAGs are evicted as needed if the capacity is reached.
+	// immutable. DAGs are evicted as needed if the capacity is reached. Alternatively, the cache
+	// may be bounded by the total size of the cached chunks in bytes; see
+	// NewByteBoundedCachedEntriesChunker.
 	//
 	// See: NewCachedEntriesChunker.
 	CachedEntriesChunker struct {
@@ -66,12 +72,29 @@ type (
 		// onEvictedCtx is used to set the context to be used during cache eviction by operations
 		// performed via CachedEntriesChunker.performOnCache.
 		onEvictedCtx context.Context
-		// lock synchronizes the chunking, clearing the cache and reading the number of cached chains.
-		// Any function that performs Store on the linksystem should also grab this lock. See inline
-		// comments in Chunk.
+		// lock synchronizes the operations on cache, i.e. inserting chunked DAGs, evicting them,
+		// clearing the cache and reading the number of cached chains. The chunking itself runs
+		// outside of this lock so that chunking a large DAG does not block chunking other DAGs.
 		lock sync.Mutex
-		// chunker is the underlying chunker that generates a DAG from a provider.MultihashIterator.
-		chunker EntriesChunker
+		// storeLock synchronizes checking the existence of chunks in ds with storing, counting the
+		// overlap of and deleting them, so that concurrent chunking and eviction agree on which
+		// chunks are shared across DAGs.
+		storeLock sync.Mutex
+		// clearLock is held for reading while chunking and for writing while clearing the cache,
+		// so that the cache is not cleared from under in-flight chunking.
+		clearLock sync.RWMutex
+		// inflight deduplicates the concurrent regeneration of DAGs with the same root.
+		inflight singleflight.Group
+		// newChunker instantiates the underlying chunker that generates a DAG from a
+		// provider.MultihashIterator. A chunker is instantiated per call to Chunk, each with its
+		// own linksystem that collects the links of the DAG being chunked.
+		newChunker NewChunkerFunc
+		// maxBytes is the maximum total size of the cached chunks in bytes, or zero if the cache
+		// is bounded by the number of DAGs instead.
+		maxBytes int64
+		// size is the total size of the cached chunks in bytes, counting overlapping chunks once.
+		// It is only tracked if maxBytes is set, and is guarded by storeLock.
+		size int64
 	}
 
 	// NewChunkerFunc instantiates the core EntriesChunker to use for generating advertisement
@@ -86,7 +109,7 @@ type (
 //
 //	form via CachedEntriesChunker.GetRawCachedChunk.
 //
-// The shape of the DAGs is dictated by the underlying chunking logic that is instantiated once via
+// The shape of the DAGs is dictated by the underlying chunking logic that is instantiated via
 // newChunker function. See: NewHamtChunkerFunc, NewChainChunkerFunc.
 //
 // The growth of LRU cache is limited by the given capacity. The capacity specifies the number of
@@ -117,21 +140,47 @@ type (
 //
 // See: CachedEntriesChunker.Chunk, CachedEntriesChunker.GetRawCachedChunk.
 func NewCachedEntriesChunker(ctx context.Context, ds datastore.Batching, capacity int, newChunker NewChunkerFunc, purge bool) (*CachedEntriesChunker, error) {
+	return newCachedEntriesChunker(ctx, ds, capacity, 0, newChunker, purge)
+}
+
+// NewByteBoundedCachedEntriesChunker instantiates a new CachedEntriesChunker backed by a given
+// datastore, the same way as NewCachedEntriesChunker, except that the cache is bounded by the
+// total size of the cached chunks in bytes rather than by the number of cached DAGs.
+//
+// The serialized size of every cached chunk is tracked, counting chunks that overlap across DAGs
+// once. The least recently used DAGs are evicted until the size fits within maxBytes, while the
+// overlapping chunks are only deleted once all the DAGs that link to them are evicted. The most
+// recently cached DAG is never evicted, so that it can be served even if on its own it is larger
+// than maxBytes.
+//
+// Restoring the cache requires reading the size of every previously cached chunk. If maxBytes is
+// smaller than the size of the restored chunks, DAGs are evicted in no particular order.
+//
+// See: CachedEntriesChunker.ByteLen, CachedEntriesChunker.ByteCap.
+func NewByteBoundedCachedEntriesChunker(ctx context.Context, ds datastore.Batching, maxBytes int64, newChunker NewChunkerFunc, purge bool) (*CachedEntriesChunker, error) {
+	if maxBytes < 1 {
+		return nil, fmt.Errorf("invalid cache byte capacity: %d", maxBytes)
+	}
+	return newCachedEntriesChunker(ctx, ds, 0, maxBytes, newChunker, purge)
+}
+
+func newCachedEntriesChunker(ctx context.Context, ds datastore.Batching, capacity int, maxBytes int64, newChunker NewChunkerFunc, purge bool) (*CachedEntriesChunker, error) {
 	ls := &CachedEntriesChunker{
-		ds:    ds,
-		lsys:  cidlink.DefaultLinkSystem(),
-		cache: lru.New(capacity),
+		ds:         ds,
+		lsys:       cidlink.DefaultLinkSystem(),
+		cache:      lru.New(capacity),
+		newChunker: newChunker,
+		maxBytes:   maxBytes,
 	}
 
 	ls.lsys.StorageReadOpener = ls.storageReadOpener
 	ls.lsys.StorageWriteOpener = ls.storageWriteOpener
 	ls.cache.OnEvicted = ls.onEvicted
 
-	chunker, err := newChunker(&ls.lsys)
-	if err != nil {
+	// Instantiate the chunker once to fail early if it is misconfigured.
+	if _, err := newChunker(&ls.lsys); err != nil {
 		return nil, err
 	}
-	ls.chunker = chunker
 
 	// If cache is to be cleared don't bother restoring it.
 	if purge {
@@ -159,6 +208,8 @@ func (ls *CachedEntriesChunker) storageWriteOpener(lctx linking.LinkContext) (io
 	buf := bytes.NewBuffer(nil)
 	return buf, func(lnk ipld.Link) error {
 		ctx := lctx.Ctx
+		ls.storeLock.Lock()
+		defer ls.storeLock.Unlock()
 		exists, err := ls.ds.Has(ctx, dsKey(lnk))
 		if err != nil {
 			log.Errorf("Could not check existence of cache entry for key %s", lnk)
@@ -171,8 +222,12 @@ func (ls *CachedEntriesChunker) storageWriteOpener(lctx linking.LinkContext) (io
 		err = ls.ds.Put(ctx, dsKey(lnk), buf.Bytes())
 		if err != nil {
 			log.Errorf("Could not put cache entry for key %s", lnk)
+			return err
 		}
-		return err
+		if ls.maxBytes > 0 {
+			ls.size += int64(buf.Len())
+		}
+		return nil
 	}, nil
 }
 
@@ -201,23 +256,7 @@ func (ls *CachedEntriesChunker) onEvicted(k lru.Key, val interface{}) {
 		return
 	}
 	for _, link := range chunkLinks {
-		count, err := ls.countOverlap(ls.onEvictedCtx, link)
-		if err != nil {
-			ls.onEvictedErr = err
-			return
-		}
-
-		if count == 0 {
-			if err := ls.ds.Delete(ls.onEvictedCtx, dsKey(link)); err != nil {
-				log.Errorw("failed to delete cache", "key", link, "err", err)
-				ls.onEvictedErr = err
-				return
-			}
-			continue
-		}
-
-		err = ls.decrementOverlap(ls.onEvictedCtx, link)
-		if err != nil {
+		if err := ls.releaseChunk(ls.onEvictedCtx, link); err != nil {
 			ls.onEvictedErr = err
 			return
 		}
@@ -228,7 +267,36 @@ func (ls *CachedEntriesChunker) onEvicted(k lru.Key, val interface{}) {
 	if err != nil {
 		log.Errorw("failed to prune persisted cache key after eviction", "err", err)
 		ls.onEvictedErr = err
+		return
+	}
+	metrics.Chunker.CacheEvictions.Add(ls.onEvictedCtx, 1)
+}
+
+// releaseChunk deletes the given chunk of an evicted DAG, unless it overlaps with other DAGs in
+// which case its overlap count is decremented instead.
+func (ls *CachedEntriesChunker) releaseChunk(ctx context.Context, link ipld.Link) error {
+	ls.storeLock.Lock()
+	defer ls.storeLock.Unlock()
+
+	count, err := ls.countOverlap(ctx, link)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return ls.decrementOverlap(ctx, link)
+	}
+	if ls.maxBytes > 0 {
+		size, err := ls.ds.GetSize(ctx, dsKey(link))
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+		ls.size -= int64(size)
+	}
+	if err := ls.ds.Delete(ctx, dsKey(link)); err != nil {
+		log.Errorw("failed to delete cache", "key", link, "err", err)
+		return err
 	}
+	return nil
 }
 
 func dsKey(l ipld.Link) datastore.Key {
@@ -236,22 +304,20 @@ func dsKey(l ipld.Link) datastore.Key {
 }
 
 // Chunk chunks the multihashes supplied by the given mhi into a DAG and returns the link to root.
+//
+// Chunk is safe to call concurrently. The chunking runs concurrently with other calls to Chunk;
+// only storing the chunks and inserting the resulting DAG into the cache are serialized.
 func (ls *CachedEntriesChunker) Chunk(ctx context.Context, mhi provider.MultihashIterator) (ipld.Link, error) {
-	ls.lock.Lock()
-	defer func() {
-		ls.lsys.StorageWriteOpener = ls.storageWriteOpener
-		ls.lock.Unlock()
-	}()
+	ls.clearLock.RLock()
+	defer ls.clearLock.RUnlock()
 
 	var links []ipld.Link
 	var linksEnc []byte
-	// Intercept the links that are being stored.
-	// It is safe to swap the StorageWriteOpener, because:
-	//  - Chunk is the only place we expect to write to the linksystem, and
-	//  - calls to Chunk are synchronized using a lock.
-	// It is also an efficient way to collecting all the links without having to traverse the dag
-	// from the root link, or make the EntriesChunker interface more complex.
-	ls.lsys.StorageWriteOpener = func(ctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+	// Intercept the links that are being stored, using a linksystem and a chunker dedicated to
+	// this call. It is an efficient way to collecting all the links without having to traverse
+	// the dag from the root link, or make the EntriesChunker interface more complex.
+	lsys := ls.lsys
+	lsys.StorageWriteOpener = func(ctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
 		opener, committer, err := ls.storageWriteOpener(ctx)
 		if err != nil {
 			return nil, nil, err
@@ -262,26 +328,84 @@ func (ls *CachedEntriesChunker) Chunk(ctx context.Context, mhi provider.Multihas
 			return committer(link)
 		}, nil
 	}
+	chunker, err := ls.newChunker(&lsys)
+	if err != nil {
+		return nil, err
+	}
 
 	// Store the multihashes in mhi as a DAG and get the root link.
-	root, err := ls.chunker.Chunk(ctx, mhi)
+	start := time.Now()
+	cmhi := &countingIterator{MultihashIterator: mhi}
+	root, err := chunker.Chunk(ctx, cmhi)
 	if err != nil {
+		metrics.Chunker.ChunkDuration.Record(ctx, time.Since(start).Milliseconds(), metrics.Attributes.StatusFailure)
+		// The chunks stored so far are not part of any cached DAG, and would never be evicted.
+		// Release them regardless of the context, which may be the cause of the failure.
+		for _, link := range links {
+			if rerr := ls.releaseChunk(context.Background(), link); rerr != nil {
+				log.Errorw("Failed to release chunk of failed chunking", "link", link, "err", rerr)
+			}
+		}
 		return nil, err
-	} else if root == nil {
+	}
+	metrics.Chunker.ChunkDuration.Record(ctx, time.Since(start).Milliseconds(), metrics.Attributes.StatusSuccess)
+	metrics.Chunker.ChunkedEntries.Record(ctx, cmhi.count)
+	if root == nil {
 		log.Debugw("multihash iterator returned no elements")
 		return nil, nil
 	}
 
 	// Store internal mappings for caching purposes.
-	err = ls.performOnCache(ctx, func(cache *lru.Cache) { cache.Add(root, links) })
-	if err != nil {
+	if err = ls.insert(ctx, root, links, linksEnc); err != nil {
 		return nil, err
 	}
-	err = ls.ds.Put(ctx, ls.dsRootPrefixedKey(root), linksEnc)
+	return root, ls.sync(ctx)
+}
+
+// Regenerate chunks the multihashes supplied by the given mhi the same way as Chunk, where the
+// multihashes are expected to chunk into a DAG with the given root, e.g. when regenerating an
+// evicted DAG. Concurrent calls for the same root are deduplicated: only one of them drains its
+// mhi and chunks the multihashes, and all of them return its result. Canceling the context of
+// that call therefore fails the calls that share its result.
+//
+// The returned link is the actual root of the chunked DAG, which may differ from the given root
+// if mhi does not return the expected multihashes.
+func (ls *CachedEntriesChunker) Regenerate(ctx context.Context, root ipld.Link, mhi provider.MultihashIterator) (ipld.Link, error) {
+	v, err, shared := ls.inflight.Do(root.String(), func() (interface{}, error) {
+		return ls.Chunk(ctx, mhi)
+	})
+	if shared {
+		log.Debugw("Shared regeneration of entries with concurrent call", "root", root)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return root, ls.sync(ctx)
+	lnk, _ := v.(ipld.Link)
+	return lnk, nil
+}
+
+// insert adds the chunked DAG with the given root and links to the cache, evicting DAGs as needed.
+func (ls *CachedEntriesChunker) insert(ctx context.Context, root ipld.Link, links []ipld.Link, linksEnc []byte) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	err := ls.performOnCache(ctx, func(cache *lru.Cache) {
+		cache.Add(root, links)
+		ls.evictToByteCap(cache)
+	})
+	if err != nil {
+		return err
+	}
+	return ls.ds.Put(ctx, ls.dsRootPrefixedKey(root), linksEnc)
+}
+
+// evictToByteCap evicts the least recently used DAGs, except the most recently used one, until
+// the size of the cache fits within the byte capacity, if any. It must be called via
+// CachedEntriesChunker.performOnCache.
+func (ls *CachedEntriesChunker) evictToByteCap(cache *lru.Cache) {
+	for ls.maxBytes > 0 && ls.ByteLen() > ls.maxBytes && cache.Len() > 1 && ls.onEvictedErr == nil {
+		cache.RemoveOldest()
+	}
 }
 
 func (ls *CachedEntriesChunker) sync(ctx context.Context) error {
@@ -300,8 +424,25 @@ func (ls *CachedEntriesChunker) GetRawCachedChunk(ctx context.Context, l ipld.Li
 	return raw, nil
 }
 
+// countingIterator counts the multihashes returned by a
+// provider.MultihashIterator.
+type countingIterator struct {
+	provider.MultihashIterator
+	count int64
+}
+
+func (i *countingIterator) Next() (multihash.Multihash, error) {
+	mh, err := i.MultihashIterator.Next()
+	if err == nil {
+		i.count++
+	}
+	return mh, err
+}
+
 // Clear purges all stored items from the CachedEntriesChunker.
 func (ls *CachedEntriesChunker) Clear(ctx context.Context) error {
+	ls.clearLock.Lock()
+	defer ls.clearLock.Unlock()
 	ls.lock.Lock()
 	defer ls.lock.Unlock()
 
@@ -339,6 +480,9 @@ func (ls *CachedEntriesChunker) Clear(ctx context.Context) error {
 			return err
 		}
 	}
+	ls.storeLock.Lock()
+	ls.size = 0
+	ls.storeLock.Unlock()
 	log.Info("Cleared the cache successfully")
 	return nil
 }
@@ -366,6 +510,8 @@ func (ls *CachedEntriesChunker) restoreCache(ctx context.Context) error {
 
 	// For each root key
 	var count int
+	// The chunks whose size is counted already, if the cache is bounded by size.
+	sized := make(map[ipld.Link]struct{})
 	for r := range results.Next() {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -398,6 +544,20 @@ func (ls *CachedEntriesChunker) restoreCache(ctx context.Context) error {
 			links = append(links, cidlink.Link{Cid: c})
 		}
 
+		if ls.maxBytes > 0 {
+			for _, link := range links {
+				if _, ok := sized[link]; ok {
+					continue
+				}
+				size, err := ls.ds.GetSize(ctx, dsKey(link))
+				if err != nil {
+					return fmt.Errorf("cannot get size of cached chunk: %w", err)
+				}
+				ls.size += int64(size)
+				sized[link] = struct{}{}
+			}
+		}
+
 		// Extract the root link from its datastore key
 		rawKey := datastore.RawKey(r.Key)
 		l, err := ls.linkFromDsCachePrefixedKey(rawKey)
@@ -448,6 +608,17 @@ func (ls *CachedEntriesChunker) restoreCache(ctx context.Context) error {
 		if prunedCount != 0 {
 			log.Infow("No caching metadata is persisted but datastore is non-empty; pruned lingering cache entries", "count", prunedCount)
 		}
+	} else if ls.maxBytes > 0 {
+		// Evict as needed if the byte capacity was decreased since the cache was persisted.
+		restoredSize := ls.size
+		if err := ls.performOnCache(ctx, ls.evictToByteCap); err != nil {
+			return err
+		}
+		if restoredSize > ls.maxBytes {
+			log.Infow("Cache byte capacity is smaller than previously persisted cache; pruned persisted cache.", "persistedCacheSize", restoredSize, "byteCapacity", ls.maxBytes)
+		} else {
+			log.Debugw("Cache restored successfully", "restoredCacheCount", ls.cache.Len(), "restoredCacheSize", ls.size, "byteCapacity", ls.maxBytes)
+		}
 	} else if ls.Cap() < count {
 		// If the cache capacity was too small to restore all entries present, it means cache was
 		// evicted during restore and records were pruned as needed.
@@ -475,7 +646,8 @@ func (ls *CachedEntriesChunker) performOnCache(ctx context.Context, action func(
 	return err
 }
 
-// Cap returns the maximum number of chained entries chunks this cache stores.
+// Cap returns the maximum number of chained entries chunks this cache stores, or zero if the
+// cache is bounded by size instead.
 //
 // Note, the maximum number refers to the number of chains as a unit and not the total sum of
 // individual chunks across chains.
@@ -483,6 +655,23 @@ func (ls *CachedEntriesChunker) Cap() int {
 	return ls.cache.MaxEntries
 }
 
+// ByteCap returns the maximum total size of the cached chunks in bytes, or zero if the cache is
+// bounded by the number of chains instead.
+//
+// See: NewByteBoundedCachedEntriesChunker.
+func (ls *CachedEntriesChunker) ByteCap() int64 {
+	return ls.maxBytes
+}
+
+// ByteLen returns the total size in bytes of the chunks that are currently stored in cache,
+// counting the chunks that overlap across chains once. The size is only tracked if the cache is
+// bounded by size; otherwise zero is returned.
+func (ls *CachedEntriesChunker) ByteLen() int64 {
+	ls.storeLock.Lock()
+	defer ls.storeLock.Unlock()
+	return ls.size
+}
+
 // Len returns the number of chained entries chunks thar are currently stored in cache.
 //
 // Note, the number refers to the number of chains as a unit and not the total sum of individual
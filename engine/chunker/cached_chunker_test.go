@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -296,6 +297,172 @@ func TestCachedEntriesChunker_OverlappingDagIsNotEvicted(t *testing.T) {
 	require.Equal(t, 1, subject.Len())
 }
 
+func TestCachedEntriesChunker_ConcurrentChunk(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := chunker.NewCachedEntriesChunker(ctx, store, 10, chunker.NewChainChunkerFunc(10), false)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	// Chunk lists that overlap in their first chunk concurrently, each twice, and assert that
+	// every chunked DAG is fully cached with the expected entries.
+	sharedMhs := test.RandomMultihashes(10)
+	var mhss [][]multihash.Multihash
+	for i := 0; i < 5; i++ {
+		mhs := append([]multihash.Multihash{}, sharedMhs...)
+		mhss = append(mhss, append(mhs, test.RandomMultihashes(25)...))
+	}
+	links := make([]ipld.Link, 2*len(mhss))
+	errs := make([]error, len(links))
+	var wg sync.WaitGroup
+	for i := range links {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			links[i], errs[i] = subject.Chunk(ctx, provider.SliceMultihashIterator(mhss[i%len(mhss)]))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, len(mhss), subject.Len())
+	for i, mhs := range mhss {
+		require.Equal(t, links[i], links[i+len(mhss)])
+		requireChunkIsCached(t, subject, listEntriesChain(t, subject, links[i])...)
+		requireChunkEntriesMatch(t, requireDecodeAllMultihashes(t, links[i], subject.LinkSystem()), mhs)
+	}
+
+	// Evict all chunked DAGs and assert that none of their chunks are left behind, including
+	// the ones they share.
+	sharedLnk, err := subject.Chunk(ctx, provider.SliceMultihashIterator(sharedMhs))
+	require.NoError(t, err)
+	require.NoError(t, subject.Clear(ctx))
+	for _, l := range links {
+		requireChunkIsNotCached(t, subject, l)
+	}
+	requireChunkIsNotCached(t, subject, sharedLnk)
+
+	// Regenerate the same DAG concurrently, and assert that all calls return its root.
+	regenerated := make([]ipld.Link, 5)
+	for i := range regenerated {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			regenerated[i], errs[i] = subject.Regenerate(ctx, links[0], provider.SliceMultihashIterator(mhss[0]))
+		}(i)
+	}
+	wg.Wait()
+	for i, got := range regenerated {
+		require.NoError(t, errs[i])
+		require.Equal(t, links[0], got)
+	}
+	require.Equal(t, 1, subject.Len())
+	requireChunkIsCached(t, subject, listEntriesChain(t, subject, links[0])...)
+}
+
+func TestByteBoundedCachedEntriesChunker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Measure the size of a chunk of 10 multihashes with no next link.
+	probe, err := chunker.NewByteBoundedCachedEntriesChunker(ctx, datastore.NewMapDatastore(), math.MaxInt64, chunker.NewChainChunkerFunc(10), false)
+	require.NoError(t, err)
+	_, err = probe.Chunk(ctx, provider.SliceMultihashIterator(test.RandomMultihashes(10)))
+	require.NoError(t, err)
+	chunkSize := probe.ByteLen()
+	require.NotZero(t, chunkSize)
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	byteCap := chunkSize*2 + chunkSize/2
+	subject, err := chunker.NewByteBoundedCachedEntriesChunker(ctx, store, byteCap, chunker.NewChainChunkerFunc(10), false)
+	require.NoError(t, err)
+	require.Equal(t, byteCap, subject.ByteCap())
+	require.Zero(t, subject.Cap())
+	require.Zero(t, subject.ByteLen())
+
+	chunk := func(mhs []multihash.Multihash) ipld.Link {
+		l, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+		require.NoError(t, err)
+		return l
+	}
+	aLnk := chunk(test.RandomMultihashes(10))
+	bLnk := chunk(test.RandomMultihashes(10))
+	require.Equal(t, 2, subject.Len())
+	require.Equal(t, 2*chunkSize, subject.ByteLen())
+
+	// Least recently used DAGs are evicted to fit the byte capacity.
+	cMhs := test.RandomMultihashes(10)
+	cLnk := chunk(cMhs)
+	require.Equal(t, 2, subject.Len())
+	require.Equal(t, 2*chunkSize, subject.ByteLen())
+	requireChunkIsNotCached(t, subject, aLnk)
+	requireChunkIsCached(t, subject, bLnk, cLnk)
+
+	// Overlapping chunks are counted once, and only deleted once all the DAGs
+	// that link to them are evicted.
+	dLnk := chunk(append(cMhs, test.RandomMultihashes(10)...))
+	require.Equal(t, 2, subject.Len())
+	requireChunkIsNotCached(t, subject, bLnk)
+	requireChunkIsCached(t, subject, cLnk, dLnk)
+	requireOverlapCount(t, subject, 1, cLnk)
+	require.Less(t, subject.ByteLen(), 3*chunkSize)
+
+	eLnk := chunk(test.RandomMultihashes(10))
+	require.Equal(t, 1, subject.Len())
+	require.Equal(t, chunkSize, subject.ByteLen())
+	requireChunkIsNotCached(t, subject, cLnk, dLnk)
+	requireChunkIsCached(t, subject, eLnk)
+
+	// The most recently cached DAG is kept even if larger than the capacity.
+	fLnk := chunk(test.RandomMultihashes(50))
+	require.Equal(t, 1, subject.Len())
+	require.Greater(t, subject.ByteLen(), subject.ByteCap())
+	requireChunkIsCached(t, subject, listEntriesChain(t, subject, fLnk)...)
+	requireChunkIsNotCached(t, subject, eLnk)
+
+	// The size is restored.
+	wantByteLen := subject.ByteLen()
+	require.NoError(t, subject.Close())
+	subject, err = chunker.NewByteBoundedCachedEntriesChunker(ctx, store, byteCap, chunker.NewChainChunkerFunc(10), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, subject.Len())
+	require.Equal(t, wantByteLen, subject.ByteLen())
+
+	require.NoError(t, subject.Clear(ctx))
+	require.Zero(t, subject.ByteLen())
+}
+
+func TestByteBoundedCachedEntriesChunker_ReleasesChunksOfFailedChunk(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := chunker.NewByteBoundedCachedEntriesChunker(ctx, store, math.MaxInt64, chunker.NewChainChunkerFunc(10), false)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	mhs := test.RandomMultihashes(10)
+	lnk, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+	require.NoError(t, err)
+	wantByteLen := subject.ByteLen()
+
+	// The chunks stored before the failure, both new and overlapping ones, are
+	// released.
+	wantErr := errors.New("fish")
+	_, err = subject.Chunk(ctx, &erroringIterator{
+		MultihashIterator: provider.SliceMultihashIterator(append(mhs, test.RandomMultihashes(20)...)),
+		err:               wantErr,
+	})
+	require.ErrorIs(t, err, wantErr)
+	require.Equal(t, 1, subject.Len())
+	require.Equal(t, wantByteLen, subject.ByteLen())
+	requireOverlapCount(t, subject, 0, lnk)
+	requireChunkIsCached(t, subject, lnk)
+}
+
 func testCachedEntriesChunker_RecoversFromCorruptCacheGracefully(t *testing.T, capacity int, c chunker.NewChunkerFunc) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -2,6 +2,7 @@ package chunker
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -15,10 +16,15 @@ import (
 var _ EntriesChunker = (*ChainChunker)(nil)
 
 // ChainChunker chunks advertisement entries as a chained series of schema.EntryChunk nodes.
-// See: NewChainChunker
+// See: NewChainChunker, NewByteBoundedChainChunker
 type ChainChunker struct {
 	ls        *ipld.LinkSystem
 	chunkSize int
+	// maxBytes is the maximum size of each encoded chunk in bytes, or zero if chunks are only
+	// bounded by chunkSize.
+	maxBytes int
+	// overhead is the encoded size of a chunk with no entries and a next link.
+	overhead int
 }
 
 // NewChainChunker instantiates a new chain chunker that given a provider.MultihashIterator it drains
@@ -42,15 +48,68 @@ func NewChainChunkerFunc(chunkSize int) NewChunkerFunc {
 	}
 }
 
+// NewByteBoundedChainChunker instantiates a new chain chunker like NewChainChunker, except that
+// the multihashes are packed into each chunk for as long as the encoded chunk fits
+// within maxBytes. This bounds the size of the chunk blocks regardless of the length of the
+// multihashes, e.g. when sha2-256 and blake3-512 multihashes are mixed.
+//
+// Optionally, the number of multihashes per chunk is capped by chunkSize as well; zero means no
+// cap. A chunk is cut as soon as either bound is reached. Chunking fails if a single multihash does
+// not fit in a chunk on its own.
+//
+// Chunks are packed in the order in which the multihashes are returned by the iterator, and so the
+// same multihashes in the same order always result in the same chain.
+//
+// See: schema.EntryChunk.
+func NewByteBoundedChainChunker(ls *ipld.LinkSystem, maxBytes, chunkSize int) (*ChainChunker, error) {
+	if chunkSize < 0 {
+		return nil, fmt.Errorf("chunk size must not be negative; got: %d", chunkSize)
+	}
+	// The size of a chunk with no entries and a link to the next chunk.
+	overhead := entryChunkSize(0, 0)
+	if maxBytes <= overhead {
+		return nil, fmt.Errorf("maximum chunk byte size must be larger than %d; got: %d", overhead, maxBytes)
+	}
+	return &ChainChunker{
+		ls:        ls,
+		chunkSize: chunkSize,
+		maxBytes:  maxBytes,
+		overhead:  overhead,
+	}, nil
+}
+
+func NewByteBoundedChainChunkerFunc(maxBytes, chunkSize int) NewChunkerFunc {
+	return func(ls *ipld.LinkSystem) (EntriesChunker, error) {
+		return NewByteBoundedChainChunker(ls, maxBytes, chunkSize)
+	}
+}
+
 // Chunk chunks all the mulithashes returned by the given iterator into a chain of schema.EntryChunk
-// nodes where each chunk contains no more than chunkSize number of multihashes and returns the link
-// the root chunk node.
+// nodes where each chunk contains no more than chunkSize number of multihashes, and encodes to no
+// more than the maximum chunk byte size if set, and returns the link the root chunk node.
 //
 // See: schema.EntryChunk.
 func (ls *ChainChunker) Chunk(ctx context.Context, mhi provider.MultihashIterator) (ipld.Link, error) {
-	mhs := make([]multihash.Multihash, 0, ls.chunkSize)
+	mhs := make([]multihash.Multihash, 0, ls.initialCapacity())
 	var next ipld.Link
 	var mhCount, chunkCount int
+	// The encoded size of the entries in mhs, used if the chunks are bounded by size.
+	var entriesSize int
+	store := func() error {
+		cNode, err := newEntriesChunkNode(mhs, next)
+		if err != nil {
+			return err
+		}
+		next, err = ls.ls.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, cNode)
+		if err != nil {
+			return err
+		}
+		chunkCount++
+		// NewLinkedListOfMhs makes it own copy, so safe to reuse mhs
+		mhs = mhs[:0]
+		entriesSize = 0
+		return nil
+	}
 	for {
 		mh, err := mhi.Next()
 		if err != nil {
@@ -59,38 +118,45 @@ func (ls *ChainChunker) Chunk(ctx context.Context, mhi provider.MultihashIterato
 			}
 			return nil, err
 		}
+		if ls.maxBytes > 0 {
+			size := entrySize(len(mh))
+			if entryChunkSize(1, size) > ls.maxBytes {
+				return nil, fmt.Errorf("multihash of %d bytes does not fit in a chunk of at most %d bytes", len(mh), ls.maxBytes)
+			}
+			if len(mhs) != 0 && entryChunkSize(len(mhs)+1, entriesSize+size) > ls.maxBytes {
+				if err := store(); err != nil {
+					return nil, err
+				}
+			}
+			entriesSize += size
+		}
 		mhs = append(mhs, mh)
 		mhCount++
-		if len(mhs) >= ls.chunkSize {
-			cNode, err := newEntriesChunkNode(mhs, next)
-			if err != nil {
-				return nil, err
-			}
-			next, err = ls.ls.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, cNode)
-			if err != nil {
+		if ls.chunkSize > 0 && len(mhs) >= ls.chunkSize {
+			if err := store(); err != nil {
 				return nil, err
 			}
-			chunkCount++
-			// NewLinkedListOfMhs makes it own copy, so safe to reuse mhs
-			mhs = mhs[:0]
 		}
 	}
 	if len(mhs) != 0 {
-		cNode, err := newEntriesChunkNode(mhs, next)
-		if err != nil {
+		if err := store(); err != nil {
 			return nil, err
 		}
-		next, err = ls.ls.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, cNode)
-		if err != nil {
-			return nil, err
-		}
-		chunkCount++
 	}
 
 	log.Infow("Generated linked chunks of multihashes", "totalMhCount", mhCount, "chunkCount", chunkCount)
 	return next, nil
 }
 
+// initialCapacity returns the capacity with which to allocate the multihashes of a chunk.
+func (ls *ChainChunker) initialCapacity() int {
+	if ls.chunkSize > 0 {
+		return ls.chunkSize
+	}
+	// Assume sha2-256 multihashes when only bounded by size.
+	return (ls.maxBytes - ls.overhead) / entrySize(34)
+}
+
 func newEntriesChunkNode(mhs []multihash.Multihash, next ipld.Link) (ipld.Node, error) {
 	chunk := schema.EntryChunk{
 		Entries: mhs,
@@ -100,3 +166,37 @@ func newEntriesChunkNode(mhs []multihash.Multihash, next ipld.Link) (ipld.Node,
 	}
 	return chunk.ToNode()
 }
+
+// linkSize is the length of the string representation of the CIDs of entry chunks, as generated
+// by schema.Linkproto.
+var linkSize = func() int {
+	c, err := schema.Linkproto.Sum(nil)
+	if err != nil {
+		panic(err)
+	}
+	return len(c.String())
+}()
+
+// entryChunkSize returns the encoded size of a schema.EntryChunk with the given number of entries,
+// whose encoded size adds up to entriesSize, and with a link to the next chunk. The size is an
+// upper bound for the last chunk in the chain, which has no next link.
+//
+// Entry chunks are encoded as DAG-JSON, i.e.:
+//
+//	{"Entries":[<entry>,...],"Next":{"/":"<cid>"}}
+func entryChunkSize(count, entriesSize int) int {
+	size := len(`{"Entries":[`) + entriesSize + len(`]`) + len(`,"Next":{"/":"`) + linkSize + len(`"}}`)
+	if count > 1 {
+		// Entries are separated by commas.
+		size += count - 1
+	}
+	return size
+}
+
+// entrySize returns the DAG-JSON encoded size of an entry with the given multihash length, i.e.
+// the multihash bytes encoded as unpadded base64:
+//
+//	{"/":{"bytes":"<base64>"}}
+func entrySize(mhLen int) int {
+	return len(`{"/":{"bytes":"`) + base64.RawStdEncoding.EncodedLen(mhLen) + len(`"}}`)
+}
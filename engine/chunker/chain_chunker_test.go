@@ -11,6 +11,7 @@ import (
 	"github.com/ipni/go-libipni/test"
 	provider "github.com/ipni/index-provider"
 	"github.com/ipni/index-provider/engine/chunker"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
 
@@ -49,3 +50,108 @@ func TestChainChunker_Chunk(t *testing.T) {
 		chunkHasExpectedMhs(t, subject)
 	})
 }
+
+func TestByteBoundedChainChunker_Chunk(t *testing.T) {
+	ctx := context.TODO()
+	const maxBytes = 1024
+
+	// Mix multihashes of different lengths, including identity multihashes.
+	var mhs []multihash.Multihash
+	for i, data := range test.RandomMultihashes(200) {
+		var code uint64
+		switch i % 3 {
+		case 0:
+			code = multihash.SHA2_256
+		case 1:
+			code = multihash.SHA2_512
+		default:
+			code = multihash.IDENTITY
+			data = data[:10+i%20]
+		}
+		mh, err := multihash.Sum(data, code, -1)
+		require.NoError(t, err)
+		mhs = append(mhs, mh)
+	}
+
+	chunk := func(t *testing.T, newChunker chunker.NewChunkerFunc, mhs []multihash.Multihash) (ipld.Link, *memstore.Store, ipld.LinkSystem) {
+		store := &memstore.Store{}
+		ls := cidlink.DefaultLinkSystem()
+		ls.SetReadStorage(store)
+		ls.SetWriteStorage(store)
+		subject, err := newChunker(&ls)
+		require.NoError(t, err)
+		l, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+		require.NoError(t, err)
+		return l, store, ls
+	}
+	listChunks := func(t *testing.T, l ipld.Link, store *memstore.Store, ls ipld.LinkSystem) ([]*schema.EntryChunk, []int) {
+		var chunks []*schema.EntryChunk
+		var sizes []int
+		for l != nil {
+			n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, l, schema.EntryChunkPrototype)
+			require.NoError(t, err)
+			c, err := schema.UnwrapEntryChunk(n)
+			require.NoError(t, err)
+			chunks = append(chunks, c)
+			sizes = append(sizes, len(store.Bag[l.(cidlink.Link).Cid.KeyString()]))
+			l = c.Next
+		}
+		return chunks, sizes
+	}
+
+	t.Run("PacksChunksUpToMaxBytes", func(t *testing.T) {
+		l, store, ls := chunk(t, chunker.NewByteBoundedChainChunkerFunc(maxBytes, 0), mhs)
+		chunks, sizes := listChunks(t, l, store, ls)
+		require.Greater(t, len(chunks), 1)
+		var gotMhs []multihash.Multihash
+		for i, c := range chunks {
+			require.LessOrEqual(t, sizes[i], maxBytes)
+			gotMhs = append(append([]multihash.Multihash{}, c.Entries...), gotMhs...)
+			// The chain is linked from the last chunk stored, so every chunk but the root is
+			// full: the first multihash of the chunk that precedes it would not have fit in.
+			if i != 0 {
+				full := schema.EntryChunk{
+					Entries: append(append([]multihash.Multihash{}, c.Entries...), chunks[i-1].Entries[0]),
+					Next:    l,
+				}
+				n, err := full.ToNode()
+				require.NoError(t, err)
+				fullLnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, n)
+				require.NoError(t, err)
+				require.Greater(t, len(store.Bag[fullLnk.(cidlink.Link).Cid.KeyString()]), maxBytes)
+			}
+		}
+		require.Equal(t, mhs, gotMhs)
+
+		// The same multihashes result in the same chain.
+		again, _, _ := chunk(t, chunker.NewByteBoundedChainChunkerFunc(maxBytes, 0), mhs)
+		require.Equal(t, l, again)
+	})
+	t.Run("CapsNumberOfMultihashes", func(t *testing.T) {
+		l, store, ls := chunk(t, chunker.NewByteBoundedChainChunkerFunc(maxBytes, 3), mhs)
+		chunks, sizes := listChunks(t, l, store, ls)
+		require.Len(t, chunks, 67)
+		for i, c := range chunks {
+			require.LessOrEqual(t, len(c.Entries), 3)
+			require.LessOrEqual(t, sizes[i], maxBytes)
+		}
+	})
+	t.Run("FailsOnMultihashLargerThanMaxBytes", func(t *testing.T) {
+		store := &memstore.Store{}
+		ls := cidlink.DefaultLinkSystem()
+		ls.SetWriteStorage(store)
+		subject, err := chunker.NewByteBoundedChainChunker(&ls, maxBytes, 0)
+		require.NoError(t, err)
+		large, err := multihash.Sum(make([]byte, maxBytes), multihash.IDENTITY, -1)
+		require.NoError(t, err)
+		_, err = subject.Chunk(ctx, provider.SliceMultihashIterator(append(mhs[:1:1], large)))
+		require.Error(t, err)
+	})
+	t.Run("ValidatesConfig", func(t *testing.T) {
+		ls := cidlink.DefaultLinkSystem()
+		_, err := chunker.NewByteBoundedChainChunker(&ls, 64, 0)
+		require.Error(t, err)
+		_, err = chunker.NewByteBoundedChainChunker(&ls, maxBytes, -1)
+		require.Error(t, err)
+	})
+}
@@ -34,25 +34,32 @@ type HamtChunker struct {
 //   - https://ipld.io/specs/advanced-data-layouts/hamt/spec
 //   - https://github.com/ipld/go-ipld-adl-hamt
 func NewHamtChunker(ls *ipld.LinkSystem, hashAlg multicodec.Code, bitWidth, bucketSize int) (*HamtChunker, error) {
+	if err := validateHamtConfig(hashAlg, bitWidth, bucketSize); err != nil {
+		return nil, err
+	}
+	return &HamtChunker{
+		ls:         ls,
+		hashAlg:    hashAlg,
+		bitWidth:   bitWidth,
+		bucketSize: bucketSize,
+	}, nil
+}
+
+func validateHamtConfig(hashAlg multicodec.Code, bitWidth, bucketSize int) error {
 	if bitWidth < 3 {
-		return nil, fmt.Errorf("bit-width must be at least 3; got: %d", bitWidth)
+		return fmt.Errorf("bit-width must be at least 3; got: %d", bitWidth)
 	}
 	if bucketSize < 1 {
-		return nil, fmt.Errorf("bucket size must be at least 1; got: %d", bucketSize)
+		return fmt.Errorf("bucket size must be at least 1; got: %d", bucketSize)
 	}
 	switch hashAlg {
 	case multicodec.Identity, multicodec.Sha2_256, multicodec.Murmur3X64_64:
 	default:
-		return nil, fmt.Errorf("only %s, %s, and %s hash algorithms are supported; got: %s",
+		return fmt.Errorf("only %s, %s, and %s hash algorithms are supported; got: %s",
 			multicodec.Identity, multicodec.Sha2_256, multicodec.Murmur3X64_64, hashAlg,
 		)
 	}
-	return &HamtChunker{
-		ls:         ls,
-		hashAlg:    hashAlg,
-		bitWidth:   bitWidth,
-		bucketSize: bucketSize,
-	}, nil
+	return nil
 }
 
 func NewHamtChunkerFunc(hashAlg multicodec.Code, bitWidth, bucketSize int) NewChunkerFunc {
@@ -0,0 +1,317 @@
+package chunker
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	hamt "github.com/ipld/go-ipld-adl-hamt"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	"github.com/ipni/go-libipni/ingest/schema"
+	provider "github.com/ipni/index-provider"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/twmb/murmur3"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ EntriesChunker = (*ParallelHamtChunker)(nil)
+
+// ParallelHamtChunker chunks advertisement entries as an IPLD HAMT data structure, building the
+// subtrees of the HAMT root concurrently.
+// See: NewParallelHamtChunker.
+type ParallelHamtChunker struct {
+	ls          *ipld.LinkSystem
+	hashAlg     multicodec.Code
+	bitWidth    int
+	bucketSize  int
+	concurrency int
+	maxBuffered int
+}
+
+// NewParallelHamtChunker instantiates a new HAMT chunker that produces the same HAMT as
+// HamtChunker configured with the given hash algorithm, bit-width and bucket size, i.e. the root
+// link of the HAMT built from the same multihashes is identical. The HAMT is built by the given
+// number of concurrent workers.
+//
+// The multihashes are partitioned by the prefix of their hash that determines their position in
+// the HAMT root, so that each partition makes up a subtree of the root independently of the
+// others. Each worker builds the subtrees of its share of the partitions, inserting the
+// multihashes in the order in which they are returned by the provider.MultihashIterator, and the
+// root is assembled once all the subtrees are built.
+//
+// At most maxBuffered multihashes are held in memory between being read from the iterator and
+// being inserted into their subtree; the iterator is not read from while the buffer is full. The
+// HAMT nodes are stored in the given link system as they are built, the same way as HamtChunker.
+// The concurrency must be at least 1, and maxBuffered must be at least concurrency.
+//
+// See: NewHamtChunker.
+func NewParallelHamtChunker(ls *ipld.LinkSystem, hashAlg multicodec.Code, bitWidth, bucketSize, concurrency, maxBuffered int) (*ParallelHamtChunker, error) {
+	if err := validateHamtConfig(hashAlg, bitWidth, bucketSize); err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1; got: %d", concurrency)
+	}
+	if maxBuffered < concurrency {
+		return nil, fmt.Errorf("max buffered multihashes must be at least the concurrency %d; got: %d", concurrency, maxBuffered)
+	}
+	return &ParallelHamtChunker{
+		ls:          ls,
+		hashAlg:     hashAlg,
+		bitWidth:    bitWidth,
+		bucketSize:  bucketSize,
+		concurrency: concurrency,
+		maxBuffered: maxBuffered,
+	}, nil
+}
+
+func NewParallelHamtChunkerFunc(hashAlg multicodec.Code, bitWidth, bucketSize, concurrency, maxBuffered int) NewChunkerFunc {
+	return func(ls *ipld.LinkSystem) (EntriesChunker, error) {
+		return NewParallelHamtChunker(ls, hashAlg, bitWidth, bucketSize, concurrency, maxBuffered)
+	}
+}
+
+// hamtEntry is a multihash along with the position of its subtree in the HAMT root.
+type hamtEntry struct {
+	mh   multihash.Multihash
+	slot int
+}
+
+// hamtSubtree is the element of the HAMT root at a given position.
+type hamtSubtree struct {
+	slot    int
+	element hamt.Element
+}
+
+// Chunk drains all the multihashes in the given iterator, stores them as an IPLD HAMT ADL and
+// returns the link to the root HAMT node.
+//
+// The HAMT is used as a set where the keys in the map represent the multihashes and values are
+// simply set to true.
+func (h *ParallelHamtChunker) Chunk(ctx context.Context, iterator provider.MultihashIterator) (ipld.Link, error) {
+	// The link system is shared by the workers, and may not be safe for concurrent use.
+	lsys := syncLinkSystem(h.ls)
+
+	// Buffer the multihashes in batches, recycled once inserted, so that at most maxBuffered
+	// multihashes are held at any time. There are at least as many batches as workers, so that
+	// a batch can always be taken once the ones handed to the workers are processed.
+	batchSize := h.maxBuffered / (2 * h.concurrency)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batchCount := h.maxBuffered / batchSize
+	free := make(chan []hamtEntry, batchCount)
+	for i := 0; i < batchCount; i++ {
+		free <- make([]hamtEntry, 0, batchSize)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	inputs := make([]chan []hamtEntry, h.concurrency)
+	subtrees := make([][]hamtSubtree, h.concurrency)
+	for i := range inputs {
+		i := i
+		inputs[i] = make(chan []hamtEntry)
+		g.Go(func() error {
+			var err error
+			subtrees[i], err = h.buildSubtrees(lsys, inputs[i], free)
+			return err
+		})
+	}
+
+	count, err := h.dispatch(gctx, iterator, inputs, free)
+	for _, input := range inputs {
+		close(input)
+	}
+	if werr := g.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Debugw("finished iterating over multihash lister", "mhCount", count)
+	if count == 0 {
+		return nil, nil
+	}
+
+	builder := hamt.NewBuilder(h.prototype()).WithLinking(*h.ls, schema.Linkproto)
+	if _, err := builder.BeginMap(0); err != nil {
+		return nil, err
+	}
+	root := hamt.Build(builder)
+	var all []hamtSubtree
+	for _, s := range subtrees {
+		all = append(all, s...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].slot < all[j].slot })
+	for _, s := range all {
+		root.Hamt.Map[s.slot/8] |= 1 << (7 - s.slot%8)
+		root.Hamt.Data = append(root.Hamt.Data, s.element)
+	}
+	return h.ls.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, root.Substrate())
+}
+
+// dispatch drains the given iterator, and hands the multihashes in batches to the workers that
+// build their subtree. It returns the number of multihashes read.
+func (h *ParallelHamtChunker) dispatch(ctx context.Context, iterator provider.MultihashIterator, inputs []chan []hamtEntry, free chan []hamtEntry) (int, error) {
+	batches := make([][]hamtEntry, len(inputs))
+	send := func(i int) error {
+		select {
+		case inputs[i] <- batches[i]:
+			batches[i] = nil
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var count int
+	for {
+		mh, err := iterator.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return count, err
+		}
+		count++
+		slot, err := h.slot(mh)
+		if err != nil {
+			return count, err
+		}
+		i := slot % len(inputs)
+		if batches[i] == nil {
+			select {
+			case batches[i] = <-free:
+			case <-ctx.Done():
+				return count, ctx.Err()
+			}
+		}
+		batches[i] = append(batches[i], hamtEntry{mh: mh, slot: slot})
+		if len(batches[i]) == cap(batches[i]) {
+			if err := send(i); err != nil {
+				return count, err
+			}
+		}
+	}
+	for i := range batches {
+		if len(batches[i]) != 0 {
+			if err := send(i); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// buildSubtrees inserts the multihashes received from the given input into the subtrees they
+// belong to, until the input is closed, and returns the built subtrees.
+func (h *ParallelHamtChunker) buildSubtrees(lsys ipld.LinkSystem, input <-chan []hamtEntry, free chan<- []hamtEntry) ([]hamtSubtree, error) {
+	builders := make(map[int]*hamt.Builder)
+	assemblers := make(map[int]datamodel.MapAssembler)
+	for batch := range input {
+		for _, e := range batch {
+			ma, ok := assemblers[e.slot]
+			if !ok {
+				// Each subtree is built as a HAMT of its own, whose root only has the element at
+				// the position of the subtree.
+				builder := hamt.NewBuilder(h.prototype()).WithLinking(lsys, schema.Linkproto)
+				var err error
+				if ma, err = builder.BeginMap(0); err != nil {
+					return nil, err
+				}
+				builders[e.slot] = builder
+				assemblers[e.slot] = ma
+			}
+			if err := ma.AssembleKey().AssignBytes(e.mh); err != nil {
+				return nil, err
+			}
+			if err := ma.AssembleValue().AssignBool(true); err != nil {
+				return nil, err
+			}
+		}
+		free <- batch[:0]
+	}
+
+	subtrees := make([]hamtSubtree, 0, len(builders))
+	for slot, builder := range builders {
+		if err := assemblers[slot].Finish(); err != nil {
+			return nil, err
+		}
+		data := hamt.Build(builder).Hamt.Data
+		if len(data) != 1 {
+			return nil, fmt.Errorf("expected a single element in HAMT subtree %d; got: %d", slot, len(data))
+		}
+		subtrees = append(subtrees, hamtSubtree{slot: slot, element: data[0]})
+	}
+	return subtrees, nil
+}
+
+func (h *ParallelHamtChunker) prototype() hamt.Prototype {
+	return hamt.Prototype{
+		BitWidth:   h.bitWidth,
+		BucketSize: h.bucketSize,
+	}.WithHashAlg(h.hashAlg)
+}
+
+// slot returns the position in the HAMT root of the subtree that the given multihash belongs to,
+// i.e. the first bit-width bits of its hash, hashed the same way as go-ipld-adl-hamt does.
+func (h *ParallelHamtChunker) slot(mh multihash.Multihash) (int, error) {
+	var hash []byte
+	switch h.hashAlg {
+	case multicodec.Sha2_256:
+		sum := sha256.Sum256(mh)
+		hash = sum[:]
+	case multicodec.Murmur3X64_64:
+		hasher := murmur3.New128()
+		hasher.Write(mh)
+		hash = hasher.Sum(nil)
+	default:
+		hash = mh
+	}
+	if len(hash)*8 < h.bitWidth {
+		return 0, fmt.Errorf("hash of multihash %s is shorter than bit-width %d", mh.B58String(), h.bitWidth)
+	}
+	var slot int
+	for i := 0; i < h.bitWidth; i++ {
+		slot = slot<<1 | int(hash[i/8]>>(7-i%8)&1)
+	}
+	return slot, nil
+}
+
+// syncLinkSystem returns a copy of the given link system whose storage is safe for concurrent
+// use. Blocks are still encoded and hashed concurrently; only opening and committing them are
+// serialized.
+func syncLinkSystem(ls *ipld.LinkSystem) ipld.LinkSystem {
+	var lock sync.RWMutex
+	lsys := *ls
+	if read := ls.StorageReadOpener; read != nil {
+		lsys.StorageReadOpener = func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+			lock.RLock()
+			defer lock.RUnlock()
+			return read(lctx, lnk)
+		}
+	}
+	if write := ls.StorageWriteOpener; write != nil {
+		lsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			w, commit, err := write(lctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			return w, func(lnk datamodel.Link) error {
+				lock.Lock()
+				defer lock.Unlock()
+				return commit(lnk)
+			}, nil
+		}
+	}
+	return lsys
+}
@@ -0,0 +1,143 @@
+package chunker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipni/go-libipni/test"
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine/chunker"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewParallelHamtChunker_ValidatesConfig(t *testing.T) {
+	ls := cidlink.DefaultLinkSystem()
+
+	_, err := chunker.NewParallelHamtChunker(&ls, multicodec.Murmur3X64_64, 3, 1, 4, 4)
+	require.NoError(t, err)
+	_, err = chunker.NewParallelHamtChunker(&ls, multicodec.Murmur3X64_64, 2, 1, 4, 4)
+	require.Error(t, err)
+	_, err = chunker.NewParallelHamtChunker(&ls, multicodec.Blake3, 3, 1, 4, 4)
+	require.Error(t, err)
+	_, err = chunker.NewParallelHamtChunker(&ls, multicodec.Murmur3X64_64, 3, 1, 0, 4)
+	require.Error(t, err)
+	_, err = chunker.NewParallelHamtChunker(&ls, multicodec.Murmur3X64_64, 3, 1, 4, 3)
+	require.Error(t, err)
+}
+
+func TestParallelHamtChunker_MatchesHamtChunker(t *testing.T) {
+	ctx := context.TODO()
+	mhs := test.RandomMultihashes(1000)
+
+	tests := []struct {
+		hashAlg     multicodec.Code
+		bitWidth    int
+		bucketSize  int
+		concurrency int
+		maxBuffered int
+	}{
+		{multicodec.Murmur3X64_64, 3, 1, 1, 1},
+		{multicodec.Murmur3X64_64, 3, 3, 4, 16},
+		{multicodec.Murmur3X64_64, 5, 3, 3, 1000},
+		{multicodec.Murmur3X64_64, 8, 2, 8, 10000},
+		{multicodec.Sha2_256, 4, 3, 4, 64},
+		{multicodec.Identity, 4, 3, 4, 64},
+	}
+	for _, tt := range tests {
+		tt := tt
+		name := fmt.Sprintf("%s/BitWidth_%d_BucketSize_%d/Concurrency_%d_MaxBuffered_%d", tt.hashAlg, tt.bitWidth, tt.bucketSize, tt.concurrency, tt.maxBuffered)
+		t.Run(name, func(t *testing.T) {
+			want := chunkWith(t, func(ls *ipld.LinkSystem) (chunker.EntriesChunker, error) {
+				return chunker.NewHamtChunker(ls, tt.hashAlg, tt.bitWidth, tt.bucketSize)
+			}, mhs)
+
+			ls := cidlink.DefaultLinkSystem()
+			store := &memstore.Store{}
+			ls.SetReadStorage(store)
+			ls.SetWriteStorage(store)
+			subject, err := chunker.NewParallelHamtChunker(&ls, tt.hashAlg, tt.bitWidth, tt.bucketSize, tt.concurrency, tt.maxBuffered)
+			require.NoError(t, err)
+			got, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+
+			gotMhs := requireDecodeAllMultihashes(t, got, ls)
+			requireChunkEntriesMatch(t, gotMhs, mhs)
+		})
+	}
+}
+
+func TestParallelHamtChunker_Chunk(t *testing.T) {
+	ctx := context.TODO()
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	subject, err := chunker.NewParallelHamtChunkerFunc(multicodec.Murmur3X64_64, 3, 1, 2, 2)(&ls)
+	require.NoError(t, err)
+
+	t.Run("NoMultihashes", func(t *testing.T) {
+		l, err := subject.Chunk(ctx, provider.SliceMultihashIterator(nil))
+		require.NoError(t, err)
+		require.Nil(t, l)
+	})
+	t.Run("IteratorError", func(t *testing.T) {
+		wantErr := errors.New("fish")
+		mhi := &erroringIterator{
+			MultihashIterator: provider.SliceMultihashIterator(test.RandomMultihashes(100)),
+			err:               wantErr,
+		}
+		_, err := subject.Chunk(ctx, mhi)
+		require.ErrorIs(t, err, wantErr)
+	})
+}
+
+func TestParallelHamtChunker_Cached(t *testing.T) {
+	ctx := context.TODO()
+	mhs := test.RandomMultihashes(1000)
+	want := chunkWith(t, chunker.NewHamtChunkerFunc(multicodec.Murmur3X64_64, 3, 3), mhs)
+
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := chunker.NewCachedEntriesChunker(ctx, store, 10, chunker.NewParallelHamtChunkerFunc(multicodec.Murmur3X64_64, 3, 3, 4, 100), false)
+	require.NoError(t, err)
+	defer subject.Close()
+	got, err := subject.Chunk(ctx, provider.SliceMultihashIterator(mhs))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	requireChunkEntriesMatch(t, requireDecodeAllMultihashes(t, got, subject.LinkSystem()), mhs)
+}
+
+func chunkWith(t testing.TB, newChunker chunker.NewChunkerFunc, mhs []multihash.Multihash) ipld.Link {
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	c, err := newChunker(&ls)
+	require.NoError(t, err)
+	l, err := c.Chunk(context.TODO(), provider.SliceMultihashIterator(mhs))
+	require.NoError(t, err)
+	return l
+}
+
+// erroringIterator returns err once the wrapped iterator is exhausted.
+type erroringIterator struct {
+	provider.MultihashIterator
+	err error
+}
+
+func (i *erroringIterator) Next() (multihash.Multihash, error) {
+	mh, err := i.MultihashIterator.Next()
+	if err != nil {
+		return nil, i.err
+	}
+	return mh, nil
+}
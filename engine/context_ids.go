@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const contextIDIndexPrefix = "map/keyIdx/"
+
+// ContextIDInfo describes a context ID that is currently advertised by the
+// engine.
+type ContextIDInfo struct {
+	// Provider is the ID of the provider the context ID is advertised for.
+	Provider peer.ID
+	// ContextID is the advertised context ID.
+	ContextID []byte
+	// Entries is the CID of the root of the advertised entries.
+	Entries cid.Cid
+	// Metadata is the metadata most recently advertised for the context ID.
+	Metadata metadata.Metadata
+	// AdCid is the CID of the advertisement that last put the context ID. It
+	// is cid.Undef if the context ID was advertised before the engine started
+	// to record it.
+	AdCid cid.Cid
+	// Expiry is the time after which the context ID is removed, or the zero
+	// time if it never expires.
+	Expiry time.Time
+}
+
+// ContextIDIterator iterates over the context IDs advertised by the engine
+// for a provider.
+//
+// See: Engine.ListContextIDs.
+type ContextIDIterator struct {
+	ctx      context.Context
+	e        *Engine
+	provider peer.ID
+	results  query.Results
+}
+
+// ListContextIDs returns an iterator over the context IDs currently
+// advertised for the given provider, i.e. the ones that have been put but not
+// removed since. The context IDs are listed in no particular order, and
+// changes made while iterating may or may not be reflected.
+//
+// If providerID is empty then the default configured provider will be assumed.
+//
+// The returned iterator must be closed once no longer needed.
+func (e *Engine) ListContextIDs(ctx context.Context, providerID peer.ID) (*ContextIDIterator, error) {
+	if providerID == "" {
+		providerID = e.providerID()
+	}
+	results, err := e.ds.Query(ctx, query.Query{Prefix: e.contextIDIndexPrefix(providerID)})
+	if err != nil {
+		return nil, fmt.Errorf("could not query context IDs: %w", err)
+	}
+	return &ContextIDIterator{
+		ctx:      ctx,
+		e:        e,
+		provider: providerID,
+		results:  results,
+	}, nil
+}
+
+// Next returns the next advertised context ID. This function returns nil and
+// io.EOF when there are no more context IDs to return.
+func (it *ContextIDIterator) Next() (*ContextIDInfo, error) {
+	for {
+		r, ok := it.results.NextSync()
+		if !ok {
+			return nil, io.EOF
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		p, contextID, err := it.e.decodeContextIDIndex(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if p != it.provider {
+			continue
+		}
+		info, err := it.e.GetContextID(it.ctx, p, contextID)
+		if errors.Is(err, provider.ErrContextIDNotFound) {
+			// Removed since the query was made.
+			continue
+		}
+		return info, err
+	}
+}
+
+// Close releases the resources held by the iterator.
+func (it *ContextIDIterator) Close() error {
+	return it.results.Close()
+}
+
+// GetContextID looks up the given context ID advertised for the given
+// provider. If the context ID is not currently advertised then
+// provider.ErrContextIDNotFound is returned.
+//
+// If providerID is empty then the default configured provider will be assumed.
+func (e *Engine) GetContextID(ctx context.Context, providerID peer.ID, contextID []byte) (*ContextIDInfo, error) {
+	if providerID == "" {
+		providerID = e.providerID()
+	}
+	entries, err := e.getKeyCidMap(ctx, providerID, contextID)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, provider.ErrContextIDNotFound
+		}
+		return nil, fmt.Errorf("could not get entries cid by provider + context id: %w", err)
+	}
+	return e.contextIDInfo(ctx, providerID, contextID, entries)
+}
+
+func (e *Engine) contextIDInfo(ctx context.Context, providerID peer.ID, contextID []byte, entries cid.Cid) (*ContextIDInfo, error) {
+	md, err := e.getKeyMetadataMap(ctx, providerID, contextID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("could not get metadata for provider + context id: %w", err)
+	}
+	adCid, err := e.getKeyAdMap(ctx, providerID, contextID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get advertisement cid for provider + context id: %w", err)
+	}
+	expiry, err := e.getKeyExpiryMap(ctx, providerID, contextID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get expiry for provider + context id: %w", err)
+	}
+	return &ContextIDInfo{
+		Provider:  providerID,
+		ContextID: contextID,
+		Entries:   entries,
+		Metadata:  md,
+		AdCid:     adCid,
+		Expiry:    expiry,
+	}, nil
+}
+
+// listContextIDs returns the context IDs currently advertised for the given
+// provider.
+func (e *Engine) listContextIDs(ctx context.Context, provider peer.ID) ([][]byte, error) {
+	results, err := e.ds.Query(ctx, query.Query{Prefix: e.contextIDIndexPrefix(provider)})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var contextIDs [][]byte
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		p, contextID, err := e.decodeContextIDIndex(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if p == provider {
+			contextIDs = append(contextIDs, contextID)
+		}
+	}
+	return contextIDs, nil
+}
+
+// contextIDIndexKey returns the key of the context ID index entry of the given
+// provider and context ID.
+//
+// Unlike the other mappings, the context ID is encoded as a single key
+// segment, since cleaning the key as a path would alter context IDs that
+// contain "/" or ".." segments. Entries of the default provider are not
+// prefixed by a provider ID, so that they carry over when the provider key is
+// rotated.
+func (e *Engine) contextIDIndexKey(provider peer.ID, contextID []byte) datastore.Key {
+	// Multibase base64url, so that an empty context ID still has a segment.
+	segment := "u" + base64.RawURLEncoding.EncodeToString(contextID)
+	return datastore.NewKey(e.contextIDIndexPrefix(provider)).ChildString(segment)
+}
+
+// contextIDIndexPrefix returns the datastore prefix under which the context ID
+// index entries of the given provider are stored. The entries of the default
+// provider are stored directly under the index prefix, and so the entries of
+// other providers are found under it as well.
+func (e *Engine) contextIDIndexPrefix(provider peer.ID) string {
+	prefix := datastore.NewKey(contextIDIndexPrefix)
+	if provider != e.providerID() {
+		prefix = prefix.ChildString(provider.String())
+	}
+	return prefix.String()
+}
+
+// putContextIDIndex records the given context ID as advertised by the given
+// provider. The raw context ID is stored as the value, along with the
+// provider unless it is the default one.
+func (e *Engine) putContextIDIndex(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	var pAndC providerAndContext
+	if provider != e.providerID() {
+		pB, err := provider.Marshal()
+		if err != nil {
+			return err
+		}
+		pAndC.Provider = pB
+	}
+	pAndC.ContextID = contextID
+	m, err := json.Marshal(&pAndC)
+	if err != nil {
+		return err
+	}
+	return w.Put(ctx, e.contextIDIndexKey(provider, contextID), m)
+}
+
+func (e *Engine) deleteContextIDIndex(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	return w.Delete(ctx, e.contextIDIndexKey(provider, contextID))
+}
+
+// decodeContextIDIndex returns the provider and context ID of a context ID
+// index entry value.
+func (e *Engine) decodeContextIDIndex(value []byte) (peer.ID, []byte, error) {
+	var pAndC providerAndContext
+	if err := json.Unmarshal(value, &pAndC); err != nil {
+		return "", nil, fmt.Errorf("could not decode context ID index entry: %w", err)
+	}
+	if len(pAndC.Provider) == 0 {
+		return e.providerID(), pAndC.ContextID, nil
+	}
+	p, err := peer.IDFromBytes(pAndC.Provider)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not decode context ID index entry provider: %w", err)
+	}
+	return p, pAndC.ContextID, nil
+}
+
+// indexContextIDs adds the context IDs advertised before the context ID index
+// was introduced to the index. Since the index is kept up to date with the key
+// to CID mappings from then on, it only needs to be populated if it is empty.
+//
+// The context IDs are recovered from the keys of their key to CID mappings,
+// which is best effort: context IDs altered by cleaning the keys as paths are
+// indexed as altered.
+func (e *Engine) indexContextIDs(ctx context.Context) error {
+	indexed, err := e.ds.Query(ctx, query.Query{
+		Prefix:   datastore.NewKey(contextIDIndexPrefix).String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return fmt.Errorf("could not query context ID index: %w", err)
+	}
+	rs, err := indexed.Rest()
+	if err != nil {
+		return fmt.Errorf("could not query context ID index: %w", err)
+	}
+	if len(rs) != 0 {
+		return nil
+	}
+
+	prefix := datastore.NewKey(keyToCidMapPrefix).String()
+	results, err := e.ds.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return fmt.Errorf("could not query context IDs: %w", err)
+	}
+	defer results.Close()
+
+	batch, err := e.ds.Batch(ctx)
+	if err != nil {
+		return fmt.Errorf("could not create datastore batch: %w", err)
+	}
+	var count int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return fmt.Errorf("could not query context IDs: %w", r.Error)
+		}
+		p, contextID := e.providerAndContextIDFromKey(prefix, r.Key)
+		if err = e.putContextIDIndex(ctx, batch, p, contextID); err != nil {
+			return err
+		}
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	if err = batch.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit context ID index: %w", err)
+	}
+	log.Infow("Indexed previously advertised context IDs", "count", count)
+	return nil
+}
+
+// providerAndContextIDFromKey extracts the provider and context ID from a
+// mapping key found under the given prefix, e.g. a key to CID mapping key.
+//
+// Mappings of the default provider are not prefixed by a provider ID. Any key
+// under the prefix that starts with a valid peer ID segment is therefore
+// considered to belong to a different provider.
+func (e *Engine) providerAndContextIDFromKey(prefix, key string) (peer.ID, []byte) {
+	rest := strings.TrimPrefix(key, prefix+"/")
+	if i := strings.IndexByte(rest, '/'); i > 0 {
+		if p, err := peer.Decode(rest[:i]); err == nil {
+			return p, []byte(rest[i+1:])
+		}
+	}
+	return e.providerID(), []byte(rest)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
@@ -16,19 +17,17 @@ import (
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
-	"github.com/ipni/go-libipni/announce"
 	"github.com/ipni/go-libipni/announce/httpsender"
 	"github.com/ipni/go-libipni/announce/message"
-	"github.com/ipni/go-libipni/announce/p2psender"
 	"github.com/ipni/go-libipni/dagsync"
-	"github.com/ipni/go-libipni/dagsync/dtsync"
-	"github.com/ipni/go-libipni/dagsync/httpsync"
 	"github.com/ipni/go-libipni/ingest/schema"
 	"github.com/ipni/go-libipni/metadata"
 	provider "github.com/ipni/index-provider"
 	"github.com/ipni/index-provider/engine/chunker"
+	"github.com/ipni/index-provider/metrics"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -36,6 +35,7 @@ const (
 	cidToKeyMapPrefix            = "map/cidKey/"
 	cidToProviderAndKeyMapPrefix = "map/cidProvAndKey/"
 	keyToMetadataMapPrefix       = "map/keyMD/"
+	keyToAdMapPrefix             = "map/keyAd/"
 	latestAdvKey                 = "sync/adv/"
 	linksCachePath               = "/cache/links"
 )
@@ -44,6 +44,8 @@ var (
 	log = logging.Logger("provider/engine")
 
 	dsLatestAdvKey = datastore.NewKey(latestAdvKey)
+
+	errDuplicateContextID = errors.New("context ID appears more than once in batch")
 )
 
 // Engine is an implementation of the core reference provider interface.
@@ -54,9 +56,27 @@ type Engine struct {
 	entriesChunker *chunker.CachedEntriesChunker
 
 	publisher dagsync.Publisher
-
-	mhLister provider.MultihashLister
-	cblk     sync.Mutex
+	outbox    *announceOutbox
+	auditor   *listerAuditor
+	publishes *publishQueue
+
+	// sweeperLk guards sweeper, which is only started once a context ID has
+	// an expiry, and sweeperClosed, which is set on shutdown.
+	sweeperLk     sync.Mutex
+	sweeper       *expirySweeper
+	sweeperClosed bool
+
+	listers listerRegistry
+	cblk    sync.Mutex
+
+	// addrsLk guards the retrieval addresses of the default provider, which
+	// may be changed at runtime via Engine.UpdateAddrs.
+	addrsLk sync.RWMutex
+	// idLk guards the signing key and the ID of the default provider, which
+	// may be changed at runtime via Engine.RotateKey.
+	idLk sync.RWMutex
+
+	subs subscribers
 }
 
 var _ provider.Interface = (*Engine)(nil)
@@ -107,20 +127,38 @@ func New(o ...Option) (*Engine, error) {
 // dtsync.NewPublisherFromExisting
 func (e *Engine) Start(ctx context.Context) error {
 	var err error
+	// Roll back any publish that was interrupted before its writes were
+	// fully applied.
+	if err = e.recoverPendingPublish(ctx); err != nil {
+		return fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+	if err = e.indexContextIDs(ctx); err != nil {
+		return fmt.Errorf("could not index advertised context IDs: %w", err)
+	}
+
 	// Create datastore entriesChunker.
 	entriesCacheDs := dsn.Wrap(e.ds, datastore.NewKey(linksCachePath))
-	e.entriesChunker, err = chunker.NewCachedEntriesChunker(ctx, entriesCacheDs, e.entCacheCap, e.chunker, e.purgeCache)
+	if e.entCacheByteCap > 0 {
+		e.entriesChunker, err = chunker.NewByteBoundedCachedEntriesChunker(ctx, entriesCacheDs, e.entCacheByteCap, e.chunker, e.purgeCache)
+	} else {
+		e.entriesChunker, err = chunker.NewCachedEntriesChunker(ctx, entriesCacheDs, e.entCacheCap, e.chunker, e.purgeCache)
+	}
 	if err != nil {
 		return err
 	}
 
 	e.publisher, err = e.newPublisher()
 	if err != nil {
-		log.Errorw("Failed to instantiate dagsync publisher", "err", err, "kind", e.pubKind)
+		log.Errorw("Failed to instantiate dagsync publisher", "err", err, "kinds", e.pubKinds)
 		return err
 	}
 
 	if e.publisher != nil {
+		e.outbox, err = e.newAnnounceOutbox(ctx)
+		if err != nil {
+			return fmt.Errorf("could not create announce outbox: %w", err)
+		}
+
 		// Initialize publisher with latest advertisement CID.
 		adCid, err := e.getLatestAdCid(ctx)
 		if err != nil {
@@ -133,55 +171,37 @@ func (e *Engine) Start(ctx context.Context) error {
 		}
 	}
 
-	return nil
-}
-
-func (e *Engine) newPublisher() (dagsync.Publisher, error) {
-	switch e.pubKind {
-	case NoPublisher:
-		log.Info("Remote announcements is disabled; all advertisements will only be store locally.")
-		return nil, nil
-	case DataTransferPublisher, HttpPublisher:
-	default:
-		return nil, fmt.Errorf("unknown publisher kind: %s", e.pubKind)
+	// Let indexer nodes know if the retrieval addresses have changed since
+	// the last advertisement, e.g. due to a change in configuration.
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+	changed, err := e.addrsChanged(ctx)
+	if err != nil {
+		return fmt.Errorf("could not compare retrieval addresses with latest advertisement: %w", err)
 	}
-
-	var senders []announce.Sender
-
-	// If there are announce URLs, then creage an announce sender to send
-	// direct HTTP announce messages to these URLs.
-	if len(e.announceURLs) != 0 {
-		httpSender, err := httpsender.New(e.announceURLs, e.h.ID())
-		if err != nil {
-			return nil, fmt.Errorf("cannot create http announce sender: %w", err)
+	if changed {
+		if _, err = e.publishAddrsAdv(ctx, e.retrievalAddrs()); err != nil {
+			return fmt.Errorf("could not publish retrieval addresses update: %w", err)
 		}
-		senders = append(senders, httpSender)
 	}
 
-	// If there is a libp2p host, then create a gossip pubsub announce sender.
-	if e.h != nil {
-		// Create an announce sender to send over gossip pubsub.
-		p2pSender, err := p2psender.New(e.h, e.pubTopicName, p2psender.WithTopic(e.pubTopic))
+	if e.auditInterval > 0 {
+		e.startListerAuditor()
+	}
+	if e.expirySweepInterval > 0 {
+		// Context IDs may have expired while the engine was not running.
+		hasExpiries, err := e.hasExpiries(ctx)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("could not check for context ID expiries: %w", err)
+		}
+		if hasExpiries {
+			e.startExpirySweeper()
 		}
-		senders = append(senders, p2pSender)
-	}
-
-	if e.pubKind == HttpPublisher {
-		return httpsync.NewPublisher(e.pubHttpListenAddr, e.lsys, e.key, httpsync.WithAnnounceSenders(senders...))
-	}
-
-	dtOpts := []dtsync.Option{
-		dtsync.WithExtraData(e.pubExtraGossipData),
-		dtsync.WithAllowPeer(e.syncPolicy.Allowed),
-		dtsync.WithAnnounceSenders(senders...),
 	}
-	if e.pubDT != nil {
-		return dtsync.NewPublisherFromExisting(e.pubDT, e.h, e.pubTopicName, e.lsys, dtOpts...)
+	if e.publishes, err = e.newPublishQueue(ctx); err != nil {
+		return fmt.Errorf("could not create publish queue: %w", err)
 	}
-	ds := dsn.Wrap(e.ds, datastore.NewKey("/dagsync/dtsync/pub"))
-	return dtsync.NewPublisher(e.h, ds, e.lsys, e.pubTopicName, dtOpts...)
+	return nil
 }
 
 // PublishLocal stores the advertisement in the local link system and marks it
@@ -192,6 +212,48 @@ func (e *Engine) newPublisher() (dagsync.Publisher, error) {
 //
 // See: Engine.Publish.
 func (e *Engine) PublishLocal(ctx context.Context, adv schema.Advertisement) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+	return e.publishLocal(ctx, &publishJournal{}, adv)
+}
+
+// publishLocal stores the advertisement and marks it as the latest, along
+// with any writes already recorded in the given journal. The caller must hold
+// Engine.cblk.
+func (e *Engine) publishLocal(ctx context.Context, j *publishJournal, adv schema.Advertisement) (cid.Cid, error) {
+	c, err := e.storeAdv(ctx, j, adv)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err = e.commitLatest(ctx, j, c); err != nil {
+		return cid.Undef, err
+	}
+	return c, nil
+}
+
+// commitLatest marks the advertisement with the given CID as the latest, and
+// commits the journal. The caller must hold Engine.cblk.
+func (e *Engine) commitLatest(ctx context.Context, j *publishJournal, c cid.Cid) error {
+	log := log.With("adCid", c)
+
+	if err := j.Put(ctx, dsLatestAdvKey, c.Bytes()); err != nil {
+		return err
+	}
+	if err := e.commitJournal(ctx, j); err != nil {
+		log.Errorw("Failed to update reference to the latest advertisement", "err", err)
+		return fmt.Errorf("failed to update reference to latest advertisement: %w", err)
+	}
+	log.Info("Stored ad in local link system and updated reference to the latest advertisement successfully")
+	return nil
+}
+
+// storeAdv validates the advertisement and records its block, along with the
+// addresses it advertises for its provider, in the given journal.
+func (e *Engine) storeAdv(ctx context.Context, j *publishJournal, adv schema.Advertisement) (cid.Cid, error) {
 	if err := adv.Validate(); err != nil {
 		return cid.Undef, err
 	}
@@ -201,22 +263,49 @@ func (e *Engine) PublishLocal(ctx context.Context, adv schema.Advertisement) (ci
 		return cid.Undef, err
 	}
 
-	lnk, err := e.lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, adNode)
+	lsys := e.journalLinkSystem(j)
+	lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, adNode)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("cannot generate advertisement link: %s", err)
 	}
 	c := lnk.(cidlink.Link).Cid
-	log := log.With("adCid", c)
-	log.Info("Stored ad in local link system")
-
-	if err = e.putLatestAdv(ctx, c.Bytes()); err != nil {
-		log.Errorw("Failed to update reference to the latest advertisement", "err", err)
-		return cid.Undef, fmt.Errorf("failed to update reference to latest advertisement: %w", err)
+	if err = e.putAdvertisedAddrs(ctx, j, adv); err != nil {
+		return cid.Undef, fmt.Errorf("could not record advertised retrieval addresses: %w", err)
 	}
-	log.Info("Updated reference to the latest advertisement successfully")
+	p, _ := peer.Decode(adv.Provider)
+	j.published = append(j.published, publishedAd{
+		AdPublishedEvent: AdPublishedEvent{
+			AdCid:     c,
+			Provider:  p,
+			ContextID: adv.ContextID,
+			IsRm:      adv.IsRm,
+		},
+		adType: e.adType(ctx, p, adv),
+	})
 	return c, nil
 }
 
+// adType classifies the given advertisement by the change it makes, for
+// metrics: a removal, an update of the provider information without entries,
+// an update of the metadata of the already advertised entries of a context
+// ID, or a put of new entries.
+func (e *Engine) adType(ctx context.Context, p peer.ID, adv schema.Advertisement) attribute.KeyValue {
+	if adv.IsRm {
+		return metrics.Attributes.AdTypeRemove
+	}
+	if adv.Entries == schema.NoEntries {
+		return metrics.Attributes.AdTypeUpdateProvider
+	}
+	// Mappings written by the publish in progress are not visible yet, so the
+	// entries are only found mapped if they were previously advertised.
+	if entries, ok := adv.Entries.(cidlink.Link); ok {
+		if c, err := e.getKeyCidMap(ctx, p, adv.ContextID); err == nil && c == entries.Cid {
+			return metrics.Attributes.AdTypeUpdateMetadata
+		}
+	}
+	return metrics.Attributes.AdTypePut
+}
+
 // Publish stores the given advertisement locally via Engine.PublishLocal
 // first, then publishes a message onto the gossipsub to signal the change in
 // the latest advertisement by the provider to indexer nodes.
@@ -230,24 +319,33 @@ func (e *Engine) Publish(ctx context.Context, adv schema.Advertisement) (cid.Cid
 		return cid.Undef, fmt.Errorf("failed to publish advertisement locally: %w", err)
 	}
 
-	// Only announce the advertisement CID if publisher is configured.
-	if e.publisher != nil {
-		log := log.With("adCid", c)
-		if len(e.announceURLs) == 0 {
-			log.Info("Announcing advertisement in pubsub channel")
-		} else {
-			log.Info("Announcing advertisement in pubsub channel and via http")
-		}
+	e.announce(ctx, c)
+	return c, nil
+}
 
-		err = e.publisher.UpdateRoot(ctx, c)
-		if err != nil {
-			log.Errorw("Failed to announce advertisement", "err", err)
-			// Do not consider a failure to announce an error, since publishing
-			// locally worked.
-		}
+// announce publishes the given advertisement CID as the latest via the
+// publisher, if one is configured.
+func (e *Engine) announce(ctx context.Context, c cid.Cid) {
+	// Only announce the advertisement CID if publisher is configured.
+	if e.publisher == nil {
+		return
+	}
+	log := log.With("adCid", c)
+	if len(e.announceURLs) == 0 {
+		log.Info("Announcing advertisement in pubsub channel")
+	} else {
+		log.Info("Announcing advertisement in pubsub channel and via http")
 	}
 
-	return c, nil
+	if err := e.publisher.SetRoot(ctx, c); err != nil {
+		log.Errorw("Failed to set advertisement as the root of the publisher", "err", err)
+		return
+	}
+	if err := e.outbox.announce(ctx, c); err != nil {
+		log.Errorw("Failed to persist advertisement to announce", "err", err)
+		// Do not consider a failure to persist the announce outbox an error,
+		// since publishing locally worked and the announcement is still sent.
+	}
 }
 
 func (e *Engine) latestAdToPublish(ctx context.Context) (cid.Cid, error) {
@@ -270,7 +368,10 @@ func (e *Engine) latestAdToPublish(ctx context.Context) (cid.Cid, error) {
 	return adCid, nil
 }
 
-// PublishLatest re-publishes the latest existing advertisement to pubsub.
+// PublishLatest re-publishes the latest existing advertisement to pubsub and
+// the configured announce URLs. The advertisement is announced right away, and
+// the error of any announce target that fails is returned; such targets are
+// then retried in the background. See: Engine.AnnounceStatus.
 func (e *Engine) PublishLatest(ctx context.Context) (cid.Cid, error) {
 	adCid, err := e.latestAdToPublish(ctx)
 	if err != nil {
@@ -278,7 +379,11 @@ func (e *Engine) PublishLatest(ctx context.Context) (cid.Cid, error) {
 	}
 	log.Infow("Publishing latest advertisement", "cid", adCid)
 
-	err = e.publisher.UpdateRoot(ctx, adCid)
+	err = e.publisher.SetRoot(ctx, adCid)
+	if err != nil {
+		return adCid, err
+	}
+	err = e.outbox.announceNow(ctx, adCid)
 	if err != nil {
 		return adCid, err
 	}
@@ -315,21 +420,13 @@ func (e *Engine) httpAnnounce(ctx context.Context, adCid cid.Cid, announceURLs [
 		Cid: adCid,
 	}
 
-	// The publisher kind determines what addresses to put into the announce
+	// The publisher kinds determine what addresses to put into the announce
 	// message.
-	switch e.pubKind {
-	case NoPublisher:
+	if e.publisher == nil {
 		log.Info("Remote announcements disabled")
 		return nil
-	case DataTransferPublisher:
-		msg.SetAddrs(e.h.Addrs())
-	case HttpPublisher:
-		if len(e.pubHttpAnnounceAddrs) != 0 {
-			msg.SetAddrs(e.pubHttpAnnounceAddrs)
-		} else {
-			msg.SetAddrs(e.publisher.Addrs())
-		}
 	}
+	msg.SetAddrs(e.announceAddrs())
 
 	// Create the http announce sender.
 	httpSender, err := httpsender.New(announceURLs, e.h.ID())
@@ -338,7 +435,7 @@ func (e *Engine) httpAnnounce(ctx context.Context, adCid cid.Cid, announceURLs [
 	}
 
 	log.Infow("Announcing advertisements over HTTP", "urls", announceURLs)
-	return httpSender.Send(ctx, msg)
+	return e.newEventSender(httpSender, "http", urlStrings(announceURLs)...).Send(ctx, msg)
 }
 
 // RegisterMultihashLister registers a provider.MultihashLister that is used to
@@ -346,15 +443,17 @@ func (e *Engine) httpAnnounce(ctx context.Context, adCid cid.Cid, announceURLs [
 // such registration must be registered before calls to Engine.NotifyPut and
 // Engine.NotifyRemove.
 //
-// Note that successive calls to this function will replace the previous
-// registration. Only a single registration is supported.
+// The registered lister is the default one, used when no lister registered
+// via Engine.RegisterMultihashListerFor matches the provider ID and context
+// ID. Successive calls to this function replace the previous default.
 //
 // See: provider.Interface
 func (e *Engine) RegisterMultihashLister(mhl provider.MultihashLister) {
 	log.Debugf("Registering multihash lister in engine")
-	e.cblk.Lock()
-	defer e.cblk.Unlock()
-	e.mhLister = mhl
+	e.listers.lk.Lock()
+	e.listers.fallback = mhl
+	e.listers.lk.Unlock()
+	e.listerRegistered()
 }
 
 // NotifyPut publishes an advertisement that signals the list of multihashes
@@ -365,17 +464,26 @@ func (e *Engine) RegisterMultihashLister(mhl provider.MultihashLister) {
 // Note that prior to calling this function a provider.MultihashLister must be
 // registered.
 //
+// If an expiry is given via provider.WithExpiry or provider.WithTTL then it
+// is persisted, and the context ID is removed once it expires. The expiry is
+// persisted even if provider.ErrAlreadyAdvertised is returned. See:
+// WithExpirySweepInterval, Engine.ExtendTTL, Engine.ClearTTL.
+//
 // See: Engine.RegisterMultihashLister, Engine.Publish.
-func (e *Engine) NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error) {
+func (e *Engine) NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata, opts ...provider.NotifyOption) (cid.Cid, error) {
 	// The multihash lister must have been registered for the linkSystem to
 	// know how to go from contextID to list of CIDs.
-	pID := e.options.provider.ID
-	addrs := e.options.provider.Addrs
+	var pID peer.ID
+	var addrs []multiaddr.Multiaddr
 	if provider != nil {
 		pID = provider.ID
 		addrs = provider.Addrs
 	}
-	return e.publishAdvForIndex(ctx, pID, addrs, contextID, md, false)
+	expiry, err := notifyExpiry(opts)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return e.publishAdvForIndex(ctx, pID, addrs, contextID, md, false, expiry, cidlink.Link{})
 }
 
 // NotifyRemove publishes an advertisement that signals the list of multihashes
@@ -386,11 +494,66 @@ func (e *Engine) NotifyPut(ctx context.Context, provider *peer.AddrInfo, context
 //
 // See: Engine.RegisterMultihashLister, Engine.Publish.
 func (e *Engine) NotifyRemove(ctx context.Context, provider peer.ID, contextID []byte) (cid.Cid, error) {
-	// TODO: add support for "delete all" for provider
-	if provider == "" {
-		provider = e.options.provider.ID
+	return e.publishAdvForIndex(ctx, provider, nil, contextID, metadata.Metadata{}, true, time.Time{}, cidlink.Link{})
+}
+
+// NotifyPutBatch publishes one advertisement per given context ID in a
+// single datastore batch, and announces only the last one. Each advertisement
+// is generated the same way as Engine.NotifyPut.
+//
+// Context IDs that fail to be advertised, e.g. because they are already
+// advertised, are reported as a provider.BatchError along with the CID of the
+// last advertisement published for the rest of the batch.
+//
+// Note that prior to calling this function a provider.MultihashLister must be
+// registered.
+//
+// See: Engine.NotifyPut, Engine.RegisterMultihashLister.
+func (e *Engine) NotifyPutBatch(ctx context.Context, provider *peer.AddrInfo, contextIDs [][]byte, md metadata.Metadata) (cid.Cid, error) {
+	var pID peer.ID
+	var addrs []multiaddr.Multiaddr
+	if provider != nil {
+		pID = provider.ID
+		addrs = provider.Addrs
+	}
+	return e.publishAdvBatchForIndex(ctx, pID, addrs, contextIDs, md, false)
+}
+
+// NotifyRemoveBatch publishes one removal advertisement per given context ID
+// in a single datastore batch, and announces only the last one. Failures are
+// reported the same way as Engine.NotifyPutBatch.
+//
+// See: Engine.NotifyRemove, Engine.NotifyPutBatch.
+func (e *Engine) NotifyRemoveBatch(ctx context.Context, provider peer.ID, contextIDs [][]byte) (cid.Cid, error) {
+	return e.publishAdvBatchForIndex(ctx, provider, nil, contextIDs, metadata.Metadata{}, true)
+}
+
+// NotifyRemoveAll publishes one removal advertisement for every context ID
+// previously put for the given provider, and announces only the last one. The
+// key to CID, CID to key and metadata mappings of each removed context ID are
+// deleted along the way, the same way as Engine.NotifyRemove.
+//
+// If no context IDs are found for the provider then
+// provider.ErrContextIDNotFound is returned. Otherwise, failures are reported
+// the same way as Engine.NotifyPutBatch.
+//
+// If providerID is empty then the default configured provider will be assumed.
+//
+// See: Engine.NotifyRemove, Engine.NotifyRemoveBatch.
+func (e *Engine) NotifyRemoveAll(ctx context.Context, providerID peer.ID) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	providerID, _ = e.resolveProvider(providerID, nil, true)
+	contextIDs, err := e.listContextIDs(ctx, providerID)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not list context IDs of provider %s: %w", providerID, err)
+	}
+	if len(contextIDs) == 0 {
+		return cid.Undef, provider.ErrContextIDNotFound
 	}
-	return e.publishAdvForIndex(ctx, provider, nil, contextID, metadata.Metadata{}, true)
+	log.Infow("Removing all context IDs of provider", "provider", providerID, "count", len(contextIDs))
+	return e.publishAdvBatchForIndexLocked(ctx, providerID, nil, contextIDs, metadata.Metadata{}, true)
 }
 
 // LinkSystem gets the link system used by the engine to store and retrieve advertisement data.
@@ -402,6 +565,18 @@ func (e *Engine) LinkSystem() *ipld.LinkSystem {
 // engine. The engine is no longer usable after the call to this function.
 func (e *Engine) Shutdown() error {
 	var errs error
+	if e.publishes != nil {
+		e.publishes.close()
+	}
+	e.closeExpirySweeper()
+	if e.auditor != nil {
+		e.auditor.close()
+	}
+	if e.outbox != nil {
+		if err := e.outbox.close(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("error closing announce outbox: %s", err))
+		}
+	}
 	if e.publisher != nil {
 		if err := e.publisher.Close(); err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("error closing leg publisher: %s", err))
@@ -410,6 +585,7 @@ func (e *Engine) Shutdown() error {
 	if err := e.entriesChunker.Close(); err != nil {
 		errs = multierror.Append(errs, fmt.Errorf("error closing link entriesChunker: %s", err))
 	}
+	e.closeSubscribers()
 	return errs
 }
 
@@ -447,7 +623,93 @@ func (e *Engine) GetLatestAdv(ctx context.Context) (cid.Cid, *schema.Advertiseme
 	return latestAdCid, ad, nil
 }
 
-func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata, isRm bool) (cid.Cid, error) {
+// publishAdvForIndex generates, stores and announces an advertisement for the
+// given provider and context ID. If the provider is empty, the default
+// provider is assumed. Unless removing, a non-zero expiry is recorded along
+// with the mappings of the context ID. See mkAdvForIndex for entries.
+func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata, isRm bool, expiry time.Time, entries cidlink.Link) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	p, addrs = e.resolveProvider(p, addrs, isRm)
+
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	// Record all writes in a journal, so that the mappings, the advertisement
+	// and the reference to it as the latest are stored together.
+	j := &publishJournal{}
+	adv, err := e.mkAdvForIndex(ctx, j, p, addrs, contextID, md, isRm, entries)
+	if errors.Is(err, provider.ErrAlreadyAdvertised) && !expiry.IsZero() {
+		// There is nothing to publish, but the expiry still applies.
+		if err = e.putKeyExpiryMap(ctx, e.ds, p, contextID, expiry); err != nil {
+			return cid.Undef, fmt.Errorf("failed to write provider + context id to expiry mapping: %w", err)
+		}
+		e.startExpirySweeper()
+		return cid.Undef, provider.ErrAlreadyAdvertised
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !isRm && !expiry.IsZero() {
+		if err = e.putKeyExpiryMap(ctx, j, p, contextID, expiry); err != nil {
+			return cid.Undef, fmt.Errorf("failed to write provider + context id to expiry mapping: %w", err)
+		}
+	}
+
+	c, err := e.linkAndPublish(ctx, j, p, adv)
+	if err == nil && !isRm && !expiry.IsZero() {
+		e.startExpirySweeper()
+	}
+	return c, err
+}
+
+// linkAndPublish links the given advertisement of the given provider to the
+// latest advertisement, signs it, stores it along with the writes recorded in
+// the journal, and announces it. The chain lock must be held.
+func (e *Engine) linkAndPublish(ctx context.Context, j *publishJournal, p peer.ID, adv *schema.Advertisement) (cid.Cid, error) {
+	// Get the previous advertisement that was generated.
+	prevAdvID, err := e.getLatestAdCid(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not get latest advertisement: %s", err)
+	}
+
+	// Check for cid.Undef for the previous link. If this is the case, then
+	// this means there is a "cid too short" error in IPLD links serialization.
+	if prevAdvID != cid.Undef {
+		log.Info("Latest advertisement CID was undefined - no previous advertisement")
+		prev := ipld.Link(cidlink.Link{Cid: prevAdvID})
+		adv.PreviousID = prev
+	}
+
+	// Sign the advertisement.
+	if err := adv.Sign(e.signingKey()); err != nil {
+		return cid.Undef, err
+	}
+	c, err := e.storeAdv(ctx, j, *adv)
+	if err == nil && !adv.IsRm {
+		err = e.putKeyAdMap(ctx, j, p, adv.ContextID, c)
+	}
+	if err == nil {
+		err = e.commitLatest(ctx, j, c)
+	}
+	if err != nil {
+		log.Errorw("Failed to store advertisement locally", "err", err)
+		return cid.Undef, fmt.Errorf("failed to publish advertisement locally: %w", err)
+	}
+
+	e.announce(ctx, c)
+	return c, nil
+}
+
+// mkAdvForIndex generates an unsigned advertisement with no previous link for
+// the given provider and context ID. The provider and context ID mappings are
+// updated by writing to w, which is the journal of the publish in progress.
+//
+// If entries is defined, it is used as the entries of a context ID that is
+// not advertised yet instead of chunking the multihashes of its lister.
+func (e *Engine) mkAdvForIndex(ctx context.Context, w datastore.Write, p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata, isRm bool, entries cidlink.Link) (*schema.Advertisement, error) {
 	var err error
 	var cidsLnk cidlink.Link
 
@@ -456,7 +718,7 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 	c, err := e.getKeyCidMap(ctx, p, contextID)
 	if err != nil {
 		if err != datastore.ErrNotFound {
-			return cid.Undef, fmt.Errorf("cound not not get entries cid by provider + context id: %s", err)
+			return nil, fmt.Errorf("cound not not get entries cid by provider + context id: %s", err)
 		}
 	}
 
@@ -468,40 +730,25 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 
 		// If no previously-published ad for this context ID.
 		if c == cid.Undef {
-			log.Info("Generating entries linked list for advertisement")
-			// If no lister registered return error.
-			if e.mhLister == nil {
-				return cid.Undef, provider.ErrNoMultihashLister
-			}
-
-			// Call the lister.
-			mhIter, err := e.mhLister(ctx, p, contextID)
-			if err != nil {
-				return cid.Undef, err
-			}
-			// Generate the linked list ipld.Link that is added to the
-			// advertisement and used for ingestion.
-			lnk, err := e.entriesChunker.Chunk(ctx, mhIter)
-			if err != nil {
-				return cid.Undef, fmt.Errorf("could not generate entries list: %s", err)
-			} else if lnk == nil {
-				log.Warnw("chunking for context ID resulted in no link", "contextID", contextID)
-				lnk = schema.NoEntries
+			cidsLnk = entries
+			if cidsLnk.Cid == cid.Undef {
+				if cidsLnk, err = e.chunkEntries(ctx, p, contextID); err != nil {
+					return nil, err
+				}
 			}
-			cidsLnk = lnk.(cidlink.Link)
 
 			// Store the relationship between providerID, contextID and CID of the
 			// advertised list of Cids.
-			err = e.putKeyCidMap(ctx, p, contextID, cidsLnk.Cid)
+			err = e.putKeyCidMap(ctx, w, p, contextID, cidsLnk.Cid)
 			if err != nil {
-				return cid.Undef, fmt.Errorf("failed to write provider + context id to entries cid mapping: %s", err)
+				return nil, fmt.Errorf("failed to write provider + context id to entries cid mapping: %s", err)
 			}
 		} else {
 			// Lookup metadata for this providerID and contextID.
 			prevMetadata, err := e.getKeyMetadataMap(ctx, p, contextID)
 			if err != nil {
 				if err != datastore.ErrNotFound {
-					return cid.Undef, fmt.Errorf("could not get metadata for provider + context id: %s", err)
+					return nil, fmt.Errorf("could not get metadata for provider + context id: %s", err)
 				}
 				log.Warn("No metadata for existing provider + context ID, generating new advertisement")
 			}
@@ -509,7 +756,7 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 			if md.Equal(prevMetadata) {
 				// Metadata is the same; no change, no need for new
 				// advertisement.
-				return cid.Undef, provider.ErrAlreadyAdvertised
+				return nil, provider.ErrAlreadyAdvertised
 			}
 
 			// Linked list is the same, but metadata is different, so generate
@@ -517,29 +764,41 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 			cidsLnk = cidlink.Link{Cid: c}
 		}
 
-		if err = e.putKeyMetadataMap(ctx, p, contextID, &md); err != nil {
-			return cid.Undef, fmt.Errorf("failed to write provider + context id to metadata mapping: %s", err)
+		if err = e.putKeyMetadataMap(ctx, w, p, contextID, &md); err != nil {
+			return nil, fmt.Errorf("failed to write provider + context id to metadata mapping: %s", err)
 		}
 	} else {
 		log.Info("Creating removal advertisement")
 
 		if c == cid.Undef {
-			return cid.Undef, provider.ErrContextIDNotFound
+			return nil, provider.ErrContextIDNotFound
 		}
 
 		// If removing by context ID, it means the list of CIDs is not needed
 		// anymore, so we can remove the entry from the datastore.
-		err = e.deleteKeyCidMap(ctx, p, contextID)
+		err = e.deleteKeyCidMap(ctx, w, p, contextID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete provider + context id to entries cid mapping: %s", err)
+		}
+		err = e.deleteCidKeyMap(ctx, w, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete entries cid to provider + context id mapping: %s", err)
+		}
+		err = e.deleteKeyMetadataMap(ctx, w, p, contextID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete provider + context id to metadata mapping: %s", err)
+		}
+		err = e.deleteKeyAdMap(ctx, w, p, contextID)
 		if err != nil {
-			return cid.Undef, fmt.Errorf("failed to delete provider + context id to entries cid mapping: %s", err)
+			return nil, fmt.Errorf("failed to delete provider + context id to advertisement mapping: %s", err)
 		}
-		err = e.deleteCidKeyMap(ctx, c)
+		err = e.deleteKeyXProvidersMap(ctx, w, p, contextID)
 		if err != nil {
-			return cid.Undef, fmt.Errorf("failed to delete entries cid to provider + context id mapping: %s", err)
+			return nil, fmt.Errorf("failed to delete provider + context id to extended providers mapping: %s", err)
 		}
-		err = e.deleteKeyMetadataMap(ctx, p, contextID)
+		err = e.deleteKeyExpiryMap(ctx, w, p, contextID)
 		if err != nil {
-			return cid.Undef, fmt.Errorf("failed to delete provider + context id to metadata mapping: %s", err)
+			return nil, fmt.Errorf("failed to delete provider + context id to expiry mapping: %s", err)
 		}
 
 		// Create an advertisement to delete content by contextID by specifying
@@ -551,9 +810,14 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 		md = metadata.Default.New()
 	}
 
+	return newAdvertisement(p, addrs, contextID, md, cidsLnk, isRm)
+}
+
+// newAdvertisement returns an unsigned advertisement with no previous link.
+func newAdvertisement(p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata, entries cidlink.Link, isRm bool) (*schema.Advertisement, error) {
 	mdBytes, err := md.MarshalBinary()
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
 
 	var stringAddrs []string
@@ -561,39 +825,158 @@ func (e *Engine) publishAdvForIndex(ctx context.Context, p peer.ID, addrs []mult
 		stringAddrs = append(stringAddrs, addr.String())
 	}
 
-	adv := schema.Advertisement{
+	return &schema.Advertisement{
 		Provider:  p.String(),
 		Addresses: stringAddrs,
-		Entries:   cidsLnk,
+		Entries:   entries,
 		ContextID: contextID,
 		Metadata:  mdBytes,
 		IsRm:      isRm,
+	}, nil
+}
+
+// chunkEntries chunks the multihashes that the lister of the given provider
+// and context ID returns, and returns the link to the root of the entries, or
+// schema.NoEntries if there are none.
+func (e *Engine) chunkEntries(ctx context.Context, p peer.ID, contextID []byte) (cidlink.Link, error) {
+	log := log.With("providerID", p).With("contextID", base64.StdEncoding.EncodeToString(contextID))
+	log.Info("Generating entries linked list for advertisement")
+	// If no lister matches return error.
+	mhLister, err := e.multihashLister(p, contextID, true)
+	if err != nil {
+		return cidlink.Link{}, err
 	}
 
-	// Get the previous advertisement that was generated.
+	// Call the lister.
+	mhIter, err := mhLister(ctx, p, contextID)
+	if err != nil {
+		return cidlink.Link{}, err
+	}
+	// Generate the linked list ipld.Link that is added to the
+	// advertisement and used for ingestion.
+	lnk, err := e.entriesChunker.Chunk(ctx, mhIter)
+	if err != nil {
+		return cidlink.Link{}, fmt.Errorf("could not generate entries list: %s", err)
+	} else if lnk == nil {
+		log.Warnw("chunking for context ID resulted in no link", "contextID", contextID)
+		lnk = schema.NoEntries
+	}
+	cidsLnk := lnk.(cidlink.Link)
+	if cidsLnk != schema.NoEntries {
+		e.emit(EntriesChunkedEvent{
+			Provider:  p,
+			ContextID: contextID,
+			Entries:   cidsLnk.Cid,
+		})
+	}
+	return cidsLnk, nil
+}
+
+// publishAdvBatchForIndex generates one advertisement per context ID, and
+// stores all of them along with their provider and context ID mappings in a
+// single journal. Only the last advertisement in the batch is announced.
+//
+// Context IDs that fail are skipped, and reported via provider.BatchError once
+// the rest of the batch is published.
+func (e *Engine) publishAdvBatchForIndex(ctx context.Context, p peer.ID, addrs []multiaddr.Multiaddr, contextIDs [][]byte, md metadata.Metadata, isRm bool) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+	return e.publishAdvBatchForIndexLocked(ctx, p, addrs, contextIDs, md, isRm)
+}
+
+// publishAdvBatchForIndexLocked is publishAdvBatchForIndex for callers that
+// already hold the chain lock.
+func (e *Engine) publishAdvBatchForIndexLocked(ctx context.Context, p peer.ID, addrs []multiaddr.Multiaddr, contextIDs [][]byte, md metadata.Metadata, isRm bool) (cid.Cid, error) {
+	p, addrs = e.resolveProvider(p, addrs, isRm)
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	j := &publishJournal{}
 	prevAdvID, err := e.getLatestAdCid(ctx)
 	if err != nil {
 		return cid.Undef, fmt.Errorf("could not get latest advertisement: %s", err)
 	}
 
-	// Check for cid.Undef for the previous link. If this is the case, then
-	// this means there is a "cid too short" error in IPLD links serialization.
-	if prevAdvID != cid.Undef {
-		log.Info("Latest advertisement CID was undefined - no previous advertisement")
-		prev := ipld.Link(cidlink.Link{Cid: prevAdvID})
-		adv.PreviousID = prev
+	var errs provider.BatchError
+	seen := make(map[string]struct{}, len(contextIDs))
+	var published int
+	for _, contextID := range contextIDs {
+		// Mappings written to the journal are not visible until it is
+		// committed, so the same context ID cannot be processed twice.
+		if _, ok := seen[string(contextID)]; ok {
+			errs = append(errs, provider.ContextIDError{ContextID: contextID, Err: errDuplicateContextID})
+			continue
+		}
+		seen[string(contextID)] = struct{}{}
+
+		// Record the writes of each context ID in a journal of its own, so
+		// that the writes of a context ID that fails are discarded rather
+		// than committed with the rest of the batch.
+		cj := &publishJournal{}
+		adCid, err := e.mkBatchAdv(ctx, cj, p, addrs, contextID, md, isRm, prevAdvID)
+		if err != nil {
+			errs = append(errs, provider.ContextIDError{ContextID: contextID, Err: err})
+			continue
+		}
+		j.append(cj)
+		prevAdvID = adCid
+		published++
 	}
 
-	// Sign the advertisement.
-	if err := adv.Sign(e.key); err != nil {
+	if published == 0 {
+		if len(errs) == 0 {
+			return cid.Undef, nil
+		}
+		return cid.Undef, errs
+	}
+
+	if err = j.Put(ctx, dsLatestAdvKey, prevAdvID.Bytes()); err != nil {
+		return cid.Undef, fmt.Errorf("failed to update reference to latest advertisement: %w", err)
+	}
+	if err = e.commitJournal(ctx, j); err != nil {
+		return cid.Undef, fmt.Errorf("failed to commit advertisement batch: %w", err)
+	}
+	log.Infow("Published batch of advertisements", "count", published, "failed", len(errs), "adCid", prevAdvID)
+
+	e.announce(ctx, prevAdvID)
+
+	if len(errs) != 0 {
+		return prevAdvID, errs
+	}
+	return prevAdvID, nil
+}
+
+// mkBatchAdv generates, signs and stores the advertisement of the given
+// context ID linked to the given previous advertisement, as part of a batch.
+// All writes, including the provider and context ID mappings, are recorded in
+// the given journal.
+func (e *Engine) mkBatchAdv(ctx context.Context, j *publishJournal, p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata, isRm bool, prevAdvID cid.Cid) (cid.Cid, error) {
+	adv, err := e.mkAdvForIndex(ctx, j, p, addrs, contextID, md, isRm, cidlink.Link{})
+	if err != nil {
 		return cid.Undef, err
 	}
-	return e.Publish(ctx, adv)
+	if prevAdvID != cid.Undef {
+		adv.PreviousID = cidlink.Link{Cid: prevAdvID}
+	}
+	if err = adv.Sign(e.signingKey()); err != nil {
+		return cid.Undef, err
+	}
+	adCid, err := e.storeAdv(ctx, j, *adv)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !isRm {
+		if err = e.putKeyAdMap(ctx, j, p, contextID, adCid); err != nil {
+			return cid.Undef, fmt.Errorf("failed to write provider + context id to advertisement mapping: %w", err)
+		}
+	}
+	return adCid, nil
 }
 
 func (e *Engine) keyToCidKey(provider peer.ID, contextID []byte) datastore.Key {
 	switch provider {
-	case e.provider.ID:
+	case e.providerID():
 		return datastore.NewKey(keyToCidMapPrefix + string(contextID))
 	default:
 		return datastore.NewKey(keyToCidMapPrefix + provider.String() + "/" + string(contextID))
@@ -610,21 +993,24 @@ func (e *Engine) cidToProviderAndKeyKey(c cid.Cid) datastore.Key {
 
 func (e *Engine) keyToMetadataKey(provider peer.ID, contextID []byte) datastore.Key {
 	switch provider {
-	case e.provider.ID:
+	case e.providerID():
 		return datastore.NewKey(keyToMetadataMapPrefix + string(contextID))
 	default:
 		return datastore.NewKey(keyToMetadataMapPrefix + provider.String() + "/" + string(contextID))
 	}
 }
 
-func (e *Engine) putKeyCidMap(ctx context.Context, provider peer.ID, contextID []byte, c cid.Cid) error {
+func (e *Engine) putKeyCidMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte, c cid.Cid) error {
 	// Store the map Key-Cid to know what CidLink to put in advertisement when
 	// notifying about a removal.
 
-	err := e.ds.Put(ctx, e.keyToCidKey(provider, contextID), c.Bytes())
+	err := w.Put(ctx, e.keyToCidKey(provider, contextID), c.Bytes())
 	if err != nil {
 		return err
 	}
+	if err = e.putContextIDIndex(ctx, w, provider, contextID); err != nil {
+		return err
+	}
 	// And the other way around when graphsync is making a request, so the
 	// lister in the linksystem knows to what contextID the CID referrs to.
 	// it's enough for us to store just a single mapping of cid to provider and context to generate chunks
@@ -637,7 +1023,7 @@ func (e *Engine) putKeyCidMap(ctx context.Context, provider peer.ID, contextID [
 	if err != nil {
 		return err
 	}
-	return e.ds.Put(ctx, e.cidToProviderAndKeyKey(c), m)
+	return w.Put(ctx, e.cidToProviderAndKeyKey(c), m)
 }
 
 func (e *Engine) getKeyCidMap(ctx context.Context, provider peer.ID, contextID []byte) (cid.Cid, error) {
@@ -649,16 +1035,19 @@ func (e *Engine) getKeyCidMap(ctx context.Context, provider peer.ID, contextID [
 	return d, err
 }
 
-func (e *Engine) deleteKeyCidMap(ctx context.Context, provider peer.ID, contextID []byte) error {
-	return e.ds.Delete(ctx, e.keyToCidKey(provider, contextID))
+func (e *Engine) deleteKeyCidMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	if err := w.Delete(ctx, e.keyToCidKey(provider, contextID)); err != nil {
+		return err
+	}
+	return e.deleteContextIDIndex(ctx, w, provider, contextID)
 }
 
-func (e *Engine) deleteCidKeyMap(ctx context.Context, c cid.Cid) error {
-	err := e.ds.Delete(ctx, e.cidToProviderAndKeyKey(c))
+func (e *Engine) deleteCidKeyMap(ctx context.Context, w datastore.Write, c cid.Cid) error {
+	err := w.Delete(ctx, e.cidToProviderAndKeyKey(c))
 	if err != nil {
 		return err
 	}
-	return e.ds.Delete(ctx, e.cidToKeyKey(c))
+	return w.Delete(ctx, e.cidToKeyKey(c))
 }
 
 type providerAndContext struct {
@@ -689,12 +1078,12 @@ func (e *Engine) getCidKeyMap(ctx context.Context, c cid.Cid) (*providerAndConte
 	return &pAndC, nil
 }
 
-func (e *Engine) putKeyMetadataMap(ctx context.Context, provider peer.ID, contextID []byte, metadata *metadata.Metadata) error {
+func (e *Engine) putKeyMetadataMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte, metadata *metadata.Metadata) error {
 	data, err := metadata.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	return e.ds.Put(ctx, e.keyToMetadataKey(provider, contextID), data)
+	return w.Put(ctx, e.keyToMetadataKey(provider, contextID), data)
 }
 
 func (e *Engine) getKeyMetadataMap(ctx context.Context, provider peer.ID, contextID []byte) (metadata.Metadata, error) {
@@ -709,12 +1098,42 @@ func (e *Engine) getKeyMetadataMap(ctx context.Context, provider peer.ID, contex
 	return md, nil
 }
 
-func (e *Engine) deleteKeyMetadataMap(ctx context.Context, provider peer.ID, contextID []byte) error {
-	return e.ds.Delete(ctx, e.keyToMetadataKey(provider, contextID))
+func (e *Engine) deleteKeyMetadataMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	return w.Delete(ctx, e.keyToMetadataKey(provider, contextID))
+}
+
+func (e *Engine) keyToAdKey(provider peer.ID, contextID []byte) datastore.Key {
+	switch provider {
+	case e.providerID():
+		return datastore.NewKey(keyToAdMapPrefix + string(contextID))
+	default:
+		return datastore.NewKey(keyToAdMapPrefix + provider.String() + "/" + string(contextID))
+	}
+}
+
+// putKeyAdMap stores the CID of the advertisement that last put the given
+// provider and context ID.
+func (e *Engine) putKeyAdMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte, adCid cid.Cid) error {
+	return w.Put(ctx, e.keyToAdKey(provider, contextID), adCid.Bytes())
+}
+
+// getKeyAdMap returns the CID of the advertisement that last put the given
+// provider and context ID, or cid.Undef if it is not known, e.g. because the
+// context ID was advertised before such mappings were recorded.
+func (e *Engine) getKeyAdMap(ctx context.Context, provider peer.ID, contextID []byte) (cid.Cid, error) {
+	b, err := e.ds.Get(ctx, e.keyToAdKey(provider, contextID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, nil
+		}
+		return cid.Undef, err
+	}
+	_, c, err := cid.CidFromBytes(b)
+	return c, err
 }
 
-func (e *Engine) putLatestAdv(ctx context.Context, advID []byte) error {
-	return e.ds.Put(ctx, dsLatestAdvKey, advID)
+func (e *Engine) deleteKeyAdMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	return w.Delete(ctx, e.keyToAdKey(provider, contextID))
 }
 
 func (e *Engine) getLatestAdCid(ctx context.Context) (cid.Cid, error) {
@@ -8,6 +8,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,12 +24,12 @@ func (e *Engine) Chunker() *chunker.CachedEntriesChunker {
 
 // Key returns the engine's private key, exposed for testing purposes only.
 func (e *Engine) Key() crypto.PrivKey {
-	return e.key
+	return e.signingKey()
 }
 
 // ProviderID returns the engine's default provider ID, exposed for testing purposes only.
 func (e *Engine) ProviderID() peer.ID {
-	return e.provider.ID
+	return e.providerID()
 }
 
 // ProviderAddrs returns the engine's default provider addresses, exposed for testing purposes only.
@@ -41,6 +42,18 @@ func (e *Engine) Datastore() datastore.Datastore {
 	return e.ds
 }
 
+// PublisherAddrs returns the addresses of the engine's publishers, exposed for testing purposes only.
+func (e *Engine) PublisherAddrs() []multiaddr.Multiaddr {
+	return e.announceAddrs()
+}
+
+// ParkedPublishes returns the number of restored publishes that wait for their multihash lister, exposed for testing purposes only.
+func (e *Engine) ParkedPublishes() int {
+	e.publishes.lk.Lock()
+	defer e.publishes.lk.Unlock()
+	return len(e.publishes.parked)
+}
+
 func Test_EmptyConfigSetsDefaults(t *testing.T) {
 	engine, err := New()
 	require.NoError(t, err)
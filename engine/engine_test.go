@@ -4,14 +4,19 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/ipld/go-ipld-prime"
@@ -22,19 +27,28 @@ import (
 	selectorbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/ipni/go-libipni/announce/message"
 	"github.com/ipni/go-libipni/dagsync/dtsync"
+	"github.com/ipni/go-libipni/dagsync/httpsync"
 	"github.com/ipni/go-libipni/dagsync/p2p/protocol/head"
 	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/ipni/go-libipni/maurl"
 	"github.com/ipni/go-libipni/metadata"
 	"github.com/ipni/go-libipni/test"
 	provider "github.com/ipni/index-provider"
 	"github.com/ipni/index-provider/engine"
+	"github.com/ipni/index-provider/engine/mhfilter"
+	"github.com/ipni/index-provider/engine/policy"
+	"github.com/ipni/index-provider/engine/xproviders"
 	"github.com/ipni/index-provider/testutil"
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/metric/global"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"golang.org/x/time/rate"
 )
 
@@ -366,70 +380,2127 @@ func TestEngine_NotifyPutThenNotifyRemove(t *testing.T) {
 	require.NotEqual(t, gotLatestAfterRmAdCid, gotLatestAdCid)
 }
 
+func TestEngine_NotifyPutBatchDiscardsFailedContextIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// The advertisement of a context ID that is too long fails validation once
+	// its mappings are already generated.
+	tooLong := bytes.Repeat([]byte("x"), schema.MaxContextIDLen+1)
+	gotHead, err := subject.NotifyPutBatch(ctx, nil, [][]byte{[]byte("fish"), tooLong}, md)
+	require.NotEqual(t, cid.Undef, gotHead)
+	var batchErr provider.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr, 1)
+	require.Equal(t, tooLong, batchErr[0].ContextID)
+
+	// None of the mappings of the failed context ID are committed.
+	_, err = subject.NotifyRemove(ctx, "", tooLong)
+	require.ErrorIs(t, err, provider.ErrContextIDNotFound)
+	_, err = subject.NotifyRemove(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+}
+
+func TestEngine_NotifyPutBatchThenNotifyRemoveBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	mhsByContextID := map[string][]multihash.Multihash{
+		"fish":    test.RandomMultihashes(42),
+		"lobster": test.RandomMultihashes(42),
+		"crab":    test.RandomMultihashes(42),
+	}
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		mhs, ok := mhsByContextID[string(contextID)]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
+
+	contextIDs := [][]byte{[]byte("fish"), []byte("crab"), []byte("lobster"), []byte("fish")}
+	gotHead, err := subject.NotifyPutBatch(ctx, nil, contextIDs, md)
+	require.NotEqual(t, cid.Undef, gotHead)
+	var batchErr provider.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr, 2)
+	require.Equal(t, []byte("crab"), batchErr[0].ContextID)
+	require.ErrorIs(t, batchErr[0], provider.ErrAlreadyAdvertised)
+	require.Equal(t, []byte("fish"), batchErr[1].ContextID)
+
+	// Only the last ad in the batch is the head, and it links to the rest of
+	// the batch.
+	gotLatestAdCid, ad, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.Equal(t, gotHead, gotLatestAdCid)
+	require.Equal(t, []byte("lobster"), ad.ContextID)
+	prevAd, err := subject.GetAdv(ctx, ad.PreviousID.(cidlink.Link).Cid)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fish"), prevAd.ContextID)
+	require.False(t, prevAd.IsRm)
+
+	// Already batch-advertised context IDs are known to the engine.
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.Equal(t, provider.ErrAlreadyAdvertised, err)
+
+	gotRmHead, err := subject.NotifyRemoveBatch(ctx, "", [][]byte{[]byte("fish"), []byte("squid"), []byte("lobster")})
+	require.NotEqual(t, cid.Undef, gotRmHead)
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr, 1)
+	require.Equal(t, []byte("squid"), batchErr[0].ContextID)
+	require.ErrorIs(t, batchErr[0], provider.ErrContextIDNotFound)
+
+	ad, err = subject.GetAdv(ctx, gotRmHead)
+	require.NoError(t, err)
+	require.True(t, ad.IsRm)
+	require.Equal(t, []byte("lobster"), ad.ContextID)
+	prevAd, err = subject.GetAdv(ctx, ad.PreviousID.(cidlink.Link).Cid)
+	require.NoError(t, err)
+	require.True(t, prevAd.IsRm)
+	require.Equal(t, []byte("fish"), prevAd.ContextID)
+	require.Equal(t, gotHead, prevAd.PreviousID.(cidlink.Link).Cid)
+
+	// Batch with only failures publishes nothing.
+	c, err := subject.NotifyRemoveBatch(ctx, "", [][]byte{[]byte("fish")})
+	require.Equal(t, cid.Undef, c)
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr, 1)
+	require.ErrorIs(t, batchErr[0], provider.ErrContextIDNotFound)
+}
+
 func TestEngine_NotifyRemoveWithDefaultProvider(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	t.Cleanup(cancel)
 
-	mhs := test.RandomMultihashes(42)
+	mhs := test.RandomMultihashes(42)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	wantContextID := []byte("fish")
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		if string(contextID) == string(wantContextID) {
+			return provider.SliceMultihashIterator(mhs), nil
+		}
+		return nil, errors.New("not found")
+	})
+
+	_, err = subject.NotifyPut(ctx, nil, wantContextID, metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	gotRemoveAdCid, err := subject.NotifyRemove(ctx, "", wantContextID)
+	require.NoError(t, err)
+
+	ad, err := subject.GetAdv(ctx, gotRemoveAdCid)
+	require.NoError(t, err)
+
+	// verify that the provider is resolved to the default one when empty
+	require.Equal(t, subject.ProviderID().String(), ad.Provider)
+}
+
+func TestEngine_NotifyRemoveWithCustomProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	mhs := test.RandomMultihashes(42)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	wantContextID := []byte("fish")
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		if string(contextID) == string(wantContextID) {
+			return provider.SliceMultihashIterator(mhs), nil
+		}
+		return nil, errors.New("not found")
+	})
+
+	providerId, _, _ := test.RandomIdentity()
+	providerAddrs, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/1234/http")
+
+	_, err = subject.NotifyPut(ctx, &peer.AddrInfo{ID: providerId, Addrs: []multiaddr.Multiaddr{providerAddrs}}, wantContextID, metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	gotRemoveAdCid, err := subject.NotifyRemove(ctx, providerId, wantContextID)
+	require.NoError(t, err)
+
+	ad, err := subject.GetAdv(ctx, gotRemoveAdCid)
+	require.NoError(t, err)
+
+	require.Equal(t, providerId.String(), ad.Provider)
+}
+
+func TestEngine_NotifyRemoveAll(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	mhsByContextID := map[string][]multihash.Multihash{
+		"fish":    test.RandomMultihashes(42),
+		"lobster": test.RandomMultihashes(42),
+		"crab":    test.RandomMultihashes(42),
+	}
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		mhs, ok := mhsByContextID[string(contextID)]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	providerId, _, _ := test.RandomIdentity()
+	providerAddrs, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/1234/http")
+	customProvider := &peer.AddrInfo{ID: providerId, Addrs: []multiaddr.Multiaddr{providerAddrs}}
+
+	_, err = subject.NotifyPutBatch(ctx, nil, [][]byte{[]byte("fish"), []byte("lobster")}, md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPutBatch(ctx, customProvider, [][]byte{[]byte("fish"), []byte("crab")}, md)
+	require.NoError(t, err)
+
+	// Removing all context IDs of the custom provider leaves the ones of the
+	// default provider intact.
+	gotHead, err := subject.NotifyRemoveAll(ctx, providerId)
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, gotHead)
+	require.NoError(t, err)
+	require.True(t, ad.IsRm)
+	require.Equal(t, providerId.String(), ad.Provider)
+	prevAd, err := subject.GetAdv(ctx, ad.PreviousID.(cidlink.Link).Cid)
+	require.NoError(t, err)
+	require.True(t, prevAd.IsRm)
+	require.Equal(t, providerId.String(), prevAd.Provider)
+	require.ElementsMatch(t, [][]byte{[]byte("fish"), []byte("crab")}, [][]byte{ad.ContextID, prevAd.ContextID})
+
+	_, err = subject.NotifyRemove(ctx, providerId, []byte("crab"))
+	require.Equal(t, provider.ErrContextIDNotFound, err)
+	_, err = subject.NotifyRemoveAll(ctx, providerId)
+	require.Equal(t, provider.ErrContextIDNotFound, err)
+
+	// Mappings are cleaned up, so the same context ID can be put again.
+	_, err = subject.NotifyPut(ctx, customProvider, []byte("crab"), md)
+	require.NoError(t, err)
+
+	gotHead, err = subject.NotifyRemoveAll(ctx, "")
+	require.NoError(t, err)
+	ad, err = subject.GetAdv(ctx, gotHead)
+	require.NoError(t, err)
+	require.True(t, ad.IsRm)
+	require.Equal(t, subject.ProviderID().String(), ad.Provider)
+
+	_, err = subject.NotifyRemove(ctx, "", []byte("fish"))
+	require.Equal(t, provider.ErrContextIDNotFound, err)
+	_, err = subject.NotifyRemove(ctx, providerId, []byte("crab"))
+	require.NoError(t, err)
+}
+
+func TestEngine_PreservesRawContextIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New(
+		engine.WithPublisherKind(engine.NoPublisher),
+		engine.WithExpirySweepInterval(10*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(5)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// Context IDs that are altered when cleaned as datastore key paths, or
+	// whose first segment is a peer ID.
+	otherID, _, _ := test.RandomIdentity()
+	contextIDs := [][]byte{
+		[]byte("fish//lobster/"),
+		[]byte("crab/../shrimp"),
+		{0xff, '/', '.', '.', '/', 0x00},
+		[]byte(otherID.String() + "/squid"),
+	}
+	_, err = subject.NotifyPutBatch(ctx, nil, contextIDs, md)
+	require.NoError(t, err)
+
+	it, err := subject.ListContextIDs(ctx, "")
+	require.NoError(t, err)
+	var listed [][]byte
+	for {
+		info, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		listed = append(listed, info.ContextID)
+	}
+	require.NoError(t, it.Close())
+	require.ElementsMatch(t, contextIDs, listed)
+
+	// Expired context IDs are removed by their raw context ID.
+	expiring := []byte("octopus/../urchin")
+	_, err = subject.NotifyPut(ctx, nil, expiring, md, provider.WithTTL(50*time.Millisecond))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ad, err := subject.GetLatestAdv(ctx)
+		return err == nil && ad.IsRm
+	}, testTimeout, 10*time.Millisecond)
+	_, ad, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expiring, ad.ContextID)
+
+	// All context IDs are removed by their raw context ID.
+	head, err := subject.NotifyRemoveAll(ctx, "")
+	require.NoError(t, err)
+	var removed [][]byte
+	err = subject.WalkAdChain(ctx, head, func(c cid.Cid, ad *schema.Advertisement) error {
+		require.True(t, ad.IsRm)
+		removed = append(removed, ad.ContextID)
+		return nil
+	}, engine.WithWalkMaxDepth(len(contextIDs)))
+	require.NoError(t, err)
+	require.ElementsMatch(t, contextIDs, removed)
+	for _, contextID := range contextIDs {
+		_, err = subject.GetContextID(ctx, "", contextID)
+		require.ErrorIs(t, err, provider.ErrContextIDNotFound)
+	}
+}
+
+func TestEngine_IndexesLegacyContextIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	// Key to CID mappings written before context IDs were indexed.
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	otherID, _, _ := test.RandomIdentity()
+	entries := test.RandomCids(2)
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("map/keyCid/fish"), entries[0].Bytes()))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("map/keyCid/"+otherID.String()+"/lobster"), entries[1].Bytes()))
+
+	subject, err := engine.New(engine.WithDatastore(ds), engine.WithPublisherKind(engine.NoPublisher))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+
+	list := func(p peer.ID) []*engine.ContextIDInfo {
+		it, err := subject.ListContextIDs(ctx, p)
+		require.NoError(t, err)
+		defer it.Close()
+		var infos []*engine.ContextIDInfo
+		for {
+			info, err := it.Next()
+			if err == io.EOF {
+				return infos
+			}
+			require.NoError(t, err)
+			infos = append(infos, info)
+		}
+	}
+	infos := list("")
+	require.Len(t, infos, 1)
+	require.Equal(t, []byte("fish"), infos[0].ContextID)
+	require.Equal(t, entries[0], infos[0].Entries)
+	infos = list(otherID)
+	require.Len(t, infos, 1)
+	require.Equal(t, []byte("lobster"), infos[0].ContextID)
+	require.Equal(t, entries[1], infos[0].Entries)
+}
+
+func TestEngine_ListAndGetContextIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+	providerId, _, _ := test.RandomIdentity()
+	providerAddrs, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/1234/http")
+
+	fishAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, &peer.AddrInfo{ID: providerId, Addrs: []multiaddr.Multiaddr{providerAddrs}}, []byte("crab"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyRemove(ctx, "", []byte("lobster"))
+	require.NoError(t, err)
+
+	listAll := func(providerID peer.ID) []*engine.ContextIDInfo {
+		it, err := subject.ListContextIDs(ctx, providerID)
+		require.NoError(t, err)
+		defer it.Close()
+		var infos []*engine.ContextIDInfo
+		for {
+			info, err := it.Next()
+			if err == io.EOF {
+				return infos
+			}
+			require.NoError(t, err)
+			infos = append(infos, info)
+		}
+	}
+
+	infos := listAll("")
+	require.Len(t, infos, 1)
+	require.Equal(t, []byte("fish"), infos[0].ContextID)
+	require.Equal(t, subject.ProviderID(), infos[0].Provider)
+	require.Equal(t, fishAdCid, infos[0].AdCid)
+	require.True(t, md.Equal(infos[0].Metadata))
+	fishAd, err := subject.GetAdv(ctx, fishAdCid)
+	require.NoError(t, err)
+	require.Equal(t, fishAd.Entries.(cidlink.Link).Cid, infos[0].Entries)
+
+	infos = listAll(providerId)
+	require.Len(t, infos, 1)
+	require.Equal(t, []byte("crab"), infos[0].ContextID)
+	require.Equal(t, providerId, infos[0].Provider)
+
+	info, err := subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	require.Equal(t, fishAdCid, info.AdCid)
+
+	// Updating metadata updates the advertisement that last touched the context ID.
+	newMd := metadata.Default.New(&metadata.GraphsyncFilecoinV1{PieceCID: test.RandomCids(1)[0]})
+	newFishAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), newMd)
+	require.NoError(t, err)
+	info, err = subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	require.Equal(t, newFishAdCid, info.AdCid)
+	require.True(t, newMd.Equal(info.Metadata))
+
+	_, err = subject.GetContextID(ctx, "", []byte("lobster"))
+	require.Equal(t, provider.ErrContextIDNotFound, err)
+	_, err = subject.GetContextID(ctx, "", []byte("crab"))
+	require.Equal(t, provider.ErrContextIDNotFound, err)
+}
+
+func TestEngine_WalkAdChain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New(engine.WithChainedEntries(10))
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(25)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+	providerId, _, _ := test.RandomIdentity()
+	providerAddrs, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/1234/http")
+
+	fishAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, &peer.AddrInfo{ID: providerId, Addrs: []multiaddr.Multiaddr{providerAddrs}}, []byte("crab"), md)
+	require.NoError(t, err)
+	headCid, err := subject.NotifyRemove(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+
+	walk := func(from cid.Cid, o ...engine.WalkOption) []string {
+		var got []string
+		err := subject.WalkAdChain(ctx, from, func(c cid.Cid, ad *schema.Advertisement) error {
+			if ad.IsRm {
+				got = append(got, "-"+string(ad.ContextID))
+			} else {
+				got = append(got, string(ad.ContextID))
+			}
+			return nil
+		}, o...)
+		require.NoError(t, err)
+		return got
+	}
+
+	require.Equal(t, []string{"-fish", "crab", "lobster", "fish"}, walk(cid.Undef))
+	require.Equal(t, []string{"-fish", "crab", "lobster", "fish"}, walk(headCid))
+	require.Equal(t, []string{"-fish", "crab"}, walk(cid.Undef, engine.WithWalkMaxDepth(2)))
+	require.Equal(t, []string{"-fish", "crab", "lobster"}, walk(cid.Undef, engine.WithWalkStopAt(fishAdCid)))
+	require.Equal(t, []string{"crab"}, walk(cid.Undef, engine.WithWalkProvider(providerId)))
+	require.Equal(t, []string{"-fish", "fish"}, walk(cid.Undef, engine.WithWalkContextID([]byte("fish"))))
+	require.Equal(t, []string{"-fish"}, walk(cid.Undef, engine.WithWalkIsRm(true)))
+	require.Equal(t, []string{"lobster", "fish"}, walk(cid.Undef, engine.WithWalkIsRm(false), engine.WithWalkProvider(subject.ProviderID())))
+
+	var visited int
+	err = subject.WalkAdChain(ctx, cid.Undef, func(cid.Cid, *schema.Advertisement) error {
+		visited++
+		return engine.ErrStopWalk
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, visited)
+
+	stats, err := subject.AdChainStats(ctx, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.AdCount)
+	require.Equal(t, 1, stats.RmCount)
+	require.Equal(t, 3, stats.ContextIDCount)
+	require.Equal(t, 9, stats.EntriesChunkCount)
+	require.Equal(t, 75, stats.EntriesMultihashCount)
+	require.Positive(t, stats.EntriesSize)
+	require.Zero(t, stats.EntriesUnavailableCount)
+
+	// Advertise crab under two more providers, update the metadata of
+	// lobster, which reuses its entries, and publish an address update.
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
+	otherProviderId, _, _ := test.RandomIdentity()
+	_, err = subject.NotifyPut(ctx, &peer.AddrInfo{ID: otherProviderId, Addrs: []multiaddr.Multiaddr{providerAddrs}}, []byte("crab"), md)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), metadata.Default.New(&metadata.GraphsyncFilecoinV1{PieceCID: test.RandomCids(1)[0]}))
+	require.NoError(t, err)
+	newAddr, err := multiaddr.NewMultiaddr("/ip4/1.1.1.1/tcp/1234")
+	require.NoError(t, err)
+	_, err = subject.UpdateAddrs(ctx, []multiaddr.Multiaddr{newAddr})
+	require.NoError(t, err)
+
+	stats, err = subject.AdChainStats(ctx, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, 8, stats.AdCount)
+	require.Equal(t, 1, stats.RmCount)
+	require.Equal(t, 5, stats.ContextIDCount)
+	require.Equal(t, 15, stats.EntriesChunkCount)
+	require.Equal(t, 125, stats.EntriesMultihashCount)
+	require.Zero(t, stats.EntriesUnavailableCount)
+}
+
+func TestEngine_PublishesAddrsUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	h, err := libp2p.New()
+	require.NoError(t, err)
+	defer h.Close()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	newEngine := func(addrs ...string) *engine.Engine {
+		subject, err := engine.New(engine.WithHost(h), engine.WithDatastore(ds), engine.WithRetrievalAddrs(addrs...))
+		require.NoError(t, err)
+		require.NoError(t, subject.Start(ctx))
+		subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+			return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+		})
+		return subject
+	}
+
+	subject := newEngine("/ip4/1.1.1.1/tcp/1234")
+	putAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	require.NoError(t, subject.Shutdown())
+
+	// Restarting with the same addresses publishes nothing.
+	subject = newEngine("/ip4/1.1.1.1/tcp/1234")
+	gotLatest, _, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.Equal(t, putAdCid, gotLatest)
+	require.NoError(t, subject.Shutdown())
+
+	// Restarting with different addresses publishes an address-only ad.
+	subject = newEngine("/ip4/2.2.2.2/tcp/1234", "/ip4/3.3.3.3/tcp/1234")
+	gotLatest, ad, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, putAdCid, gotLatest)
+	require.Equal(t, putAdCid, ad.PreviousID.(cidlink.Link).Cid)
+	require.Equal(t, []string{"/ip4/2.2.2.2/tcp/1234", "/ip4/3.3.3.3/tcp/1234"}, ad.Addresses)
+	require.Equal(t, subject.ProviderID().String(), ad.Provider)
+	require.Equal(t, schema.NoEntries, ad.Entries)
+	require.Empty(t, ad.ContextID)
+	require.False(t, ad.IsRm)
+
+	_, err = subject.UpdateAddrs(ctx, []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/3.3.3.3/tcp/1234"),
+		multiaddr.StringCast("/ip4/2.2.2.2/tcp/1234"),
+	})
+	require.Equal(t, provider.ErrAlreadyAdvertised, err)
+
+	newAddr := multiaddr.StringCast("/ip4/4.4.4.4/tcp/1234")
+	updateAdCid, err := subject.UpdateAddrs(ctx, []multiaddr.Multiaddr{newAddr})
+	require.NoError(t, err)
+	ad, err = subject.GetAdv(ctx, updateAdCid)
+	require.NoError(t, err)
+	require.Equal(t, []string{newAddr.String()}, ad.Addresses)
+
+	// Subsequent advertisements use the updated addresses.
+	putAdCid, err = subject.NotifyPut(ctx, nil, []byte("lobster"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	ad, err = subject.GetAdv(ctx, putAdCid)
+	require.NoError(t, err)
+	require.Equal(t, []string{newAddr.String()}, ad.Addresses)
+	require.NoError(t, subject.Shutdown())
+}
+
+func TestEngine_UpdateAddrs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	// Writes only fail once writesLeft is set to zero.
+	fds := &failingDatastore{Batching: dssync.MutexWrap(datastore.NewMapDatastore()), writesLeft: -1}
+	subject, err := engine.New(engine.WithDatastore(fds), engine.WithRetrievalAddrs("/ip4/1.1.1.1/tcp/1234"))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// Nothing is published when nothing was advertised yet, but the
+	// addresses are used from then on.
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/2.2.2.2/tcp/1234")}
+	updateAdCid, err := subject.UpdateAddrs(ctx, addrs)
+	require.NoError(t, err)
+	require.Equal(t, cid.Undef, updateAdCid)
+	latest, _, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.Equal(t, cid.Undef, latest)
+
+	putAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, putAdCid)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/ip4/2.2.2.2/tcp/1234"}, ad.Addresses)
+
+	// Addresses that fail to be published are not used.
+	fds.writesLeft = 0
+	_, err = subject.UpdateAddrs(ctx, []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/3.3.3.3/tcp/1234")})
+	require.ErrorIs(t, err, errInjectedFailure)
+	fds.writesLeft = -1
+
+	putAdCid, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.NoError(t, err)
+	ad, err = subject.GetAdv(ctx, putAdCid)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/ip4/2.2.2.2/tcp/1234"}, ad.Addresses)
+
+	_, err = subject.UpdateAddrs(ctx, addrs)
+	require.Equal(t, provider.ErrAlreadyAdvertised, err)
+}
+
+func TestEngine_SetExtendedProviders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	contextID := []byte("test-context")
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	randomInfo := func() xproviders.Info {
+		providerID, priv, _ := test.RandomIdentity()
+		return xproviders.NewInfo(providerID, priv, []byte("thisismeta"), test.RandomMultiaddrs(2))
+	}
+	ep1 := randomInfo()
+	ep2 := randomInfo()
+
+	c, err := subject.SetExtendedProviders(ctx, contextID, true, []xproviders.Info{ep1, ep2})
+	require.NoError(t, err)
+	latest, adv, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.Equal(t, c, latest)
+	advPeerID, err := adv.VerifySignature()
+	require.NoError(t, err)
+	require.Equal(t, adv.Provider, advPeerID.String())
+	require.Equal(t, contextID, adv.ContextID)
+	require.Equal(t, schema.NoEntries, adv.Entries)
+	require.True(t, adv.ExtendedProvider.Override)
+	require.Len(t, adv.ExtendedProvider.Providers, 3)
+
+	// The same set in a different order is not advertised again.
+	_, err = subject.SetExtendedProviders(ctx, contextID, true, []xproviders.Info{ep2, ep1})
+	require.Equal(t, provider.ErrAlreadyAdvertised, err)
+
+	// Changing the override flag or the set is advertised.
+	c2, err := subject.SetExtendedProviders(ctx, contextID, false, []xproviders.Info{ep2, ep1})
+	require.NoError(t, err)
+	adv, err = subject.GetAdv(ctx, c2)
+	require.NoError(t, err)
+	require.Equal(t, c, adv.PreviousID.(cidlink.Link).Cid)
+	require.False(t, adv.ExtendedProvider.Override)
+
+	_, err = subject.SetExtendedProviders(ctx, contextID, false, []xproviders.Info{ep1})
+	require.NoError(t, err)
+
+	// Extended providers for the whole chain are tracked separately.
+	_, err = subject.SetExtendedProviders(ctx, nil, false, []xproviders.Info{ep1})
+	require.NoError(t, err)
+	_, err = subject.SetExtendedProviders(ctx, nil, false, []xproviders.Info{ep1})
+	require.Equal(t, provider.ErrAlreadyAdvertised, err)
+
+	// Override is not allowed for the whole chain.
+	_, err = subject.SetExtendedProviders(ctx, nil, true, []xproviders.Info{ep1})
+	require.Error(t, err)
+}
+
+func TestEngine_RotateKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	var listedBy []peer.ID
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		listedBy = append(listedBy, p)
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+	oldID := subject.ProviderID()
+
+	fishAdCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	fishAd, err := subject.GetAdv(ctx, fishAdCid)
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.NoError(t, err)
+
+	newID, newKey, _ := test.RandomIdentity()
+	_, err = subject.RotateKey(ctx, subject.Key())
+	require.Error(t, err)
+	headCid, err := subject.RotateKey(ctx, newKey)
+	require.NoError(t, err)
+	require.Equal(t, newID, subject.ProviderID())
+
+	var ads []*schema.Advertisement
+	err = subject.WalkAdChain(ctx, headCid, func(_ cid.Cid, ad *schema.Advertisement) error {
+		ads = append(ads, ad)
+		return nil
+	}, engine.WithWalkMaxDepth(5))
+	require.NoError(t, err)
+	require.Len(t, ads, 5)
+
+	// The first ad is attested to by both identities.
+	attestation := ads[4]
+	signerID, err := attestation.VerifySignature()
+	require.NoError(t, err)
+	require.Equal(t, oldID, signerID)
+	require.Empty(t, attestation.ContextID)
+	require.NotNil(t, attestation.ExtendedProvider)
+	var epIDs []string
+	for _, p := range attestation.ExtendedProvider.Providers {
+		epIDs = append(epIDs, p.ID)
+	}
+	require.ElementsMatch(t, []string{oldID.String(), newID.String()}, epIDs)
+
+	// Each context ID is put under the new ID then removed from the old one.
+	for _, pair := range [][]*schema.Advertisement{{ads[3], ads[2]}, {ads[1], ads[0]}} {
+		put, rm := pair[0], pair[1]
+		signerID, err = put.VerifySignature()
+		require.NoError(t, err)
+		require.Equal(t, newID, signerID)
+		require.Equal(t, newID.String(), put.Provider)
+		require.False(t, put.IsRm)
+
+		signerID, err = rm.VerifySignature()
+		require.NoError(t, err)
+		require.Equal(t, oldID, signerID)
+		require.Equal(t, oldID.String(), rm.Provider)
+		require.True(t, rm.IsRm)
+		require.Equal(t, put.ContextID, rm.ContextID)
+		if bytes.Equal(put.ContextID, []byte("fish")) {
+			require.Equal(t, fishAd.Entries, put.Entries)
+		}
+	}
+
+	// Context IDs now belong to the new ID, and new ads are signed by the new key.
+	info, err := subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	require.Equal(t, newID, info.Provider)
+	rmCid, err := subject.NotifyRemove(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	rmAd, err := subject.GetAdv(ctx, rmCid)
+	require.NoError(t, err)
+	signerID, err = rmAd.VerifySignature()
+	require.NoError(t, err)
+	require.Equal(t, newID, signerID)
+	require.Equal(t, newID.String(), rmAd.Provider)
+
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
+	require.Equal(t, newID, listedBy[len(listedBy)-1])
+}
+
+func TestEngine_RotateKeyConcurrentWithReaders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	mhs := test.RandomMultihashes(10)
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+	_, err = subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+
+	oldID := subject.ProviderID()
+	newID, newKey, _ := test.RandomIdentity()
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if id := subject.ProviderID(); id != oldID && id != newID {
+				readErr <- fmt.Errorf("unexpected provider ID %s", id)
+				return
+			}
+			preview, err := subject.PreviewNotifyPut(ctx, nil, []byte("lobster"), md)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if p := preview.Advertisement.Provider; p != oldID.String() && p != newID.String() {
+				readErr <- fmt.Errorf("unexpected advertisement provider %s", p)
+				return
+			}
+		}
+	}()
+
+	_, err = subject.RotateKey(ctx, newKey)
+	close(stop)
+	require.NoError(t, <-readErr)
+	require.NoError(t, err)
+	require.Equal(t, newID, subject.ProviderID())
+}
+
+func TestEngine_RotateKeyConcurrentWithPublishes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	// Hold the chain lock while listing the first context ID, until the
+	// other publishes and the rotation are waiting for it.
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		if string(contextID) == "fish-0" {
+			close(listing)
+			<-release
+		}
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	oldID := subject.ProviderID()
+	newID, newKey, _ := test.RandomIdentity()
+	contextIDs := make([][]byte, 20)
+	putErrs := make(chan error, len(contextIDs))
+	var wg sync.WaitGroup
+	for i := range contextIDs {
+		contextIDs[i] = []byte(fmt.Sprintf("fish-%d", i))
+		wg.Add(1)
+		go func(contextID []byte) {
+			defer wg.Done()
+			_, err := subject.NotifyPut(ctx, nil, contextID, md)
+			putErrs <- err
+		}(contextIDs[i])
+		if i == 0 {
+			<-listing
+		}
+	}
+	rotateErr := make(chan error, 1)
+	go func() {
+		_, err := subject.RotateKey(ctx, newKey)
+		rotateErr <- err
+	}()
+	// Give the publishes and the rotation time to wait for the chain lock;
+	// the outcome must be the same whichever order they take it in.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+	close(putErrs)
+	for err := range putErrs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-rotateErr)
+
+	// Every context ID ends up under the new peer ID, whether it was
+	// published before or after the rotation.
+	for _, contextID := range contextIDs {
+		_, err = subject.GetContextID(ctx, newID, contextID)
+		require.NoError(t, err, "context ID %s", contextID)
+		_, err = subject.GetContextID(ctx, oldID, contextID)
+		require.Equal(t, provider.ErrContextIDNotFound, err, "context ID %s", contextID)
+	}
+}
+
+func TestEngine_Subscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	subject, err := engine.New(
+		engine.WithDirectAnnounce(ts.URL),
+		engine.WithPublisherKind(engine.DataTransferPublisher),
+		engine.WithTopicName(t.Name()),
+	)
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	events, cancelSub := subject.Subscribe()
+	defer cancelSub()
+	next := func() engine.Event {
+		select {
+		case evt, ok := <-events:
+			require.True(t, ok)
+			return evt
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for event")
+			return nil
+		}
+	}
+
+	mhs := test.RandomMultihashes(42)
+	otherMhs := test.RandomMultihashes(42)
+	var useOther bool
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		if useOther {
+			return provider.SliceMultihashIterator(otherMhs), nil
+		}
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+
+	contextID := []byte("fish")
+	adCid, err := subject.NotifyPut(ctx, nil, contextID, metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, adCid)
+	require.NoError(t, err)
+	entries := ad.Entries.(cidlink.Link).Cid
+
+	require.Equal(t, engine.EntriesChunkedEvent{
+		Provider:  subject.ProviderID(),
+		ContextID: contextID,
+		Entries:   entries,
+	}, next())
+	require.Equal(t, engine.AdPublishedEvent{
+		AdCid:     adCid,
+		Provider:  subject.ProviderID(),
+		ContextID: contextID,
+	}, next())
+	var senders []string
+	for i := 0; i < 2; i++ {
+		announced, ok := next().(engine.AdAnnouncedEvent)
+		require.True(t, ok)
+		require.Equal(t, adCid, announced.AdCid)
+		require.NoError(t, announced.Err)
+		senders = append(senders, announced.Sender)
+	}
+	require.ElementsMatch(t, []string{"http:" + ts.URL + "/announce", "pubsub:" + t.Name()}, senders)
+
+	// Serving the entries emits an event per chunk served.
+	lsys := subject.LinkSystem()
+	_, err = lsys.Load(ipld.LinkContext{Ctx: ctx}, ad.Entries, schema.EntryChunkPrototype)
+	require.NoError(t, err)
+	served, ok := next().(engine.EntriesServedEvent)
+	require.True(t, ok)
+	require.Equal(t, entries, served.Cid)
+	require.NotZero(t, served.Size)
+
+	// Regenerating the entries from inconsistent multihashes is reported.
+	require.NoError(t, subject.Chunker().Clear(ctx))
+	useOther = true
+	_, err = lsys.Load(ipld.LinkContext{Ctx: ctx}, ad.Entries, schema.EntryChunkPrototype)
+	require.ErrorIs(t, err, engine.ErrEntriesLinkMismatch)
+	mismatch, ok := next().(engine.EntriesLinkMismatchEvent)
+	require.True(t, ok)
+	require.Equal(t, entries, mismatch.Want)
+	require.NotEqual(t, cid.Undef, mismatch.Got)
+	require.NotEqual(t, entries, mismatch.Got)
+
+	// Regenerating the entries from consistent multihashes is reported too.
+	useOther = false
+	_, err = lsys.Load(ipld.LinkContext{Ctx: ctx}, ad.Entries, schema.EntryChunkPrototype)
+	require.NoError(t, err)
+	require.Equal(t, engine.EntriesChunkedEvent{
+		Provider:    subject.ProviderID(),
+		ContextID:   contextID,
+		Entries:     entries,
+		Regenerated: true,
+	}, next())
+	_, ok = next().(engine.EntriesServedEvent)
+	require.True(t, ok)
+
+	// Canceling the subscription closes the channel.
+	cancelSub()
+	_, ok = <-events
+	require.False(t, ok)
+}
+
+func TestEngine_RoutesMultihashListers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New()
+	require.NoError(t, err)
+	err = subject.Start(ctx)
+	require.NoError(t, err)
+	defer subject.Shutdown()
+
+	var called []string
+	listerNamed := func(name string) provider.MultihashLister {
+		return func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+			called = append(called, name)
+			return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+		}
+	}
+	otherID, _, _ := test.RandomIdentity()
+	other := &peer.AddrInfo{ID: otherID, Addrs: test.RandomMultiaddrs(1)}
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// No lister matches.
+	subject.RegisterMultihashListerFor(listerNamed("other"), otherID, nil)
+	_, err = subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.ErrorIs(t, err, provider.ErrNoMultihashLister)
+	require.Empty(t, called)
+
+	subject.RegisterMultihashLister(listerNamed("default"))
+	subject.RegisterMultihashListerFor(listerNamed("car"), "", []byte("car/"))
+	subject.RegisterMultihashListerFor(listerNamed("car-v2"), "", []byte("car/v2/"))
+	subject.RegisterMultihashListerFor(listerNamed("other-car"), otherID, []byte("car/"))
+
+	for _, tc := range []struct {
+		provider  *peer.AddrInfo
+		contextID string
+		want      string
+	}{
+		{nil, "fish", "default"},
+		{nil, "car/1", "car"},
+		{nil, "car/v2/1", "car-v2"},
+		{other, "fish", "other"},
+		{other, "car/v2/2", "other-car"},
+	} {
+		called = nil
+		_, err = subject.NotifyPut(ctx, tc.provider, []byte(tc.contextID), md)
+		require.NoError(t, err)
+		require.Equal(t, []string{tc.want}, called, tc.contextID)
+	}
+
+	// Registering for the same provider and prefix replaces the lister.
+	subject.RegisterMultihashListerFor(listerNamed("car-replaced"), "", []byte("car/"))
+	called = nil
+	_, err = subject.NotifyPut(ctx, nil, []byte("car/3"), md)
+	require.NoError(t, err)
+	require.Equal(t, []string{"car-replaced"}, called)
+}
+
+func TestEngine_RetriesFailedAnnounces(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	var lk sync.Mutex
+	failing := true
+	var announced []cid.Cid
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		lk.Lock()
+		defer lk.Unlock()
+		if failing {
+			http.Error(w, "indexer unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var msg message.Message
+		if err := msg.UnmarshalCBOR(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		announced = append(announced, msg.Cid)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	setFailing := func(f bool) {
+		lk.Lock()
+		defer lk.Unlock()
+		failing = f
+	}
+	getAnnounced := func() []cid.Cid {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]cid.Cid{}, announced...)
+	}
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	newEngine := func() *engine.Engine {
+		subject, err := engine.New(
+			engine.WithDatastore(ds),
+			engine.WithDirectAnnounce(ts.URL),
+			engine.WithPublisherKind(engine.DataTransferPublisher),
+			engine.WithTopicName(t.Name()),
+			engine.WithAnnounceRetryBackoff(10*time.Millisecond, 50*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, subject.Start(ctx))
+		subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+			return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+		})
+		return subject
+	}
+	httpStatus := func(subject *engine.Engine) engine.AnnounceStatus {
+		for _, status := range subject.AnnounceStatus() {
+			if status.Target == "http:"+ts.URL+"/announce" {
+				return status
+			}
+		}
+		require.FailNow(t, "no status for announce URL")
+		return engine.AnnounceStatus{}
+	}
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	subject := newEngine()
+	require.Len(t, subject.AnnounceStatus(), 2)
+
+	// A failed announce is recorded and retried until it succeeds.
+	adCid1, err := subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	require.Equal(t, adCid1, httpStatus(subject).Pending)
+	require.Eventually(t, func() bool {
+		return httpStatus(subject).LastError != ""
+	}, testTimeout, 10*time.Millisecond)
+	status := httpStatus(subject)
+	require.Equal(t, adCid1, status.Pending)
+	require.False(t, status.LastErrorTime.IsZero())
+
+	setFailing(false)
+	require.Eventually(t, func() bool {
+		status := httpStatus(subject)
+		return status.Pending == cid.Undef && status.LastSuccess == adCid1
+	}, testTimeout, 10*time.Millisecond)
+	require.Equal(t, []cid.Cid{adCid1}, getAnnounced())
+
+	// Pending announces are coalesced to the latest advertisement.
+	setFailing(true)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md)
+	require.NoError(t, err)
+	adCid3, err := subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
+	require.Equal(t, adCid3, httpStatus(subject).Pending)
+	setFailing(false)
+	require.Eventually(t, func() bool {
+		return httpStatus(subject).LastSuccess == adCid3
+	}, testTimeout, 10*time.Millisecond)
+	require.Equal(t, []cid.Cid{adCid1, adCid3}, getAnnounced())
+
+	// Pending announces survive restarts.
+	setFailing(true)
+	adCid4, err := subject.NotifyPut(ctx, nil, []byte("squid"), md)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		status := httpStatus(subject)
+		return status.Pending == adCid4 && status.Attempts > 0
+	}, testTimeout, 10*time.Millisecond)
+	require.NoError(t, subject.Shutdown())
+	setFailing(false)
+
+	subject = newEngine()
+	defer subject.Shutdown()
+	require.Eventually(t, func() bool {
+		return httpStatus(subject).LastSuccess == adCid4
+	}, testTimeout, 10*time.Millisecond)
+	// A send that was in flight at shutdown may still be delivered, so the
+	// pending announce may be delivered twice.
+	got := getAnnounced()
+	if len(got) == 4 {
+		require.Equal(t, adCid4, got[3])
+		got = got[:3]
+	}
+	require.Equal(t, []cid.Cid{adCid1, adCid3, adCid4}, got)
+}
+
+func TestEngine_AnnouncesInBackground(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	subject, err := engine.New(
+		engine.WithDirectAnnounce(ts.URL),
+		engine.WithPublisherKind(engine.DataTransferPublisher),
+		engine.WithTopicName(t.Name()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+	})
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// Publishing does not wait for the unresponsive announce target.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, contextID := range []string{"fish", "lobster"} {
+			if _, err := subject.NotifyPut(ctx, nil, []byte(contextID), md); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "publishing blocked on announce")
+	}
+}
+
+func TestEngine_PublishLatestReturnsAnnounceError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	var lk sync.Mutex
+	failing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		lk.Lock()
+		defer lk.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	subject, err := engine.New(
+		engine.WithDirectAnnounce(ts.URL),
+		engine.WithPublisherKind(engine.DataTransferPublisher),
+		engine.WithTopicName(t.Name()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+	})
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+
+	// The announce target that fails is reported, and retried later.
+	gotCid, err := subject.PublishLatest(ctx)
+	require.ErrorContains(t, err, ts.URL)
+	require.Equal(t, adCid, gotCid)
+	for _, s := range subject.AnnounceStatus() {
+		if strings.HasPrefix(s.Target, "http:") {
+			require.Equal(t, adCid, s.Pending)
+		}
+	}
+
+	lk.Lock()
+	failing = false
+	lk.Unlock()
+	gotCid, err = subject.PublishLatest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, adCid, gotCid)
+}
+
+func TestEngine_ReannouncesLatest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	var lk sync.Mutex
+	var announced []cid.Cid
+	var announcedAt []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var msg message.Message
+		if err := msg.UnmarshalCBOR(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lk.Lock()
+		defer lk.Unlock()
+		announced = append(announced, msg.Cid)
+		announcedAt = append(announcedAt, time.Now())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	interval := 200 * time.Millisecond
+	subject, err := engine.New(
+		engine.WithDirectAnnounce(ts.URL),
+		engine.WithPublisherKind(engine.DataTransferPublisher),
+		engine.WithTopicName(t.Name()),
+		engine.WithReannounceInterval(interval),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+	})
+
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(announced) >= 3
+	}, testTimeout, 10*time.Millisecond)
+
+	lk.Lock()
+	defer lk.Unlock()
+	for i, c := range announced {
+		require.Equal(t, adCid, c)
+		if i > 0 {
+			// Re-announcing is skipped while the head was announced recently.
+			require.GreaterOrEqual(t, announcedAt[i].Sub(announcedAt[i-1]), interval*9/10)
+		}
+	}
+}
+
+func TestEngine_PublishesWithMultiplePublisherKinds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	msgs := make(chan message.Message, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var msg message.Message
+		if err := msg.UnmarshalCBOR(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case msgs <- msg:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	subHost, err := libp2p.New()
+	require.NoError(t, err)
+	pubHost, err := libp2p.New()
+	require.NoError(t, err)
+
+	subject, err := engine.New(
+		engine.WithHost(pubHost),
+		engine.WithPublisherKind(engine.DataTransferPublisher, engine.HttpPublisher, engine.DataTransferPublisher),
+		engine.WithHttpPublisherListenAddr("127.0.0.1:0"),
+		engine.WithDirectAnnounce(ts.URL),
+		engine.WithTopicName(t.Name()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+	})
+
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+
+	// The announce message carries the addresses of both publishers.
+	var msg message.Message
+	select {
+	case msg = <-msgs:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for announce")
+	}
+	require.Equal(t, adCid, msg.Cid)
+	addrs, err := msg.GetAddrs()
+	require.NoError(t, err)
+	var httpAddr multiaddr.Multiaddr
+	var p2pAddrCount int
+	for _, addr := range addrs {
+		addr = addr.Decapsulate(multiaddr.StringCast("/p2p/" + pubHost.ID().String()))
+		if _, err := addr.ValueForProtocol(multiaddr.P_HTTP); err == nil {
+			httpAddr = addr
+		} else {
+			p2pAddrCount++
+		}
+	}
+	require.NotNil(t, httpAddr)
+	require.NotZero(t, p2pAddrCount)
+
+	// Both publishers serve the same root.
+	require.NoError(t, subHost.Connect(ctx, peer.AddrInfo{ID: pubHost.ID(), Addrs: pubHost.Addrs()}))
+	gotRootCid, err := head.QueryRootCid(ctx, subHost, t.Name(), pubHost.ID())
+	require.NoError(t, err)
+	require.Equal(t, adCid, gotRootCid)
+
+	httpSync := httpsync.NewSync(cidlink.DefaultLinkSystem(), http.DefaultClient, nil)
+	defer httpSync.Close()
+	syncer, err := httpSync.NewSyncer(pubHost.ID(), []multiaddr.Multiaddr{httpAddr}, nil)
+	require.NoError(t, err)
+	gotRootCid, err = syncer.GetHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, adCid, gotRootCid)
+}
+
+func TestEngine_HttpPublisherEnforcesSyncPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	allowedID, allowedKey, _ := test.RandomIdentity()
+	deniedID, deniedKey, _ := test.RandomIdentity()
+	syncPolicy, err := policy.New(false, []string{allowedID.String()})
+	require.NoError(t, err)
+
+	subject, err := engine.New(
+		engine.WithPublisherKind(engine.HttpPublisher),
+		engine.WithHttpPublisherListenAddr("127.0.0.1:0"),
+		engine.WithSyncPolicy(syncPolicy),
+		engine.WithHttpPublisherBearerToken("allowed-token", allowedID),
+		engine.WithHttpPublisherBearerToken("denied-token", deniedID),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(1)), nil
+	})
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+
+	pubAddrs := subject.PublisherAddrs()
+	require.Len(t, pubAddrs, 1)
+	pubURL, err := maurl.ToURL(pubAddrs[0])
+	require.NoError(t, err)
+
+	get := func(path string, auth func(*http.Request)) int {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pubURL.String()+path, nil)
+		require.NoError(t, err)
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	noAuth := func(*http.Request) {}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	signed := func(key crypto.PrivKey) func(*http.Request) {
+		return func(req *http.Request) {
+			require.NoError(t, engine.SignHttpSyncRequest(req, key))
+		}
+	}
+
+	// Anonymous requests are denied since the policy denies by default.
+	require.Equal(t, http.StatusForbidden, get("/head", noAuth))
+	require.Equal(t, http.StatusForbidden, get("/"+adCid.String(), noAuth))
+
+	// Unknown tokens and invalid signatures are rejected.
+	require.Equal(t, http.StatusUnauthorized, get("/head", bearer("unknown-token")))
+	require.Equal(t, http.StatusUnauthorized, get("/head", func(req *http.Request) {
+		require.NoError(t, engine.SignHttpSyncRequest(req, allowedKey))
+		// Reuse the signature for a different path.
+		req.URL.Path = "/" + adCid.String()
+	}))
+	require.Equal(t, http.StatusUnauthorized, get("/head", func(req *http.Request) {
+		require.NoError(t, engine.SignHttpSyncRequest(req, allowedKey))
+		// Reuse the signature for a different host.
+		req.Host = "example.com"
+	}))
+
+	// Signed requests cannot be replayed.
+	var replayed string
+	require.Equal(t, http.StatusOK, get("/head", func(req *http.Request) {
+		require.NoError(t, engine.SignHttpSyncRequest(req, allowedKey))
+		replayed = req.Header.Get("Authorization")
+	}))
+	require.Equal(t, http.StatusUnauthorized, get("/head", func(req *http.Request) {
+		req.Header.Set("Authorization", replayed)
+	}))
+
+	// Peers are allowed or denied by the policy.
+	require.Equal(t, http.StatusForbidden, get("/head", bearer("denied-token")))
+	require.Equal(t, http.StatusForbidden, get("/head", signed(deniedKey)))
+	require.Equal(t, http.StatusOK, get("/head", bearer("allowed-token")))
+	require.Equal(t, http.StatusOK, get("/head", signed(allowedKey)))
+	require.Equal(t, http.StatusOK, get("/"+adCid.String(), signed(allowedKey)))
+
+	// Policy changes take effect straight away.
+	syncPolicy.Allow(deniedID)
+	require.Equal(t, http.StatusOK, get("/head", signed(deniedKey)))
+
+	// Anonymous requests are denied while the policy has exceptions, even if
+	// it allows peers by default, since a blocked peer could leave out its
+	// credentials.
+	syncPolicy.Copy(mustNewPolicy(t, true, deniedID.String()))
+	require.Equal(t, http.StatusForbidden, get("/head", signed(deniedKey)))
+	require.Equal(t, http.StatusOK, get("/head", signed(allowedKey)))
+	require.Equal(t, http.StatusForbidden, get("/head", noAuth))
+	syncPolicy.Allow(deniedID)
+	require.Equal(t, http.StatusOK, get("/head", noAuth))
+	require.Equal(t, http.StatusOK, get("/"+adCid.String(), noAuth))
+}
+
+func mustNewPolicy(t *testing.T, allow bool, except ...string) *policy.Policy {
+	p, err := policy.New(allow, except)
+	require.NoError(t, err)
+	return p
+}
+
+func TestEngine_RecordsAdsPublishedMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	reader := sdkmetric.NewManualReader()
+	global.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
 
-	subject, err := engine.New()
-	require.NoError(t, err)
-	err = subject.Start(ctx)
+	subject, err := engine.New(engine.WithPublisherKind(engine.NoPublisher))
 	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
 	defer subject.Shutdown()
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(3)), nil
+	})
 
-	wantContextID := []byte("fish")
+	contextID := []byte("fish")
+	_, err = subject.NotifyPut(ctx, nil, contextID, metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, contextID, metadata.Default.New(&metadata.GraphsyncFilecoinV1{PieceCID: test.RandomCids(1)[0]}))
+	require.NoError(t, err)
+	_, err = subject.NotifyRemove(ctx, "", contextID)
+	require.NoError(t, err)
+
+	rm, err := reader.Collect(ctx)
+	require.NoError(t, err)
+	adTypes := make(map[string]int64)
+	var chunkedEntries int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "index-provider/engine/ads_published":
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					adType, _ := dp.Attributes.Value("type")
+					adTypes[adType.AsString()] += dp.Value
+				}
+			case "index-provider/chunker/chunked_entries":
+				for _, dp := range m.Data.(metricdata.Histogram).DataPoints {
+					chunkedEntries += int64(dp.Sum)
+				}
+			}
+		}
+	}
+	require.Equal(t, map[string]int64{"put": 1, "update-metadata": 1, "remove": 1}, adTypes)
+	require.Equal(t, int64(3), chunkedEntries)
+
+	// Each served entries chunk is counted once as either a hit or a miss.
+	mhs := test.RandomMultihashes(3)
 	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
-		if string(contextID) == string(wantContextID) {
-			return provider.SliceMultihashIterator(mhs), nil
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("lobster"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, adCid)
+	require.NoError(t, err)
+	require.NoError(t, subject.Chunker().Clear(ctx))
+	for i := 0; i < 2; i++ {
+		_, err = subject.LinkSystem().StorageReadOpener(ipld.LinkContext{Ctx: ctx}, ad.Entries)
+		require.NoError(t, err)
+	}
+	rm, err = reader.Collect(ctx)
+	require.NoError(t, err)
+	cacheLookups := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "index-provider/chunker/cache_hits", "index-provider/chunker/cache_misses":
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					cacheLookups[m.Name] += dp.Value
+				}
+			}
 		}
-		return nil, errors.New("not found")
+	}
+	require.Equal(t, map[string]int64{
+		"index-provider/chunker/cache_hits":   1,
+		"index-provider/chunker/cache_misses": 1,
+	}, cacheLookups)
+}
+
+func TestEngine_AuditsListerConsistency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New(
+		engine.WithPublisherKind(engine.NoPublisher),
+		engine.WithListerAudit(10*time.Millisecond, 10),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+
+	var lk sync.Mutex
+	listed := map[string][]multihash.Multihash{
+		"fish":    test.RandomMultihashes(5),
+		"lobster": test.RandomMultihashes(5),
+	}
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		return provider.SliceMultihashIterator(listed[string(contextID)]), nil
 	})
+	for contextID := range listed {
+		_, err = subject.NotifyPut(ctx, nil, []byte(contextID), metadata.Default.New(metadata.Bitswap{}))
+		require.NoError(t, err)
+	}
+	fish, err := subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
 
-	_, err = subject.NotifyPut(ctx, nil, wantContextID, metadata.Default.New(metadata.Bitswap{}))
+	// Consistent listers are not reported.
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, subject.ListerMismatches())
+
+	// Change what the lister returns for one of the context IDs.
+	lk.Lock()
+	fishMhs := listed["fish"]
+	listed["fish"] = test.RandomMultihashes(5)
+	lk.Unlock()
+	require.Eventually(t, func() bool {
+		return len(subject.ListerMismatches()) != 0
+	}, testTimeout, 10*time.Millisecond)
+	mismatches := subject.ListerMismatches()
+	require.Len(t, mismatches, 1)
+	require.Equal(t, subject.ProviderID(), mismatches[0].Provider)
+	require.Equal(t, []byte("fish"), mismatches[0].ContextID)
+	require.Equal(t, fish.Entries, mismatches[0].Want)
+	require.NotEqual(t, cid.Undef, mismatches[0].Got)
+	require.NotEqual(t, fish.Entries, mismatches[0].Got)
+
+	// The mismatch is cleared once the lister is consistent again.
+	lk.Lock()
+	listed["fish"] = fishMhs
+	lk.Unlock()
+	require.Eventually(t, func() bool {
+		return len(subject.ListerMismatches()) == 0
+	}, testTimeout, 10*time.Millisecond)
+}
+
+func TestEngine_PreviewNotifyPut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := engine.New(
+		engine.WithDatastore(ds),
+		engine.WithPublisherKind(engine.NoPublisher),
+		engine.WithChainedEntries(10),
+	)
 	require.NoError(t, err)
-	gotRemoveAdCid, err := subject.NotifyRemove(ctx, "", wantContextID)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+	mhs := test.RandomMultihashes(25)
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), metadata.Default.New(metadata.Bitswap{}))
 	require.NoError(t, err)
 
-	ad, err := subject.GetAdv(ctx, gotRemoveAdCid)
+	dsKeys := func() []string {
+		results, err := ds.Query(ctx, query.Query{KeysOnly: true})
+		require.NoError(t, err)
+		entries, err := results.Rest()
+		require.NoError(t, err)
+		keys := make([]string, len(entries))
+		for i, e := range entries {
+			keys[i] = e.Key
+		}
+		return keys
+	}
+	keysBefore := dsKeys()
+	cachedBefore := subject.Chunker().Len()
+
+	contextID := []byte("fish")
+	md := metadata.Default.New(metadata.Bitswap{})
+	preview, err := subject.PreviewNotifyPut(ctx, nil, contextID, md)
 	require.NoError(t, err)
+	require.False(t, preview.Reused)
+	require.Equal(t, 3, preview.ChunkCount)
+	require.Equal(t, 25, preview.MultihashCount)
+	require.NotZero(t, preview.EntriesSize)
+	require.NotZero(t, preview.AdSize)
 
-	// verify that the provider is resolved to the default one when empty
-	require.Equal(t, subject.ProviderID().String(), ad.Provider)
+	// The preview leaves no trace.
+	require.ElementsMatch(t, keysBefore, dsKeys())
+	require.Equal(t, cachedBefore, subject.Chunker().Len())
+	_, err = subject.GetContextID(ctx, "", contextID)
+	require.ErrorIs(t, err, provider.ErrContextIDNotFound)
+
+	// The previewed advertisement is the one that gets published.
+	adCid, err := subject.NotifyPut(ctx, nil, contextID, md)
+	require.NoError(t, err)
+	require.Equal(t, preview.AdCid, adCid)
+	ad, err := subject.GetAdv(ctx, adCid)
+	require.NoError(t, err)
+	require.Equal(t, preview.Entries, ad.Entries.(cidlink.Link).Cid)
+
+	// Previews of advertised context IDs behave like NotifyPut.
+	_, err = subject.PreviewNotifyPut(ctx, nil, contextID, md)
+	require.ErrorIs(t, err, provider.ErrAlreadyAdvertised)
+	preview, err = subject.PreviewNotifyPut(ctx, nil, contextID, metadata.Default.New(&metadata.GraphsyncFilecoinV1{PieceCID: test.RandomCids(1)[0]}))
+	require.NoError(t, err)
+	require.True(t, preview.Reused)
+	require.Equal(t, ad.Entries.(cidlink.Link).Cid, preview.Entries)
 }
 
-func TestEngine_NotifyRemoveWithCustomProvider(t *testing.T) {
+func TestEngine_ExpiresContextIDs(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	t.Cleanup(cancel)
 
-	mhs := test.RandomMultihashes(42)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	newEngine := func(sweepInterval time.Duration) *engine.Engine {
+		subject, err := engine.New(
+			engine.WithDatastore(ds),
+			engine.WithPublisherKind(engine.NoPublisher),
+			engine.WithExpirySweepInterval(sweepInterval),
+		)
+		require.NoError(t, err)
+		require.NoError(t, subject.Start(ctx))
+		subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+			return provider.SliceMultihashIterator(test.RandomMultihashes(5)), nil
+		})
+		return subject
+	}
+	md := metadata.Default.New(metadata.Bitswap{})
 
-	subject, err := engine.New()
+	// Start with sweeping disabled, so that expiries are only acted upon
+	// after a restart.
+	subject := newEngine(0)
+	_, err := subject.NotifyPut(ctx, nil, []byte("fish"), md, provider.WithTTL(-time.Second))
+	require.Error(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("fish"), md, provider.WithTTL(100*time.Millisecond))
 	require.NoError(t, err)
-	err = subject.Start(ctx)
+	_, err = subject.NotifyPut(ctx, nil, []byte("lobster"), md, provider.WithTTL(100*time.Millisecond))
+	require.NoError(t, err)
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
+
+	info, err := subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	require.False(t, info.Expiry.IsZero())
+	info, err = subject.GetContextID(ctx, "", []byte("crab"))
 	require.NoError(t, err)
+	require.True(t, info.Expiry.IsZero())
+
+	require.ErrorIs(t, subject.ExtendTTL(ctx, "", []byte("unknown"), time.Hour), provider.ErrContextIDNotFound)
+	require.NoError(t, subject.ExtendTTL(ctx, "", []byte("lobster"), time.Hour))
+	require.NoError(t, subject.ExtendTTL(ctx, "", []byte("crab"), time.Hour))
+	require.NoError(t, subject.ClearTTL(ctx, "", []byte("crab")))
+	require.NoError(t, subject.Shutdown())
+
+	// Expiries survive restarts, and expired context IDs are removed right
+	// away once started.
+	time.Sleep(150 * time.Millisecond)
+	subject = newEngine(time.Hour)
 	defer subject.Shutdown()
+	require.Eventually(t, func() bool {
+		_, err := subject.GetContextID(ctx, "", []byte("fish"))
+		return errors.Is(err, provider.ErrContextIDNotFound)
+	}, testTimeout, 10*time.Millisecond)
 
-	wantContextID := []byte("fish")
+	_, ad, err := subject.GetLatestAdv(ctx)
+	require.NoError(t, err)
+	require.True(t, ad.IsRm)
+	require.Equal(t, []byte("fish"), ad.ContextID)
+
+	info, err = subject.GetContextID(ctx, "", []byte("lobster"))
+	require.NoError(t, err)
+	require.True(t, info.Expiry.After(time.Now().Add(time.Minute)))
+	info, err = subject.GetContextID(ctx, "", []byte("crab"))
+	require.NoError(t, err)
+	require.True(t, info.Expiry.IsZero())
+
+	// Re-putting a removed context ID does not carry over its old expiry.
+	_, err = subject.NotifyPut(ctx, nil, []byte("fish"), md)
+	require.NoError(t, err)
+	info, err = subject.GetContextID(ctx, "", []byte("fish"))
+	require.NoError(t, err)
+	require.True(t, info.Expiry.IsZero())
+}
+
+func TestEngine_NotifyPutSetsExpiryOfAdvertisedContextID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New(
+		engine.WithPublisherKind(engine.NoPublisher),
+		engine.WithExpirySweepInterval(10*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
 	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
-		if string(contextID) == string(wantContextID) {
-			return provider.SliceMultihashIterator(mhs), nil
-		}
-		return nil, errors.New("not found")
+		return provider.SliceMultihashIterator(test.RandomMultihashes(5)), nil
 	})
+	md := metadata.Default.New(metadata.Bitswap{})
 
-	providerId, _, _ := test.RandomIdentity()
-	providerAddrs, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/1234/http")
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md)
+	require.NoError(t, err)
 
-	_, err = subject.NotifyPut(ctx, &peer.AddrInfo{ID: providerId, Addrs: []multiaddr.Multiaddr{providerAddrs}}, wantContextID, metadata.Default.New(metadata.Bitswap{}))
+	// There is no change to advertise, but the expiry is set all the same,
+	// and the sweeper is started by it.
+	_, err = subject.NotifyPut(ctx, nil, []byte("crab"), md, provider.WithTTL(100*time.Millisecond))
+	require.ErrorIs(t, err, provider.ErrAlreadyAdvertised)
+	info, err := subject.GetContextID(ctx, "", []byte("crab"))
 	require.NoError(t, err)
-	gotRemoveAdCid, err := subject.NotifyRemove(ctx, providerId, wantContextID)
+	require.False(t, info.Expiry.IsZero())
+	require.Eventually(t, func() bool {
+		_, err := subject.GetContextID(ctx, "", []byte("crab"))
+		return errors.Is(err, provider.ErrContextIDNotFound)
+	}, testTimeout, 10*time.Millisecond)
+}
+
+func TestEngine_NotifyPutAsync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	newEngine := func() *engine.Engine {
+		subject, err := engine.New(
+			engine.WithDatastore(ds),
+			engine.WithPublisherKind(engine.NoPublisher),
+			engine.WithAsyncPublishWorkers(2),
+		)
+		require.NoError(t, err)
+		require.NoError(t, subject.Start(ctx))
+		return subject
+	}
+	lister := func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	}
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	// Publishes fail if no lister is registered, the same way as NotifyPut.
+	subject := newEngine()
+	noLister, err := subject.NotifyPutAsync(ctx, nil, []byte("no-lister"), md)
 	require.NoError(t, err)
+	_, err = noLister.Wait(ctx)
+	require.ErrorIs(t, err, provider.ErrNoMultihashLister)
 
-	ad, err := subject.GetAdv(ctx, gotRemoveAdCid)
+	// Publishes interrupted by a shutdown resume after a restart, and wait for
+	// their lister to be registered.
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	restored, err := subject.NotifyPutAsync(ctx, nil, []byte("restored"), md)
 	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return subject.PublishQueueStatus().Running == 1
+	}, testTimeout, 10*time.Millisecond)
+	require.NoError(t, subject.Shutdown())
+	_, err = restored.Wait(ctx)
+	require.Error(t, err)
+	require.Equal(t, engine.PublishFailed, restored.Status().State)
+
+	subject = newEngine()
+	defer subject.Shutdown()
+	require.Eventually(t, func() bool {
+		return subject.ParkedPublishes() == 1
+	}, testTimeout, 10*time.Millisecond)
+	task, err := subject.GetPublishTask(restored.ID)
+	require.NoError(t, err)
+	require.Equal(t, engine.PublishQueued, task.Status().State)
+	require.Equal(t, engine.PublishQueueStatus{Queued: 1, Workers: 2}, subject.PublishQueueStatus())
+	subject.RegisterMultihashLister(lister)
+	adCid, err := task.Wait(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, cid.Undef, adCid)
 
-	require.Equal(t, providerId.String(), ad.Provider)
+	var tasks []*engine.PublishTask
+	for i := 0; i < 5; i++ {
+		task, err := subject.NotifyPutAsync(ctx, nil, []byte(fmt.Sprintf("fish-%d", i)), md)
+		require.NoError(t, err)
+		tasks = append(tasks, task)
+	}
+	for i, task := range tasks {
+		adCid, err := task.Wait(ctx)
+		require.NoError(t, err)
+		status := task.Status()
+		require.Equal(t, engine.PublishDone, status.State)
+		require.Equal(t, adCid, status.AdCid)
+
+		polled, err := subject.GetPublishTask(task.ID)
+		require.NoError(t, err)
+		require.Equal(t, status, polled.Status())
+
+		info, err := subject.GetContextID(ctx, "", []byte(fmt.Sprintf("fish-%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, adCid, info.AdCid)
+	}
+	require.Equal(t, engine.PublishQueueStatus{Workers: 2}, subject.PublishQueueStatus())
+
+	// Failures are reported via the task.
+	task, err = subject.NotifyPutAsync(ctx, nil, []byte("fish-0"), md)
+	require.NoError(t, err)
+	_, err = task.Wait(ctx)
+	require.ErrorIs(t, err, provider.ErrAlreadyAdvertised)
+	require.Equal(t, engine.PublishFailed, task.Status().State)
+
+	_, err = subject.GetPublishTask("unknown")
+	require.ErrorIs(t, err, engine.ErrPublishTaskNotFound)
+}
+
+func TestEngine_NotifyUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	subject, err := engine.New(
+		engine.WithDatastore(ds),
+		engine.WithPublisherKind(engine.NoPublisher),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+
+	var lk sync.Mutex
+	mhs := test.RandomMultihashes(10)
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+	contextID := []byte("fish")
+	md := metadata.Default.New(metadata.Bitswap{})
+
+	_, err = subject.NotifyUpdate(ctx, nil, contextID, md)
+	require.ErrorIs(t, err, provider.ErrContextIDNotFound)
+	putCid, err := subject.NotifyPut(ctx, nil, contextID, md)
+	require.NoError(t, err)
+	_, err = subject.NotifyUpdate(ctx, nil, contextID, md)
+	require.ErrorIs(t, err, provider.ErrAlreadyAdvertised)
+	before, err := subject.GetContextID(ctx, "", contextID)
+	require.NoError(t, err)
+
+	// Changed multihashes are advertised in a single advertisement that
+	// replaces the previous one.
+	lk.Lock()
+	mhs = test.RandomMultihashes(10)
+	lk.Unlock()
+	_, err = subject.NotifyPut(ctx, nil, contextID, md)
+	require.ErrorIs(t, err, provider.ErrAlreadyAdvertised)
+	updateCid, err := subject.NotifyUpdate(ctx, nil, contextID, md)
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, updateCid)
+	require.NoError(t, err)
+	require.False(t, ad.IsRm)
+	require.Equal(t, contextID, ad.ContextID)
+	require.Equal(t, putCid, ad.PreviousID.(cidlink.Link).Cid)
+	require.NotEqual(t, before.Entries, ad.Entries.(cidlink.Link).Cid)
+
+	after, err := subject.GetContextID(ctx, "", contextID)
+	require.NoError(t, err)
+	require.Equal(t, ad.Entries.(cidlink.Link).Cid, after.Entries)
+	require.Equal(t, updateCid, after.AdCid)
+
+	// The previous entries no longer map to the context ID.
+	has, err := ds.Has(ctx, datastore.NewKey("map/cidProvAndKey/"+before.Entries.String()))
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = ds.Has(ctx, datastore.NewKey("map/cidProvAndKey/"+after.Entries.String()))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// Changed metadata alone is advertised too.
+	updateCid, err = subject.NotifyUpdate(ctx, nil, contextID, metadata.Default.New(&metadata.GraphsyncFilecoinV1{PieceCID: test.RandomCids(1)[0]}))
+	require.NoError(t, err)
+	ad, err = subject.GetAdv(ctx, updateCid)
+	require.NoError(t, err)
+	require.Equal(t, after.Entries, ad.Entries.(cidlink.Link).Cid)
+}
+
+func TestEngine_RecoversInterruptedPublish(t *testing.T) {
+	mhs := test.RandomMultihashes(42)
+	lister := func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(mhs), nil
+	}
+	md := metadata.Default.New(metadata.Bitswap{})
+	contextID := []byte("fish")
+
+	h, err := libp2p.New()
+	require.NoError(t, err)
+	defer h.Close()
+
+	newEngine := func(t *testing.T, ctx context.Context, ds datastore.Batching) *engine.Engine {
+		subject, err := engine.New(engine.WithHost(h), engine.WithDatastore(ds))
+		require.NoError(t, err)
+		require.NoError(t, subject.Start(ctx))
+		subject.RegisterMultihashLister(lister)
+		return subject
+	}
+
+	for _, isRm := range []bool{false, true} {
+		// Fail every write from the given step onwards, until the publish
+		// goes through without any injected failure.
+		for step := 0; ; step++ {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			t.Cleanup(cancel)
+
+			ds := dssync.MutexWrap(datastore.NewMapDatastore())
+			if isRm {
+				subject := newEngine(t, ctx, ds)
+				_, err = subject.NotifyPut(ctx, nil, contextID, md)
+				require.NoError(t, err)
+				require.NoError(t, subject.Shutdown())
+			}
+
+			fds := &failingDatastore{Batching: ds, writesLeft: step}
+			subject := newEngine(t, ctx, fds)
+			var publishErr error
+			if isRm {
+				_, publishErr = subject.NotifyRemove(ctx, "", contextID)
+			} else {
+				_, publishErr = subject.NotifyPut(ctx, nil, contextID, md)
+			}
+			injected := fds.writesLeft == 0
+			if injected && publishErr != nil {
+				require.ErrorIs(t, publishErr, errInjectedFailure)
+			}
+			_ = subject.Shutdown()
+
+			// Restart on the same datastore, as if after a crash, and check
+			// that the publish either happened fully or not at all.
+			subject = newEngine(t, ctx, ds)
+			has, err := ds.Has(ctx, datastore.NewKey("sync/pending/"))
+			require.NoError(t, err)
+			require.False(t, has, "step %d: pending publish must be recovered on start", step)
+
+			_, ad, err := subject.GetLatestAdv(ctx)
+			require.NoError(t, err)
+			published := ad != nil && ad.IsRm == isRm
+			if published {
+				require.Equal(t, contextID, ad.ContextID)
+			}
+			// A publish that returned an error must have been rolled back.
+			require.Equal(t, publishErr == nil, published, "step %d: %v", step, publishErr)
+
+			switch {
+			case isRm && published:
+				_, err = subject.NotifyRemove(ctx, "", contextID)
+				require.Equal(t, provider.ErrContextIDNotFound, err, "step %d", step)
+			case isRm:
+				_, err = subject.NotifyPut(ctx, nil, contextID, md)
+				require.Equal(t, provider.ErrAlreadyAdvertised, err, "step %d", step)
+			case published:
+				_, err = subject.NotifyPut(ctx, nil, contextID, md)
+				require.Equal(t, provider.ErrAlreadyAdvertised, err, "step %d", step)
+			default:
+				_, err = subject.NotifyRemove(ctx, "", contextID)
+				require.Equal(t, provider.ErrContextIDNotFound, err, "step %d", step)
+			}
+			require.NoError(t, subject.Shutdown())
+
+			if !injected {
+				break
+			}
+		}
+	}
+}
+
+var errInjectedFailure = errors.New("injected failure")
+
+// failingDatastore fails every write to keys outside the entries cache once
+// the given number of writes have succeeded, simulating a crash.
+type failingDatastore struct {
+	datastore.Batching
+	writesLeft int
+}
+
+func (f *failingDatastore) shouldFail(key datastore.Key) bool {
+	if strings.HasPrefix(key.String(), "/cache/") {
+		return false
+	}
+	if f.writesLeft == 0 {
+		return true
+	}
+	f.writesLeft--
+	return false
+}
+
+func (f *failingDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if f.shouldFail(key) {
+		return errInjectedFailure
+	}
+	return f.Batching.Put(ctx, key, value)
+}
+
+func (f *failingDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	if f.shouldFail(key) {
+		return errInjectedFailure
+	}
+	return f.Batching.Delete(ctx, key)
+}
+
+func (f *failingDatastore) Batch(_ context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(f), nil
 }
 
 func TestEngine_ProducesSingleChainForMultipleProviders(t *testing.T) {
@@ -698,3 +2769,51 @@ func requireEqualDagsyncMessage(t *testing.T, want, got message.Message) {
 	require.NoError(t, err)
 	require.ElementsMatch(t, wantAddrs, gotAddrs)
 }
+
+func TestEngine_MultihashFilters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	subject, err := engine.New(
+		engine.WithChainedEntries(100),
+		engine.WithMultihashFilters(mhfilter.ValidateEncoding(), mhfilter.DropIdentity(), mhfilter.Dedupe()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(ctx))
+	defer subject.Shutdown()
+
+	wantMhs := test.RandomMultihashes(5)
+	identityMh, err := multihash.Sum([]byte("fish"), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+	mhs := append([]multihash.Multihash{identityMh, wantMhs[1], multihash.Multihash("malformed")}, wantMhs...)
+	subject.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(mhs), nil
+	})
+
+	adCid, err := subject.NotifyPut(ctx, nil, []byte("fish"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	ad, err := subject.GetAdv(ctx, adCid)
+	require.NoError(t, err)
+	n, err := subject.LinkSystem().Load(ipld.LinkContext{Ctx: ctx}, ad.Entries, schema.EntryChunkPrototype)
+	require.NoError(t, err)
+	chunk, err := schema.UnwrapEntryChunk(n)
+	require.NoError(t, err)
+	require.Equal(t, []multihash.Multihash{wantMhs[1], wantMhs[0], wantMhs[2], wantMhs[3], wantMhs[4]}, chunk.Entries)
+
+	wantStats := []mhfilter.Stats{
+		{Name: "validate-encoding", Checked: 8, Dropped: 1},
+		{Name: "drop-identity", Checked: 7, Dropped: 1},
+		{Name: "dedupe", Checked: 6, Dropped: 1},
+	}
+	require.Equal(t, wantStats, subject.MultihashFilterStats())
+
+	// Previewing and regenerating entries filter the multihashes the same way,
+	// but only publishing counts them.
+	preview, err := subject.PreviewNotifyPut(ctx, nil, []byte("lobster"), metadata.Default.New(metadata.Bitswap{}))
+	require.NoError(t, err)
+	require.Equal(t, ad.Entries.(cidlink.Link).Cid, preview.Entries)
+	require.NoError(t, subject.Chunker().Clear(ctx))
+	_, err = subject.LinkSystem().Load(ipld.LinkContext{Ctx: ctx}, ad.Entries, schema.EntryChunkPrototype)
+	require.NoError(t, err)
+	require.Equal(t, wantStats, subject.MultihashFilterStats())
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/announce"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/ipni/index-provider/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// eventBufferSize is the number of events buffered per subscriber before
+// events start being dropped.
+const eventBufferSize = 64
+
+// Event is an event emitted by the engine to its subscribers. It is one of:
+// AdPublishedEvent, AdAnnouncedEvent, EntriesChunkedEvent, EntriesServedEvent
+// or EntriesLinkMismatchEvent.
+//
+// See: Engine.Subscribe.
+type Event interface {
+	event()
+}
+
+// AdPublishedEvent is emitted once an advertisement is stored locally as part
+// of the advertisement chain.
+type AdPublishedEvent struct {
+	// AdCid is the CID of the published advertisement.
+	AdCid cid.Cid
+	// Provider is the ID of the provider in the advertisement.
+	Provider peer.ID
+	// ContextID is the context ID of the advertisement.
+	ContextID []byte
+	// IsRm indicates whether the advertisement is a removal advertisement.
+	IsRm bool
+}
+
+// AdAnnouncedEvent is emitted once an announcement of an advertisement is
+// sent by an announce sender, successfully or not.
+type AdAnnouncedEvent struct {
+	// AdCid is the CID of the announced advertisement.
+	AdCid cid.Cid
+	// Sender describes the announce sender, e.g. "pubsub:<topic>" or
+	// "http:<url>,<url>".
+	Sender string
+	// Err is the error returned by the sender, or nil if the announcement was
+	// sent successfully.
+	Err error
+}
+
+// EntriesChunkedEvent is emitted once the multihashes returned by the
+// provider.MultihashLister for a context ID are chunked into entries, either
+// when the context ID is first advertised or when the entries are regenerated
+// to serve an indexer.
+type EntriesChunkedEvent struct {
+	// Provider is the ID of the provider passed to the lister.
+	Provider peer.ID
+	// ContextID is the context ID passed to the lister.
+	ContextID []byte
+	// Entries is the CID of the root of the chunked entries.
+	Entries cid.Cid
+	// Regenerated indicates whether the entries were regenerated because
+	// they were no longer cached.
+	Regenerated bool
+}
+
+// EntriesServedEvent is emitted every time an entries chunk is served via the
+// engine link system, typically to an indexer syncing the advertisement
+// chain. The first chunk served for an advertisement has the CID of its
+// entries.
+type EntriesServedEvent struct {
+	// Cid is the CID of the served entries chunk.
+	Cid cid.Cid
+	// Size is the size of the encoded chunk in bytes.
+	Size int
+}
+
+// EntriesLinkMismatchEvent is emitted when the entries regenerated from the
+// multihashes returned by the provider.MultihashLister do not match the
+// entries originally advertised, in which case ErrEntriesLinkMismatch is
+// returned to the syncing indexer.
+type EntriesLinkMismatchEvent struct {
+	// Provider is the ID of the provider passed to the lister.
+	Provider peer.ID
+	// ContextID is the context ID passed to the lister.
+	ContextID []byte
+	// Want is the CID of the originally advertised entries.
+	Want cid.Cid
+	// Got is the CID of the regenerated entries, or cid.Undef if the lister
+	// returned no multihashes.
+	Got cid.Cid
+}
+
+func (AdPublishedEvent) event()         {}
+func (AdAnnouncedEvent) event()         {}
+func (EntriesChunkedEvent) event()      {}
+func (EntriesServedEvent) event()       {}
+func (EntriesLinkMismatchEvent) event() {}
+
+// subscribers fans out the events emitted by the engine to its subscribers.
+type subscribers struct {
+	lk     sync.Mutex
+	chans  map[chan Event]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel on which the events emitted by the engine are
+// delivered, along with a function to cancel the subscription. The channel is
+// closed once the subscription is canceled or the engine is shut down.
+//
+// Events are buffered per subscriber. Events are never blocked on a slow
+// subscriber; if the buffer of a subscriber is full then events are dropped
+// for that subscriber. The channel should therefore be read continuously.
+func (e *Engine) Subscribe() (<-chan Event, context.CancelFunc) {
+	ch := make(chan Event, eventBufferSize)
+
+	e.subs.lk.Lock()
+	defer e.subs.lk.Unlock()
+	if e.subs.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if e.subs.chans == nil {
+		e.subs.chans = make(map[chan Event]struct{})
+	}
+	e.subs.chans[ch] = struct{}{}
+
+	cancel := func() {
+		e.subs.lk.Lock()
+		defer e.subs.lk.Unlock()
+		if _, ok := e.subs.chans[ch]; ok {
+			delete(e.subs.chans, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// emit delivers the given event to all subscribers without blocking.
+func (e *Engine) emit(evt Event) {
+	e.subs.lk.Lock()
+	defer e.subs.lk.Unlock()
+	for ch := range e.subs.chans {
+		select {
+		case ch <- evt:
+		default:
+			log.Warnw("Dropped engine event; subscriber is not keeping up", "event", evt)
+		}
+	}
+}
+
+// closeSubscribers closes the channels of all subscribers. Subscriptions made
+// afterwards are closed immediately.
+func (e *Engine) closeSubscribers() {
+	e.subs.lk.Lock()
+	defer e.subs.lk.Unlock()
+	for ch := range e.subs.chans {
+		close(ch)
+	}
+	e.subs.chans = nil
+	e.subs.closed = true
+}
+
+// eventSender wraps an announce.Sender to emit an AdAnnouncedEvent for every
+// announcement sent.
+type eventSender struct {
+	announce.Sender
+	e    *Engine
+	kind string
+	name string
+}
+
+func (e *Engine) newEventSender(s announce.Sender, kind string, targets ...string) *eventSender {
+	return &eventSender{
+		Sender: s,
+		e:      e,
+		kind:   kind,
+		name:   kind + ":" + strings.Join(targets, ","),
+	}
+}
+
+func (s *eventSender) Send(ctx context.Context, msg message.Message) error {
+	err := s.Sender.Send(ctx, msg)
+	status := metrics.Attributes.StatusSuccess
+	if err != nil {
+		status = metrics.Attributes.StatusFailure
+	}
+	metrics.Engine.Announces.Add(ctx, 1, metrics.SenderKind(s.kind), status)
+	s.e.emit(AdAnnouncedEvent{
+		AdCid:  msg.Cid,
+		Sender: s.name,
+		Err:    err,
+	})
+	return err
+}
+
+func urlStrings(urls []*url.URL) []string {
+	s := make([]string, len(urls))
+	for i, u := range urls {
+		s[i] = u.String()
+	}
+	return s
+}
@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	keyToExpiryMapPrefix = "map/keyExp/"
+
+	// maxExpiredBatchSize is the maximum number of expired context IDs of a
+	// provider that are removed in a single batch.
+	maxExpiredBatchSize = 1024
+)
+
+var errExpiryInPast = errors.New("expiry is not in the future")
+
+// notifyExpiry returns the expiry set by the given options, if any.
+func notifyExpiry(opts []provider.NotifyOption) (time.Time, error) {
+	expiry := provider.NewNotifyOptions(opts...).Expiry
+	if !expiry.IsZero() && !expiry.After(time.Now()) {
+		return time.Time{}, errExpiryInPast
+	}
+	return expiry, nil
+}
+
+// expirySweeper periodically removes the context IDs that have expired.
+type expirySweeper struct {
+	e      *Engine
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startExpirySweeper starts the expiry sweeper unless sweeping is disabled,
+// the sweeper is already running, or the engine is shut down. It is called
+// once a context ID has an expiry, so that the datastore is not scanned for
+// expired context IDs when none expire.
+func (e *Engine) startExpirySweeper() {
+	if e.expirySweepInterval == 0 {
+		return
+	}
+	e.sweeperLk.Lock()
+	defer e.sweeperLk.Unlock()
+	if e.sweeper != nil || e.sweeperClosed {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.sweeper = &expirySweeper{
+		e:      e,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go e.sweeper.run(ctx, e.expirySweepInterval)
+}
+
+// closeExpirySweeper stops the expiry sweeper if it is running, and prevents
+// it from being started again.
+func (e *Engine) closeExpirySweeper() {
+	e.sweeperLk.Lock()
+	defer e.sweeperLk.Unlock()
+	e.sweeperClosed = true
+	if e.sweeper != nil {
+		e.sweeper.close()
+	}
+}
+
+// hasExpiries returns whether any context ID has an expiry.
+func (e *Engine) hasExpiries(ctx context.Context) (bool, error) {
+	prefix := datastore.NewKey(keyToExpiryMapPrefix).String()
+	results, err := e.ds.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	defer results.Close()
+	r, ok := results.NextSync()
+	if !ok {
+		return false, nil
+	}
+	if r.Error != nil {
+		return false, r.Error
+	}
+	return true, nil
+}
+
+func (s *expirySweeper) run(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	// Sweep right away, since context IDs may have expired while the engine
+	// was not running.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if err := s.sweep(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Errorw("Failed to remove expired context IDs", "err", err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// sweep removes the context IDs that expired at or before the given time.
+func (s *expirySweeper) sweep(ctx context.Context, now time.Time) error {
+	expired, err := s.e.expiredContextIDs(ctx, now)
+	if err != nil {
+		return err
+	}
+	for p, contextIDs := range expired {
+		for len(contextIDs) != 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			n := len(contextIDs)
+			if n > maxExpiredBatchSize {
+				n = maxExpiredBatchSize
+			}
+			if err = s.e.removeExpired(ctx, p, contextIDs[:n], now); err != nil {
+				log.Errorw("Failed to remove expired context IDs of provider", "provider", p, "err", err)
+			}
+			contextIDs = contextIDs[n:]
+		}
+	}
+	return nil
+}
+
+func (s *expirySweeper) close() {
+	s.cancel()
+	<-s.done
+}
+
+// expiredContextIDs returns the context IDs that expired at or before the
+// given time, grouped by provider.
+func (e *Engine) expiredContextIDs(ctx context.Context, now time.Time) (map[peer.ID][][]byte, error) {
+	prefix := datastore.NewKey(keyToExpiryMapPrefix).String()
+	results, err := e.ds.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, fmt.Errorf("could not query context ID expiries: %w", err)
+	}
+	defer results.Close()
+
+	expired := make(map[peer.ID][][]byte)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, fmt.Errorf("could not query context ID expiries: %w", r.Error)
+		}
+		p, contextID, expiry, err := e.decodeExpiry(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if expiry.After(now) {
+			continue
+		}
+		expired[p] = append(expired[p], contextID)
+	}
+	return expired, nil
+}
+
+// removeExpired publishes removal advertisements for the given context IDs of
+// the given provider, except the ones whose expiry was extended or cleared
+// since they were found to have expired.
+func (e *Engine) removeExpired(ctx context.Context, p peer.ID, contextIDs [][]byte, now time.Time) error {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	toRemove := make([][]byte, 0, len(contextIDs))
+	for _, contextID := range contextIDs {
+		expiry, err := e.getKeyExpiryMap(ctx, p, contextID)
+		if err != nil {
+			return fmt.Errorf("could not get expiry for provider + context id: %w", err)
+		}
+		if !expiry.IsZero() && !expiry.After(now) {
+			toRemove = append(toRemove, contextID)
+		}
+	}
+	if len(toRemove) == 0 {
+		return nil
+	}
+
+	adCid, err := e.publishAdvBatchForIndexLocked(ctx, p, nil, toRemove, metadata.Metadata{}, true)
+	var batchErr provider.BatchError
+	if errors.As(err, &batchErr) {
+		for _, cerr := range batchErr {
+			// The context ID is gone already, so only the expiry is left.
+			if errors.Is(cerr.Err, provider.ErrContextIDNotFound) {
+				if err := e.deleteKeyExpiryMap(ctx, e.ds, p, cerr.ContextID); err != nil {
+					return fmt.Errorf("failed to delete provider + context id to expiry mapping: %w", err)
+				}
+				continue
+			}
+			log.Warnw("Failed to remove expired context ID", "provider", p, "contextID", base64.StdEncoding.EncodeToString(cerr.ContextID), "err", cerr.Err)
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if adCid != cid.Undef {
+		log.Infow("Removed expired context IDs", "provider", p, "count", len(toRemove), "adCid", adCid)
+	}
+	return nil
+}
+
+// ExtendTTL sets the expiry of the given context ID, advertised for the given
+// provider, to the given duration from now. The expiry is set whether or not
+// the context ID already has one, so the TTL may be shortened as well. If the
+// context ID is not currently advertised then provider.ErrContextIDNotFound is
+// returned.
+//
+// If providerID is empty then the default configured provider will be assumed.
+//
+// See: provider.WithTTL, Engine.ClearTTL.
+func (e *Engine) ExtendTTL(ctx context.Context, providerID peer.ID, contextID []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errExpiryInPast
+	}
+	return e.updateExpiry(ctx, providerID, contextID, time.Now().Add(ttl))
+}
+
+// ClearTTL clears the expiry of the given context ID, advertised for the given
+// provider, so that it is no longer removed automatically. If the context ID
+// is not currently advertised then provider.ErrContextIDNotFound is returned.
+//
+// If providerID is empty then the default configured provider will be assumed.
+//
+// See: Engine.ExtendTTL.
+func (e *Engine) ClearTTL(ctx context.Context, providerID peer.ID, contextID []byte) error {
+	return e.updateExpiry(ctx, providerID, contextID, time.Time{})
+}
+
+// updateExpiry sets the expiry of the given context ID, or deletes it if the
+// expiry is the zero time.
+func (e *Engine) updateExpiry(ctx context.Context, providerID peer.ID, contextID []byte, expiry time.Time) error {
+	// Hold the chain lock so that the context ID is not removed meanwhile.
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	providerID, _ = e.resolveProvider(providerID, nil, true)
+
+	if _, err := e.getKeyCidMap(ctx, providerID, contextID); err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return provider.ErrContextIDNotFound
+		}
+		return fmt.Errorf("could not get entries cid by provider + context id: %w", err)
+	}
+	if expiry.IsZero() {
+		return e.deleteKeyExpiryMap(ctx, e.ds, providerID, contextID)
+	}
+	if err := e.putKeyExpiryMap(ctx, e.ds, providerID, contextID, expiry); err != nil {
+		return err
+	}
+	e.startExpirySweeper()
+	return nil
+}
+
+func (e *Engine) keyToExpiryKey(provider peer.ID, contextID []byte) datastore.Key {
+	switch provider {
+	case e.providerID():
+		return datastore.NewKey(keyToExpiryMapPrefix + string(contextID))
+	default:
+		return datastore.NewKey(keyToExpiryMapPrefix + provider.String() + "/" + string(contextID))
+	}
+}
+
+// contextIDExpiry is the value of a context ID expiry mapping. It carries the
+// raw context ID, since it cannot always be recovered from the mapping key,
+// along with the provider unless it is the default one.
+type contextIDExpiry struct {
+	Provider  []byte    `json:"p,omitempty"`
+	ContextID []byte    `json:"c"`
+	Expiry    time.Time `json:"e"`
+}
+
+func (e *Engine) putKeyExpiryMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte, expiry time.Time) error {
+	v := contextIDExpiry{ContextID: contextID, Expiry: expiry}
+	if provider != e.providerID() {
+		pB, err := provider.Marshal()
+		if err != nil {
+			return err
+		}
+		v.Provider = pB
+	}
+	b, err := json.Marshal(&v)
+	if err != nil {
+		return err
+	}
+	return w.Put(ctx, e.keyToExpiryKey(provider, contextID), b)
+}
+
+// getKeyExpiryMap returns the expiry of the given provider and context ID, or
+// the zero time if it has none.
+func (e *Engine) getKeyExpiryMap(ctx context.Context, provider peer.ID, contextID []byte) (time.Time, error) {
+	b, err := e.ds.Get(ctx, e.keyToExpiryKey(provider, contextID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	_, _, expiry, err := e.decodeExpiry(b)
+	return expiry, err
+}
+
+// decodeExpiry returns the provider, context ID and expiry of a context ID
+// expiry mapping value.
+func (e *Engine) decodeExpiry(b []byte) (peer.ID, []byte, time.Time, error) {
+	var v contextIDExpiry
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("could not decode expiry: %w", err)
+	}
+	if len(v.Provider) == 0 {
+		return e.providerID(), v.ContextID, v.Expiry, nil
+	}
+	p, err := peer.IDFromBytes(v.Provider)
+	if err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("could not decode expiry provider: %w", err)
+	}
+	return p, v.ContextID, v.Expiry, nil
+}
+
+func (e *Engine) deleteKeyExpiryMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	return w.Delete(ctx, e.keyToExpiryKey(provider, contextID))
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine/xproviders"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const keyToXProvidersMapPrefix = "map/keyXP/"
+
+// xprovidersSet is the persisted form of the extended providers most recently
+// advertised for a context ID. Private keys are never persisted.
+type xprovidersSet struct {
+	Override  bool               `json:"o,omitempty"`
+	Providers []xprovidersRecord `json:"p,omitempty"`
+}
+
+type xprovidersRecord struct {
+	ID       string   `json:"i"`
+	Addrs    []string `json:"a,omitempty"`
+	Metadata []byte   `json:"m,omitempty"`
+}
+
+// SetExtendedProviders publishes an advertisement that sets the extended
+// providers of the default provider for the given context ID. An empty
+// context ID sets the extended providers for all the context IDs of the
+// default provider, in which case override must be false.
+//
+// The advertisement is built and appended to the chain of advertisements
+// under the same lock used by Engine.NotifyPut, so it cannot race with other
+// publishes. The metadata of the advertisement is the metadata currently
+// advertised for the context ID, if any.
+//
+// The extended providers set per context ID is persisted. If override and
+// the extended providers are the same as the ones most recently set for the
+// context ID, then provider.ErrAlreadyAdvertised is returned.
+//
+// See: xproviders.AdBuilder.
+func (e *Engine) SetExtendedProviders(ctx context.Context, contextID []byte, override bool, eps []xproviders.Info) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	p := e.providerID()
+	set := newXProvidersSet(override, eps)
+	prevSet, err := e.getKeyXProvidersMap(ctx, p, contextID)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not get extended providers for provider + context id: %w", err)
+	}
+	if set.equal(prevSet) {
+		return cid.Undef, provider.ErrAlreadyAdvertised
+	}
+
+	// The advertisement requires a valid metadata; fall back on an empty one
+	// if no metadata is advertised for the context ID.
+	md := metadata.Default.New()
+	if len(contextID) != 0 {
+		prevMetadata, err := e.getKeyMetadataMap(ctx, p, contextID)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, fmt.Errorf("could not get metadata for provider + context id: %w", err)
+		}
+		if prevMetadata.Len() != 0 {
+			md = prevMetadata
+		}
+	}
+	mdBytes, err := md.MarshalBinary()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	prevAdvID, err := e.getLatestAdCid(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not get latest advertisement: %s", err)
+	}
+
+	adv, err := xproviders.NewAdBuilder(p, e.signingKey(), e.retrievalAddrs()).
+		WithContextID(contextID).
+		WithMetadata(mdBytes).
+		WithOverride(override).
+		WithExtendedProviders(eps...).
+		WithLastAdID(prevAdvID).
+		BuildAndSign()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not build extended providers advertisement: %w", err)
+	}
+
+	j := &publishJournal{}
+	if err = e.putKeyXProvidersMap(ctx, j, p, contextID, set); err != nil {
+		return cid.Undef, fmt.Errorf("failed to write provider + context id to extended providers mapping: %w", err)
+	}
+	c, err := e.publishLocal(ctx, j, *adv)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to publish advertisement locally: %w", err)
+	}
+	log.Infow("Published extended providers advertisement", "adCid", c, "count", len(set.Providers), "override", override)
+
+	e.announce(ctx, c)
+	return c, nil
+}
+
+func newXProvidersSet(override bool, eps []xproviders.Info) *xprovidersSet {
+	set := &xprovidersSet{Override: override}
+	for _, ep := range eps {
+		set.Providers = append(set.Providers, xprovidersRecord{
+			ID:       ep.ID,
+			Addrs:    ep.Addrs,
+			Metadata: ep.Metadata,
+		})
+	}
+	sort.SliceStable(set.Providers, func(i, j int) bool {
+		return set.Providers[i].ID < set.Providers[j].ID
+	})
+	return set
+}
+
+func (s *xprovidersSet) equal(other *xprovidersSet) bool {
+	if s.Override != other.Override || len(s.Providers) != len(other.Providers) {
+		return false
+	}
+	for i, p := range s.Providers {
+		o := other.Providers[i]
+		if p.ID != o.ID || !bytes.Equal(p.Metadata, o.Metadata) || len(p.Addrs) != len(o.Addrs) {
+			return false
+		}
+		for k := range p.Addrs {
+			if p.Addrs[k] != o.Addrs[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e *Engine) keyToXProvidersKey(provider peer.ID, contextID []byte) datastore.Key {
+	switch provider {
+	case e.providerID():
+		return datastore.NewKey(keyToXProvidersMapPrefix + string(contextID))
+	default:
+		return datastore.NewKey(keyToXProvidersMapPrefix + provider.String() + "/" + string(contextID))
+	}
+}
+
+func (e *Engine) putKeyXProvidersMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte, set *xprovidersSet) error {
+	b, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return w.Put(ctx, e.keyToXProvidersKey(provider, contextID), b)
+}
+
+// getKeyXProvidersMap returns the extended providers most recently set for
+// the given provider and context ID, or an empty set if none were set.
+func (e *Engine) getKeyXProvidersMap(ctx context.Context, provider peer.ID, contextID []byte) (*xprovidersSet, error) {
+	b, err := e.ds.Get(ctx, e.keyToXProvidersKey(provider, contextID))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return &xprovidersSet{}, nil
+		}
+		return nil, err
+	}
+	var set xprovidersSet
+	if err = json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func (e *Engine) deleteKeyXProvidersMap(ctx context.Context, w datastore.Write, provider peer.ID, contextID []byte) error {
+	return w.Delete(ctx, e.keyToXProvidersKey(provider, contextID))
+}
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// PeerIDAuthScheme is the HTTP authorization scheme with which a client of
+	// the HTTP publisher authenticates as a libp2p peer. The credentials are
+	// the public key of the peer, the time of the request, a random nonce and
+	// a signature, by the peer, of the time, nonce, method, host and path of
+	// the request:
+	//
+	//	Authorization: libp2p-PeerID public-key="<base64>", ts="<unix seconds>", nonce="<base64>", sig="<base64>"
+	//
+	// Credentials are only accepted once.
+	//
+	// See: SignHttpSyncRequest.
+	PeerIDAuthScheme = "libp2p-PeerID"
+	// BearerAuthScheme is the HTTP authorization scheme with which a client of
+	// the HTTP publisher presents a bearer token mapped to a peer.
+	//
+	// See: WithHttpPublisherBearerToken.
+	BearerAuthScheme = "Bearer"
+
+	// peerIDAuthDomain separates the signatures of HTTP sync requests from
+	// signatures made with the same key for other purposes.
+	peerIDAuthDomain = "ipni-http-sync"
+	// peerIDAuthMaxSkew is the maximum difference between the time at which a
+	// request is signed and the time at which it is received.
+	peerIDAuthMaxSkew = 5 * time.Minute
+	// peerIDAuthNonceSize is the size in bytes of the nonce of a request.
+	peerIDAuthNonceSize = 16
+)
+
+// errNoAuthorization is returned when an HTTP sync request carries no
+// credentials, in which case the request is made by an anonymous peer.
+var errNoAuthorization = errors.New("no authorization")
+
+// SignHttpSyncRequest sets the Authorization header of the given request to
+// authenticate it as made by the peer with the given private key, using the
+// PeerIDAuthScheme. The request must be sent within a few minutes of being
+// signed, and only once; it must be signed again to be retried.
+func SignHttpSyncRequest(req *http.Request, key crypto.PrivKey) error {
+	pubKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return fmt.Errorf("cannot marshal public key: %w", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceBytes := make([]byte, peerIDAuthNonceSize)
+	if _, err = rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	nonce := base64.StdEncoding.EncodeToString(nonceBytes)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	sig, err := key.Sign(peerIDAuthPayload(ts, nonce, req.Method, host, req.URL.Path))
+	if err != nil {
+		return fmt.Errorf("cannot sign request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s public-key=%q, ts=%q, nonce=%q, sig=%q",
+		PeerIDAuthScheme,
+		base64.StdEncoding.EncodeToString(pubKey),
+		ts,
+		nonce,
+		base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+func peerIDAuthPayload(ts, nonce, method, host, path string) []byte {
+	return []byte(strings.Join([]string{peerIDAuthDomain, ts, nonce, method, host, path}, "\n"))
+}
+
+// peerIDAuthNonces records the nonces of the PeerIDAuthScheme credentials that
+// were accepted, until the credentials are too old to be accepted anyway, so
+// that they cannot be replayed.
+type peerIDAuthNonces struct {
+	lk        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newPeerIDAuthNonces() *peerIDAuthNonces {
+	return &peerIDAuthNonces{seen: make(map[string]time.Time)}
+}
+
+// add records the given nonce of the given peer until the given time, and
+// returns false if it is already recorded.
+func (n *peerIDAuthNonces) add(p peer.ID, nonce string, until, now time.Time) bool {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if now.Sub(n.lastPrune) > time.Minute {
+		for k, kUntil := range n.seen {
+			if now.After(kUntil) {
+				delete(n.seen, k)
+			}
+		}
+		n.lastPrune = now
+	}
+	k := string(p) + "/" + nonce
+	if _, ok := n.seen[k]; ok {
+		return false
+	}
+	n.seen[k] = until
+	return true
+}
+
+// httpSyncPeer returns the peer that made the given HTTP sync request, as
+// authenticated by its Authorization header. It returns errNoAuthorization if
+// the request carries no credentials. The nonces of the accepted
+// PeerIDAuthScheme credentials are recorded in the given nonces.
+func (e *Engine) httpSyncPeer(r *http.Request, nonces *peerIDAuthNonces) (peer.ID, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", errNoAuthorization
+	}
+	scheme, creds, _ := strings.Cut(auth, " ")
+	switch {
+	case strings.EqualFold(scheme, BearerAuthScheme):
+		p, ok := e.pubHttpBearerTokens[strings.TrimSpace(creds)]
+		if !ok {
+			return "", errors.New("unknown bearer token")
+		}
+		return p, nil
+	case strings.EqualFold(scheme, PeerIDAuthScheme):
+		return verifyPeerIDAuth(creds, r.Method, r.Host, r.URL.Path, time.Now(), nonces)
+	default:
+		return "", fmt.Errorf("unsupported authorization scheme: %s", scheme)
+	}
+}
+
+// verifyPeerIDAuth verifies the credentials of the PeerIDAuthScheme, records
+// their nonce, and returns the ID of the peer that signed them. Credentials
+// whose nonce is already recorded are rejected.
+func verifyPeerIDAuth(creds, method, host, path string, now time.Time, nonces *peerIDAuthNonces) (peer.ID, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(creds, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return "", fmt.Errorf("malformed %s parameter: %s", PeerIDAuthScheme, param)
+		}
+		params[k] = strings.Trim(v, `"`)
+	}
+
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(params["public-key"])
+	if err != nil {
+		return "", fmt.Errorf("cannot decode public key: %w", err)
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(pubKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("cannot unmarshal public key: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["sig"])
+	if err != nil {
+		return "", fmt.Errorf("cannot decode signature: %w", err)
+	}
+	ts := params["ts"]
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp: %w", err)
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := now.Sub(signedAt); skew > peerIDAuthMaxSkew || skew < -peerIDAuthMaxSkew {
+		return "", errors.New("request signed too long ago or in the future")
+	}
+	nonce := params["nonce"]
+	if nonceBytes, err := base64.StdEncoding.DecodeString(nonce); err != nil || len(nonceBytes) != peerIDAuthNonceSize {
+		return "", errors.New("invalid nonce")
+	}
+	ok, err := pubKey.Verify(peerIDAuthPayload(ts, nonce, method, host, path), sig)
+	if err != nil {
+		return "", fmt.Errorf("cannot verify signature: %w", err)
+	}
+	if !ok {
+		return "", errors.New("invalid signature")
+	}
+	p, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	if !nonces.add(p, nonce, signedAt.Add(peerIDAuthMaxSkew), now) {
+		return "", errors.New("credentials already used")
+	}
+	return p, nil
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/ipni/go-libipni/dagsync/httpsync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// httpPublisher is an httpsync publisher served behind the sync access control
+// of the engine.
+type httpPublisher struct {
+	*httpsync.Publisher
+	addr   multiaddr.Multiaddr
+	server *http.Server
+}
+
+// newHttpPublisher instantiates an httpsync publisher that is served on the
+// HTTP publisher listen address, via a handler that only lets the requests of
+// peers allowed by the sync policy through.
+//
+// The httpsync publisher is an http.Handler, but also serves requests on a
+// listener of its own. That listener is closed straight away, so that the
+// publisher is only served through the handler. The publisher has no announce
+// senders, so closing it closes nothing else.
+func (e *Engine) newHttpPublisher() (*httpPublisher, error) {
+	l, err := net.Listen("tcp", e.pubHttpListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	maddr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	pub, err := httpsync.NewPublisher("127.0.0.1:0", e.lsys, e.signingKey())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err = pub.Close(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	hp := &httpPublisher{
+		Publisher: pub,
+		addr:      multiaddr.Join(maddr, multiaddr.StringCast("/http")),
+		server:    &http.Server{Handler: e.httpSyncHandler(pub)},
+	}
+	go func() {
+		if err := hp.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorw("HTTP publisher stopped serving", "err", err)
+		}
+	}()
+	return hp, nil
+}
+
+// Addrs returns the address on which the publisher is served.
+func (p *httpPublisher) Addrs() []multiaddr.Multiaddr {
+	return []multiaddr.Multiaddr{p.addr}
+}
+
+// Close stops serving the publisher, whose own listener is already closed.
+func (p *httpPublisher) Close() error {
+	return p.server.Close()
+}
+
+// httpSyncHandler wraps the given handler to only serve the HTTP sync requests
+// made by the peers allowed by the sync policy of the engine.
+//
+// Requests are made by the peer they authenticate as, either via a bearer
+// token mapped to the peer or via the PeerIDAuthScheme. Requests without
+// credentials are made by an anonymous peer, which is only allowed if the
+// policy allows every peer; otherwise a denied peer could be served by leaving
+// out its credentials. Requests with invalid or reused credentials are
+// rejected with 401, and requests by disallowed peers with 403.
+func (e *Engine) httpSyncHandler(next http.Handler) http.Handler {
+	nonces := newPeerIDAuthNonces()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerID, err := e.httpSyncPeer(r, nonces)
+		var allowed bool
+		switch {
+		case errors.Is(err, errNoAuthorization):
+			allowed = e.syncPolicy.AllowedAll()
+		case err != nil:
+			log.Infow("Rejected HTTP sync request with invalid authorization", "remote", r.RemoteAddr, "path", r.URL.Path, "err", err)
+			http.Error(w, fmt.Sprintf("invalid authorization: %s", err), http.StatusUnauthorized)
+			return
+		default:
+			allowed = e.syncPolicy.Allowed(peerID)
+		}
+		if !allowed {
+			log.Infow("Denied HTTP sync request", "peer", peerString(peerID), "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "peer is not allowed to sync", http.StatusForbidden)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		log.Debugw("Served HTTP sync request", "peer", peerString(peerID), "remote", r.RemoteAddr, "path", r.URL.Path, "status", sw.status)
+	})
+}
+
+// peerString returns the string representation of the given peer ID, or
+// "anonymous" for the empty peer ID.
+func peerString(p peer.ID) string {
+	if p == "" {
+		return "anonymous"
+	}
+	return p.String()
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
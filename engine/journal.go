@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipni/index-provider/metrics"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const pendingPublishKey = "sync/pending/"
+
+var dsPendingPublishKey = datastore.NewKey(pendingPublishKey)
+
+// publishJournal records the datastore writes that make up a single publish,
+// i.e. the provider and context ID mappings, the advertisement blocks and the
+// reference to the latest advertisement.
+//
+// The recorded writes are persisted as an intent record before they are
+// applied, along with the writes that undo them, so that a publish interrupted
+// half-way through can be rolled back by replaying the latter. See:
+// Engine.commitJournal, Engine.recoverPendingPublish.
+type publishJournal struct {
+	Ops []journalOp `json:"ops"`
+	// Undo restores the values the keys of Ops had before the publish.
+	Undo []journalOp `json:"undo,omitempty"`
+
+	// published holds the advertisements stored in the journal, to be
+	// emitted as events and counted once the journal is committed.
+	published []publishedAd
+}
+
+// publishedAd is an advertisement stored in a journal, along with its type
+// as counted by metrics.Engine.AdsPublished.
+type publishedAd struct {
+	AdPublishedEvent
+	adType attribute.KeyValue
+}
+
+type journalOp struct {
+	Key    string `json:"k"`
+	Value  []byte `json:"v,omitempty"`
+	Delete bool   `json:"d,omitempty"`
+}
+
+var _ datastore.Write = (*publishJournal)(nil)
+
+// Put records a put of the given key and value.
+func (j *publishJournal) Put(_ context.Context, key datastore.Key, value []byte) error {
+	v := make([]byte, len(value))
+	copy(v, value)
+	j.Ops = append(j.Ops, journalOp{Key: key.String(), Value: v})
+	return nil
+}
+
+// Delete records a deletion of the given key.
+func (j *publishJournal) Delete(_ context.Context, key datastore.Key) error {
+	j.Ops = append(j.Ops, journalOp{Key: key.String(), Delete: true})
+	return nil
+}
+
+// append records the writes and advertisements of the given journal after the
+// ones already recorded.
+func (j *publishJournal) append(other *publishJournal) {
+	j.Ops = append(j.Ops, other.Ops...)
+	j.published = append(j.published, other.published...)
+}
+
+// commitJournal writes the journal as an intent record, applies its writes in
+// a single datastore batch and then removes the intent record. A publish is
+// only kept once its intent record is removed: if any step fails, the writes
+// are rolled back so that a publish that returns an error does not show up in
+// the chain. If rolling back fails too, the intent record is left in place for
+// Engine.recoverPendingPublish to roll back the publish.
+//
+// The caller must hold Engine.cblk.
+func (e *Engine) commitJournal(ctx context.Context, j *publishJournal) error {
+	var err error
+	if j.Undo, err = e.undoOps(ctx, j.Ops); err != nil {
+		return err
+	}
+	intent, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("could not encode publish intent: %w", err)
+	}
+	if err = e.ds.Put(ctx, dsPendingPublishKey, intent); err != nil {
+		return fmt.Errorf("could not store publish intent: %w", err)
+	}
+	err = e.applyJournal(ctx, j.Ops)
+	if err == nil {
+		if err = e.ds.Delete(ctx, dsPendingPublishKey); err != nil {
+			err = fmt.Errorf("could not delete publish intent: %w", err)
+		}
+	}
+	if err != nil {
+		if rbErr := e.rollbackJournal(ctx, j); rbErr != nil {
+			log.Errorw("Failed to roll back publish", "err", rbErr)
+		}
+		return err
+	}
+	for _, ad := range j.published {
+		e.emit(ad.AdPublishedEvent)
+		metrics.Engine.AdsPublished.Add(ctx, 1, ad.adType)
+	}
+	return nil
+}
+
+// rollbackJournal undoes the writes of the given journal, and removes its
+// intent record.
+func (e *Engine) rollbackJournal(ctx context.Context, j *publishJournal) error {
+	if err := e.applyJournal(ctx, j.Undo); err != nil {
+		return err
+	}
+	return e.ds.Delete(ctx, dsPendingPublishKey)
+}
+
+// undoOps returns the writes that restore the current values of the keys
+// written by the given writes, in reverse order.
+func (e *Engine) undoOps(ctx context.Context, ops []journalOp) ([]journalOp, error) {
+	undo := make([]journalOp, 0, len(ops))
+	seen := make(map[string]struct{}, len(ops))
+	for i := len(ops) - 1; i >= 0; i-- {
+		key := ops[i].Key
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		value, err := e.ds.Get(ctx, datastore.NewKey(key))
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			undo = append(undo, journalOp{Key: key, Delete: true})
+		case err != nil:
+			return nil, fmt.Errorf("could not get value to restore on failure: %w", err)
+		default:
+			undo = append(undo, journalOp{Key: key, Value: value})
+		}
+	}
+	return undo, nil
+}
+
+func (e *Engine) applyJournal(ctx context.Context, ops []journalOp) error {
+	batch, err := e.ds.Batch(ctx)
+	if err != nil {
+		return fmt.Errorf("could not create datastore batch: %w", err)
+	}
+	for _, op := range ops {
+		key := datastore.NewKey(op.Key)
+		if op.Delete {
+			err = batch.Delete(ctx, key)
+		} else {
+			err = batch.Put(ctx, key, op.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("could not apply publish intent: %w", err)
+		}
+	}
+	if err = batch.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit publish intent: %w", err)
+	}
+	return nil
+}
+
+// recoverPendingPublish rolls back a publish that was interrupted after its
+// intent record was stored, by replaying the writes that undo it. Such a
+// publish was never announced, and its caller either got an error or no
+// result at all. It does nothing if there is no pending publish.
+//
+// The caller must hold Engine.cblk, unless the engine is being started.
+func (e *Engine) recoverPendingPublish(ctx context.Context) error {
+	intent, err := e.ds.Get(ctx, dsPendingPublishKey)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("could not get publish intent: %w", err)
+	}
+
+	var j publishJournal
+	if err = json.Unmarshal(intent, &j); err != nil {
+		return fmt.Errorf("could not decode publish intent: %w", err)
+	}
+	log.Warnw("Rolling back interrupted publish", "writes", len(j.Undo))
+	return e.rollbackJournal(ctx, &j)
+}
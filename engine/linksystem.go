@@ -11,7 +11,7 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipni/go-libipni/ingest/schema"
-	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/metrics"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -54,18 +54,14 @@ func (e *Engine) mkLinkSystem() ipld.LinkSystem {
 			// If this was an advertisement, then return it.
 			if isAdvertisement(n) {
 				log.Debugw("Retrieved advertisement from datastore", "cid", c, "size", len(val))
+				metrics.Engine.ReadRequests.Add(ctx, 1, metrics.Attributes.ReadTypeAdvertisement)
 				return bytes.NewBuffer(val), nil
 			}
 			log.Debugw("Retrieved non-advertisement object from datastore", "cid", c, "size", len(val))
 		}
 
 		// Not an advertisement, so this means we are receiving ingestion data.
-
-		// If no lister registered return error
-		if e.mhLister == nil {
-			log.Error("No multihash lister has been registered in engine")
-			return nil, provider.ErrNoMultihashLister
-		}
+		metrics.Engine.ReadRequests.Add(ctx, 1, metrics.Attributes.ReadTypeEntries)
 
 		log.Debugw("Checking cache for data", "cid", c)
 
@@ -85,6 +81,7 @@ func (e *Engine) mkLinkSystem() ipld.LinkSystem {
 		// The cache uses the entry chunk CID as a key that maps to the entry
 		// chunk data.
 		if b == nil {
+			metrics.Chunker.CacheMisses.Add(ctx, 1)
 			log.Infow("Entry for CID is not cached, generating chunks", "cid", c)
 			// If the link is not found, it means that the root link of the list has
 			// not been generated and we need to get the relationship between the cid
@@ -106,41 +103,68 @@ func (e *Engine) mkLinkSystem() ipld.LinkSystem {
 			if err != nil {
 				return nil, err
 			}
-			mhIter, err := e.mhLister(ctx, provider, key.ContextID)
+			mhLister, err := e.multihashLister(provider, key.ContextID, false)
+			if err != nil {
+				log.Errorw("Cannot regenerate entries", "err", err)
+				return nil, err
+			}
+			mhIter, err := mhLister(ctx, provider, key.ContextID)
 			if err != nil {
 				return nil, err
 			}
 
 			// Store the linked list entries in cache as we generate them.  We
 			// use the cache linksystem that stores entries in an in-memory
-			// datastore.
-			regeneratedLink, err := e.entriesChunker.Chunk(ctx, mhIter)
+			// datastore. Concurrent requests for the same entries, e.g. from
+			// several indexers, share a single regeneration.
+			regeneratedLink, err := e.entriesChunker.Regenerate(ctx, lnk, mhIter)
 			if err != nil {
 				log.Errorf("Error generating linked list from multihash lister: %s", err)
+				metrics.Engine.EntriesRegenerated.Add(ctx, 1, metrics.Attributes.StatusFailure)
 				return nil, err
 			}
 			if regeneratedLink == nil || !c.Equals(regeneratedLink.(cidlink.Link).Cid) {
 				log.Errorw("Regeneration of entries link from multihash iterator did not match the original link. Check that multihash iterator consistently returns the same entries for the same key.", "want", lnk, "got", regeneratedLink)
+				mismatch := EntriesLinkMismatchEvent{
+					Provider:  provider,
+					ContextID: key.ContextID,
+					Want:      c,
+				}
+				if regeneratedLink != nil {
+					mismatch.Got = regeneratedLink.(cidlink.Link).Cid
+				}
+				e.emit(mismatch)
+				metrics.Engine.EntriesRegenerated.Add(ctx, 1, metrics.Attributes.StatusFailure)
 				return nil, ErrEntriesLinkMismatch
 			}
+			metrics.Engine.EntriesRegenerated.Add(ctx, 1, metrics.Attributes.StatusSuccess)
+			e.emit(EntriesChunkedEvent{
+				Provider:    provider,
+				ContextID:   key.ContextID,
+				Entries:     c,
+				Regenerated: true,
+			})
+
+			// Get the linked list node from the regenerated entries.
+			b, err = e.entriesChunker.GetRawCachedChunk(ctx, lnk)
+			if err != nil {
+				log.Errorf("Error fetching cached list for CID (%s): %s", c, err)
+				return nil, err
+			}
 		} else {
+			metrics.Chunker.CacheHits.Add(ctx, 1)
 			log.Debugw("Found cache entry for CID", "cid", c)
 		}
 
-		// Return the linked list node.
-		val, err = e.entriesChunker.GetRawCachedChunk(ctx, lnk)
-		if err != nil {
-			log.Errorf("Error fetching cached list for CID (%s): %s", c, err)
-			return nil, err
-		}
-
 		// If no value was populated it means that nothing was found
 		// in the multiple datastores.
+		val = b
 		if len(val) == 0 {
 			log.Errorf("No object found in linksystem for CID (%s)", c)
 			return nil, datastore.ErrNotFound
 		}
 
+		e.emit(EntriesServedEvent{Cid: c, Size: len(val)})
 		return bytes.NewBuffer(val), nil
 	}
 	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
@@ -178,6 +202,20 @@ func (e *Engine) vanillaLinkSystem() ipld.LinkSystem {
 	return lsys
 }
 
+// journalLinkSystem records links into the given journal, which is written to
+// the engine datastore once committed. Loading is not supported.
+func (e *Engine) journalLinkSystem(j *publishJournal) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func(lnk ipld.Link) error {
+			c := lnk.(cidlink.Link).Cid
+			return j.Put(lctx.Ctx, datastore.NewKey(c.String()), buf.Bytes())
+		}, nil
+	}
+	return lsys
+}
+
 // decodeIPLDNode reads the content of the given reader fully as an IPLD node.
 func decodeIPLDNode(r io.Reader) (ipld.Node, error) {
 	nb := basicnode.Prototype.Any.NewBuilder()
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine/mhfilter"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var _ provider.MultihashListerRouter = (*Engine)(nil)
+
+// listerRegistry routes multihash lookups to the registered
+// provider.MultihashLister that most specifically matches a provider ID and
+// context ID, falling back on the default lister.
+type listerRegistry struct {
+	lk       sync.RWMutex
+	routes   []listerRoute
+	fallback provider.MultihashLister
+}
+
+type listerRoute struct {
+	provider peer.ID
+	prefix   []byte
+	lister   provider.MultihashLister
+}
+
+// matches checks whether the route matches the given provider and context ID.
+func (r *listerRoute) matches(p peer.ID, contextID []byte) bool {
+	if r.provider != "" && r.provider != p {
+		return false
+	}
+	return bytes.HasPrefix(contextID, r.prefix)
+}
+
+// moreSpecific checks whether the route is more specific than the other one.
+// A route keyed by provider ID is more specific than one that is not, and
+// otherwise the route with the longest context ID prefix is more specific.
+func (r *listerRoute) moreSpecific(other *listerRoute) bool {
+	if (r.provider != "") != (other.provider != "") {
+		return r.provider != ""
+	}
+	return len(r.prefix) > len(other.prefix)
+}
+
+// RegisterMultihashListerFor registers a provider.MultihashLister that is
+// used to look up the multihashes of the context IDs with the given prefix,
+// advertised for the given provider. An empty provider ID matches any
+// provider, and an empty prefix matches any context ID. Registering a lister
+// with both empty is equivalent to Engine.RegisterMultihashLister.
+//
+// When several listers match a lookup, a lister registered for the provider ID
+// is used over one that is not, and otherwise the lister registered with the
+// longest matching prefix is used. The lister registered via
+// Engine.RegisterMultihashLister is used if no other lister matches. If no
+// lister matches at all, then lookups fail with provider.ErrNoMultihashLister.
+//
+// Registering a lister for the same provider ID and prefix as a previous
+// registration replaces it.
+func (e *Engine) RegisterMultihashListerFor(mhl provider.MultihashLister, providerID peer.ID, contextIDPrefix []byte) {
+	if providerID == "" && len(contextIDPrefix) == 0 {
+		e.RegisterMultihashLister(mhl)
+		return
+	}
+	log.Debugw("Registering multihash lister in engine", "provider", providerID, "contextIDPrefix", base64.StdEncoding.EncodeToString(contextIDPrefix))
+
+	e.listers.lk.Lock()
+	e.listers.setRoute(mhl, providerID, contextIDPrefix)
+	e.listers.lk.Unlock()
+	e.listerRegistered()
+}
+
+// setRoute registers the given lister for the given provider ID and prefix,
+// replacing any lister registered for both. The lock must be held.
+func (r *listerRegistry) setRoute(mhl provider.MultihashLister, providerID peer.ID, contextIDPrefix []byte) {
+	for i := range r.routes {
+		route := &r.routes[i]
+		if route.provider == providerID && bytes.Equal(route.prefix, contextIDPrefix) {
+			route.lister = mhl
+			return
+		}
+	}
+	r.routes = append(r.routes, listerRoute{
+		provider: providerID,
+		prefix:   append([]byte{}, contextIDPrefix...),
+		lister:   mhl,
+	})
+}
+
+// multihashLister returns the registered provider.MultihashLister to use for
+// looking up the multihashes of the given provider and context ID. The
+// multihashes are filtered through the multihash filters, which only count
+// them if count is set, i.e. if the multihashes are being advertised.
+func (e *Engine) multihashLister(p peer.ID, contextID []byte, count bool) (provider.MultihashLister, error) {
+	e.listers.lk.RLock()
+	defer e.listers.lk.RUnlock()
+
+	var best *listerRoute
+	for i := range e.listers.routes {
+		r := &e.listers.routes[i]
+		if r.matches(p, contextID) && (best == nil || r.moreSpecific(best)) {
+			best = r
+		}
+	}
+	if best != nil {
+		return e.filterMultihashes(best.lister, count), nil
+	}
+	if e.listers.fallback != nil {
+		return e.filterMultihashes(e.listers.fallback, count), nil
+	}
+	return nil, fmt.Errorf("%w for provider %s and context ID %s", provider.ErrNoMultihashLister, p, base64.StdEncoding.EncodeToString(contextID))
+}
+
+// filterMultihashes wraps the given lister so that the multihashes it returns
+// are filtered through the configured multihash filters, if any, counting
+// them only if count is set.
+func (e *Engine) filterMultihashes(mhl provider.MultihashLister, count bool) provider.MultihashLister {
+	if e.mhFilter == nil {
+		return mhl
+	}
+	return func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		mhi, err := mhl(ctx, p, contextID)
+		if err != nil {
+			return nil, err
+		}
+		if !count {
+			return e.mhFilter.WrapUncounted(mhi), nil
+		}
+		return e.mhFilter.Wrap(ctx, mhi), nil
+	}
+}
+
+// MultihashFilterStats returns the counters of the multihash filters, in the
+// order in which they are applied, or nil if no filters are configured. Only
+// the multihashes listed to publish advertisements are counted, not the ones
+// listed to preview, audit or regenerate entries.
+//
+// See: WithMultihashFilters.
+func (e *Engine) MultihashFilterStats() []mhfilter.Stats {
+	if e.mhFilter == nil {
+		return nil
+	}
+	return e.mhFilter.Stats()
+}
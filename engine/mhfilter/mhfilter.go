@@ -0,0 +1,234 @@
+// Package mhfilter provides composable filters that clean up the multihashes returned by a
+// provider.MultihashIterator before they are chunked into advertisement entries, e.g. to drop
+// duplicate, identity or malformed multihashes.
+//
+// A Pipeline is made of stages, each of which is a named filter with counters of the multihashes
+// it checked and dropped. The stages are applied in order, and a multihash dropped by a stage is
+// not checked by the following stages. Because filtering changes the advertised entries, the same
+// pipeline must be used to regenerate entries that were previously advertised.
+package mhfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/metrics"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// Filter decides which multihashes of a single context ID are kept. A Filter is instantiated per
+// provider.MultihashIterator, so it may keep state across the multihashes of a context ID.
+type Filter interface {
+	// Keep returns whether the given multihash is kept.
+	Keep(mh multihash.Multihash) bool
+}
+
+// FilterFunc is a stateless Filter.
+type FilterFunc func(mh multihash.Multihash) bool
+
+// Keep calls f.
+func (f FilterFunc) Keep(mh multihash.Multihash) bool {
+	return f(mh)
+}
+
+// Stage is a named Filter of a Pipeline, along with the counters of the multihashes it checked
+// and dropped across all context IDs.
+type Stage struct {
+	name      string
+	newFilter func() Filter
+	checked   atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// Stats holds the counters of a Stage.
+type Stats struct {
+	// Name is the name of the stage.
+	Name string
+	// Checked is the number of multihashes checked by the stage.
+	Checked uint64
+	// Dropped is the number of multihashes dropped by the stage.
+	Dropped uint64
+}
+
+// NewStage instantiates a Stage with the given name that filters multihashes using a Filter
+// instantiated by newFilter per provider.MultihashIterator.
+func NewStage(name string, newFilter func() Filter) *Stage {
+	return &Stage{
+		name:      name,
+		newFilter: newFilter,
+	}
+}
+
+// Name returns the name of the stage.
+func (s *Stage) Name() string {
+	return s.name
+}
+
+// Stats returns the current counters of the stage.
+func (s *Stage) Stats() Stats {
+	return Stats{
+		Name:    s.name,
+		Checked: s.checked.Load(),
+		Dropped: s.dropped.Load(),
+	}
+}
+
+// Dedupe drops the multihashes that were already returned for the same context ID. The
+// multihashes of a context ID are kept in memory while it is being iterated over.
+func Dedupe() *Stage {
+	return NewStage("dedupe", func() Filter {
+		seen := make(map[string]struct{})
+		return FilterFunc(func(mh multihash.Multihash) bool {
+			if _, ok := seen[string(mh)]; ok {
+				return false
+			}
+			seen[string(mh)] = struct{}{}
+			return true
+		})
+	})
+}
+
+// DropIdentity drops identity multihashes, which indexers do not index since their digest is the
+// content itself. Multihashes that cannot be decoded are kept; see ValidateEncoding.
+func DropIdentity() *Stage {
+	return NewStage("drop-identity", func() Filter {
+		return FilterFunc(func(mh multihash.Multihash) bool {
+			dmh, err := multihash.Decode(mh)
+			return err != nil || dmh.Code != multihash.IDENTITY
+		})
+	})
+}
+
+// ValidateEncoding drops the multihashes that are not validly encoded, i.e. whose code or digest
+// length cannot be decoded, or whose digest length does not match the actual digest.
+func ValidateEncoding() *Stage {
+	return NewStage("validate-encoding", func() Filter {
+		return FilterFunc(func(mh multihash.Multihash) bool {
+			_, err := multihash.Cast(mh)
+			return err == nil
+		})
+	})
+}
+
+// AllowCodes only keeps the multihashes whose hash function is one of the given codes.
+// Multihashes that cannot be decoded are dropped.
+func AllowCodes(codes ...multicodec.Code) *Stage {
+	allowed := make(map[uint64]struct{}, len(codes))
+	for _, code := range codes {
+		allowed[uint64(code)] = struct{}{}
+	}
+	return NewStage("allow-codes", func() Filter {
+		return FilterFunc(func(mh multihash.Multihash) bool {
+			dmh, err := multihash.Decode(mh)
+			if err != nil {
+				return false
+			}
+			_, ok := allowed[dmh.Code]
+			return ok
+		})
+	})
+}
+
+// Pipeline filters the multihashes returned by provider.MultihashIterator through its stages.
+//
+// See: New.
+type Pipeline struct {
+	stages []*Stage
+}
+
+// New instantiates a Pipeline that applies the given stages in order. The stages must have
+// unique names.
+//
+// It is typically composed of ValidateEncoding first, so that malformed multihashes are only
+// counted once, followed by the stages that drop valid multihashes, e.g.:
+//
+//	mhfilter.New(mhfilter.ValidateEncoding(), mhfilter.DropIdentity(), mhfilter.Dedupe())
+func New(stages ...*Stage) (*Pipeline, error) {
+	names := make(map[string]struct{}, len(stages))
+	for _, s := range stages {
+		if s == nil {
+			return nil, errors.New("nil multihash filter stage")
+		}
+		if _, ok := names[s.name]; ok {
+			return nil, fmt.Errorf("duplicate multihash filter stage: %s", s.name)
+		}
+		names[s.name] = struct{}{}
+	}
+	return &Pipeline{stages: stages}, nil
+}
+
+// Stats returns the current counters of the stages in order.
+func (p *Pipeline) Stats() []Stats {
+	stats := make([]Stats, 0, len(p.stages))
+	for _, s := range p.stages {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
+
+// Wrap returns a provider.MultihashIterator that only returns the multihashes returned by the
+// given mhi that are kept by all the stages, and counts them in the stages' counters. The given
+// context is only used to record metrics.
+func (p *Pipeline) Wrap(ctx context.Context, mhi provider.MultihashIterator) provider.MultihashIterator {
+	return p.wrap(ctx, mhi, true)
+}
+
+// WrapUncounted returns a provider.MultihashIterator that filters the multihashes returned by the
+// given mhi the same way as Wrap, without counting them. It is intended for listing multihashes
+// that are not being advertised, e.g. to preview or verify advertised entries.
+func (p *Pipeline) WrapUncounted(mhi provider.MultihashIterator) provider.MultihashIterator {
+	return p.wrap(context.Background(), mhi, false)
+}
+
+func (p *Pipeline) wrap(ctx context.Context, mhi provider.MultihashIterator, count bool) provider.MultihashIterator {
+	if len(p.stages) == 0 {
+		return mhi
+	}
+	filters := make([]Filter, len(p.stages))
+	for i, s := range p.stages {
+		filters[i] = s.newFilter()
+	}
+	return &iterator{
+		ctx:     ctx,
+		mhi:     mhi,
+		stages:  p.stages,
+		filters: filters,
+		count:   count,
+	}
+}
+
+type iterator struct {
+	ctx     context.Context
+	mhi     provider.MultihashIterator
+	stages  []*Stage
+	filters []Filter
+	count   bool
+}
+
+func (i *iterator) Next() (multihash.Multihash, error) {
+next:
+	for {
+		mh, err := i.mhi.Next()
+		if err != nil {
+			return nil, err
+		}
+		for j, f := range i.filters {
+			s := i.stages[j]
+			if i.count {
+				s.checked.Add(1)
+			}
+			if !f.Keep(mh) {
+				if i.count {
+					s.dropped.Add(1)
+					metrics.Engine.MultihashesFiltered.Add(i.ctx, 1, metrics.Filter(s.name))
+				}
+				continue next
+			}
+		}
+		return mh, nil
+	}
+}
@@ -0,0 +1,97 @@
+package mhfilter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ipni/go-libipni/test"
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine/mhfilter"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	sha256Mhs := test.RandomMultihashes(3)
+	identityMh, err := multihash.Sum([]byte("fish"), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+	sha512Mh, err := multihash.Sum([]byte("lobster"), multihash.SHA2_512, -1)
+	require.NoError(t, err)
+	// A multihash whose digest is shorter than its encoded length.
+	malformedMh := multihash.Multihash(append([]byte{}, sha256Mhs[0][:20]...))
+
+	mhs := []multihash.Multihash{
+		sha256Mhs[0], identityMh, sha256Mhs[1], malformedMh, sha256Mhs[0], sha512Mh, sha256Mhs[2], sha256Mhs[1],
+	}
+
+	validate := mhfilter.ValidateEncoding()
+	dropIdentity := mhfilter.DropIdentity()
+	dedupe := mhfilter.Dedupe()
+	allow := mhfilter.AllowCodes(multicodec.Sha2_256)
+	subject, err := mhfilter.New(validate, dropIdentity, dedupe, allow)
+	require.NoError(t, err)
+
+	requireFiltered := func(mhi provider.MultihashIterator, want ...multihash.Multihash) {
+		var got []multihash.Multihash
+		for {
+			mh, err := mhi.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, mh)
+		}
+		require.Equal(t, want, got)
+	}
+	requireFiltered(subject.Wrap(context.Background(), provider.SliceMultihashIterator(mhs)), sha256Mhs...)
+	require.Equal(t, []mhfilter.Stats{
+		{Name: "validate-encoding", Checked: 8, Dropped: 1},
+		{Name: "drop-identity", Checked: 7, Dropped: 1},
+		{Name: "dedupe", Checked: 6, Dropped: 2},
+		{Name: "allow-codes", Checked: 4, Dropped: 1},
+	}, subject.Stats())
+
+	// Duplicates are only dropped within the same iterator, and counters accumulate.
+	requireFiltered(subject.Wrap(context.Background(), provider.SliceMultihashIterator(mhs)), sha256Mhs...)
+	require.Equal(t, mhfilter.Stats{Name: "dedupe", Checked: 12, Dropped: 4}, dedupe.Stats())
+
+	// Uncounted filtering drops the same multihashes without touching the counters.
+	requireFiltered(subject.WrapUncounted(provider.SliceMultihashIterator(mhs)), sha256Mhs...)
+	require.Equal(t, mhfilter.Stats{Name: "dedupe", Checked: 12, Dropped: 4}, dedupe.Stats())
+}
+
+func TestPipeline_CustomStage(t *testing.T) {
+	mhs := test.RandomMultihashes(10)
+	var calls int
+	keepEveryOther := mhfilter.NewStage("every-other", func() mhfilter.Filter {
+		calls++
+		var i int
+		return mhfilter.FilterFunc(func(multihash.Multihash) bool {
+			i++
+			return i%2 == 0
+		})
+	})
+	subject, err := mhfilter.New(keepEveryOther)
+	require.NoError(t, err)
+	for n := 1; n <= 2; n++ {
+		mhi := subject.Wrap(context.Background(), provider.SliceMultihashIterator(mhs))
+		for i := 1; i < len(mhs); i += 2 {
+			mh, err := mhi.Next()
+			require.NoError(t, err)
+			require.Equal(t, mhs[i], mh)
+		}
+		_, err = mhi.Next()
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, n, calls)
+	}
+}
+
+func TestNew_ValidatesStages(t *testing.T) {
+	_, err := mhfilter.New(mhfilter.Dedupe(), mhfilter.Dedupe())
+	require.Error(t, err)
+	_, err = mhfilter.New(nil)
+	require.Error(t, err)
+}
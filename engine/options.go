@@ -1,14 +1,17 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer/v2"
 	"github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	_ "github.com/ipni/go-libipni/maurl"
 	"github.com/ipni/index-provider/engine/chunker"
+	"github.com/ipni/index-provider/engine/mhfilter"
 	"github.com/ipni/index-provider/engine/policy"
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -65,8 +68,8 @@ type (
 		// default configured provider will be assumed.
 		provider peer.AddrInfo
 
-		pubKind PublisherKind
-		pubDT   datatransfer.Manager
+		pubKinds []PublisherKind
+		pubDT    datatransfer.Manager
 		// pubHttpAnnounceAddrs are the addresses that are put into announce
 		// messages to tell the indexer the addresses where advertisement are
 		// published.
@@ -75,10 +78,40 @@ type (
 		pubTopicName         string
 		pubTopic             *pubsub.Topic
 		pubExtraGossipData   []byte
+		// pubHttpBearerTokens maps the bearer tokens accepted by the HTTP
+		// publisher to the peers they authenticate.
+		pubHttpBearerTokens map[string]peer.ID
+
+		// announceRetryMin and announceRetryMax bound the delay between
+		// attempts to resend a failed announcement.
+		announceRetryMin time.Duration
+		announceRetryMax time.Duration
+		// reannounceInterval is the interval at which the latest
+		// advertisement is re-announced; zero disables re-announcing.
+		reannounceInterval time.Duration
+
+		// auditInterval is the interval at which auditBatchSize context IDs
+		// are audited for lister consistency; zero disables auditing.
+		auditInterval  time.Duration
+		auditBatchSize int
+
+		// expirySweepInterval is the interval at which expired context IDs
+		// are removed; zero disables removing them.
+		expirySweepInterval time.Duration
+
+		// asyncWorkers is the number of workers that process the publishes
+		// queued via Engine.NotifyPutAsync.
+		asyncWorkers int
 
 		entCacheCap int
 		purgeCache  bool
 		chunker     chunker.NewChunkerFunc
+		// entCacheByteCap bounds the entries cache by size in bytes instead
+		// of by entCacheCap if set.
+		entCacheByteCap int64
+		// mhFilter filters the multihashes returned by the registered
+		// multihash listers, if set.
+		mhFilter *mhfilter.Pipeline
 
 		syncPolicy *policy.Policy
 	}
@@ -86,9 +119,10 @@ type (
 
 func newOptions(o ...Option) (*options, error) {
 	opts := &options{
-		pubKind:           NoPublisher,
 		pubHttpListenAddr: "0.0.0.0:3104",
 		pubTopicName:      "/indexer/ingest/mainnet",
+		announceRetryMin:  5 * time.Second,
+		announceRetryMax:  10 * time.Minute,
 		// Keep 1024 ad entry DAG in cache; note, the size on disk depends on DAG format and
 		// multihash code.
 		entCacheCap: 1024,
@@ -96,6 +130,9 @@ func newOptions(o ...Option) (*options, error) {
 		// 16384 multihashes per chunk.
 		chunker:    chunker.NewChainChunkerFunc(16384),
 		purgeCache: false,
+		// Remove expired context IDs within a minute of their expiry.
+		expirySweepInterval: time.Minute,
+		asyncWorkers:        4,
 	}
 
 	for _, apply := range o {
@@ -144,6 +181,15 @@ func newOptions(o ...Option) (*options, error) {
 	return opts, nil
 }
 
+func (o *options) hasPublisherKind(k PublisherKind) bool {
+	for _, kind := range o.pubKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
 func (o *options) retrievalAddrsAsString() []string {
 	var ras []string
 	for _, ra := range o.provider.Addrs {
@@ -169,6 +215,7 @@ func WithPurgeCacheOnStart(p bool) Option {
 // If unset, advertisement entries are formatted as chained Entry Chunk with default maximum of
 // 16384 multihashes per chunk.
 //
+// To bound the chunks by their size in bytes, see: WithByteBoundedChainedEntries.
 // To use HAMT as the advertisement entries format, see: WithHamtEntries.
 // For caching configuration: WithEntriesCacheCapacity, chunker.CachedEntriesChunker
 func WithChainedEntries(chunkSize int) Option {
@@ -178,6 +225,22 @@ func WithChainedEntries(chunkSize int) Option {
 	}
 }
 
+// WithByteBoundedChainedEntries sets format of advertisement entries to chained Entry Chunk,
+// where each chunk is packed with multihashes for as long as the encoded chunk does not exceed
+// maxBytes. Optionally, chunkSize caps the number of multihashes per chunk as well; zero means no
+// cap.
+//
+// This bounds the size of the entry chunk blocks even when the multihashes vary in length, e.g.
+// when mixing sha2-256 and blake3-512 multihashes or identity multihashes.
+//
+// See: chunker.NewByteBoundedChainChunker, WithChainedEntries.
+func WithByteBoundedChainedEntries(maxBytes, chunkSize int) Option {
+	return func(o *options) error {
+		o.chunker = chunker.NewByteBoundedChainChunkerFunc(maxBytes, chunkSize)
+		return nil
+	}
+}
+
 // WithHamtEntries sets format of advertisement entries to HAMT with the given hash algorithm,
 // bit-width and bucket size.
 //
@@ -199,6 +262,22 @@ func WithHamtEntries(hashAlg multicodec.Code, bitWidth, bucketSize int) Option {
 	}
 }
 
+// WithParallelHamtEntries sets format of advertisement entries to HAMT the same way as
+// WithHamtEntries, except that the HAMT is built by the given number of concurrent workers, each
+// building a share of the subtrees of the HAMT root. The resulting entries are identical to the
+// ones of WithHamtEntries with the same hash algorithm, bit-width and bucket size.
+//
+// At most maxBuffered multihashes are held in memory while waiting for the workers to insert them
+// into the HAMT. The concurrency must be at least 1, and maxBuffered must be at least concurrency.
+//
+// See: chunker.NewParallelHamtChunker, WithHamtEntries.
+func WithParallelHamtEntries(hashAlg multicodec.Code, bitWidth, bucketSize, concurrency, maxBuffered int) Option {
+	return func(o *options) error {
+		o.chunker = chunker.NewParallelHamtChunkerFunc(hashAlg, bitWidth, bucketSize, concurrency, maxBuffered)
+		return nil
+	}
+}
+
 // WithEntriesCacheCapacity sets the maximum number of advertisement entries DAG to cache. The
 // cached DAG may be in chained Entry Chunk or HAMT format. See WithChainedEntries and
 // WithHamtEntries to select the ad entries DAG format.
@@ -218,12 +297,40 @@ func WithEntriesCacheCapacity(s int) Option {
 	}
 }
 
-// WithPublisherKind sets the kind of publisher used to announce new advertisements.
+// WithEntriesCacheByteCapacity bounds the advertisement entries cache by the total size of the
+// cached entry chunks in bytes, rather than by the number of cached DAGs. If set, it takes
+// precedence over WithEntriesCacheCapacity.
+//
+// The least recently used DAGs are evicted until the cache fits within the given size, except for
+// the most recently cached DAG, which is kept even if it is larger than the given size on its own.
+//
+// See: chunker.NewByteBoundedCachedEntriesChunker.
+func WithEntriesCacheByteCapacity(maxBytes int64) Option {
+	return func(o *options) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("invalid entries cache byte capacity: %d", maxBytes)
+		}
+		o.entCacheByteCap = maxBytes
+		return nil
+	}
+}
+
+// WithPublisherKind sets the kinds of publisher used to publish advertisements
+// and announce new ones. When several kinds are set, a publisher of each kind
+// is run over the same link system with the same root, and announce messages
+// include the addresses of all of them. Repeated kinds and NoPublisher are
+// ignored.
+//
 // If unset, advertisements are only stored locally and no announcements are made.
 // See: PublisherKind.
-func WithPublisherKind(k PublisherKind) Option {
+func WithPublisherKind(k ...PublisherKind) Option {
 	return func(o *options) error {
-		o.pubKind = k
+		o.pubKinds = nil
+		for _, kind := range k {
+			if kind != NoPublisher && !o.hasPublisherKind(kind) {
+				o.pubKinds = append(o.pubKinds, kind)
+			}
+		}
 		return nil
 	}
 }
@@ -231,7 +338,7 @@ func WithPublisherKind(k PublisherKind) Option {
 // WithHttpPublisherListenAddr sets the net listen address for the HTTP publisher.
 // If unset, the default net listen address of '0.0.0.0:3104' is used.
 //
-// Note that this option only takes effect if the PublisherKind is set to HttpPublisher.
+// Note that this option only takes effect if the PublisherKind includes HttpPublisher.
 // See: WithPublisherKind.
 func WithHttpPublisherListenAddr(addr string) Option {
 	return func(o *options) error {
@@ -243,7 +350,7 @@ func WithHttpPublisherListenAddr(addr string) Option {
 // WithHttpPublisherAnnounceAddr sets the address to be supplied in announce
 // messages to tell indexers where to retrieve advertisements.
 //
-// This option only takes effect if the PublisherKind is set to HttpPublisher.
+// This option only takes effect if the PublisherKind includes HttpPublisher.
 func WithHttpPublisherAnnounceAddr(addr string) Option {
 	return func(o *options) error {
 		if addr != "" {
@@ -257,6 +364,28 @@ func WithHttpPublisherAnnounceAddr(addr string) Option {
 	}
 }
 
+// WithHttpPublisherBearerToken maps a bearer token to the peer it
+// authenticates when presented to the HTTP publisher, i.e. with an
+// "Authorization: Bearer <token>" header. Requests to the HTTP publisher are
+// allowed or denied by the sync policy according to the peer they
+// authenticate as, either via a bearer token or via the PeerIDAuthScheme.
+// This option may be given multiple times to map several tokens.
+//
+// This option only takes effect if the PublisherKind includes HttpPublisher.
+// See: WithSyncPolicy, SignHttpSyncRequest.
+func WithHttpPublisherBearerToken(token string, peerID peer.ID) Option {
+	return func(o *options) error {
+		if token == "" {
+			return errors.New("bearer token must not be empty")
+		}
+		if o.pubHttpBearerTokens == nil {
+			o.pubHttpBearerTokens = make(map[string]peer.ID)
+		}
+		o.pubHttpBearerTokens[token] = peerID
+		return nil
+	}
+}
+
 // WithTopicName sets toe topic name on which pubsub announcements are published.
 // To override the default pubsub configuration, use WithTopic.
 //
@@ -335,6 +464,13 @@ func WithRetrievalAddrs(addrs ...string) Option {
 	}
 }
 
+// WithSyncPolicy sets the policy that determines which peers are allowed to
+// sync advertisements and entries from the publishers. The HTTP publisher
+// identifies peers by their authorization; requests without one are only
+// allowed if the policy allows every peer, i.e. it allows peers by default and
+// has no exceptions.
+// If unspecified, all peers are allowed.
+// See: WithHttpPublisherBearerToken.
 func WithSyncPolicy(syncPolicy *policy.Policy) Option {
 	return func(o *options) error {
 		o.syncPolicy = syncPolicy
@@ -378,3 +514,120 @@ func WithDirectAnnounce(announceURLs ...string) Option {
 		return nil
 	}
 }
+
+// WithAnnounceRetryBackoff sets the delay before resending a failed
+// announcement, which doubles after each consecutive failure up to the given
+// maximum. Announcements are retried until they succeed or are superseded by
+// the announcement of a newer advertisement.
+//
+// If unset, the delay starts at 5 seconds and is at most 10 minutes.
+func WithAnnounceRetryBackoff(min, max time.Duration) Option {
+	return func(o *options) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid announce retry backoff: min %s, max %s", min, max)
+		}
+		o.announceRetryMin = min
+		o.announceRetryMax = max
+		return nil
+	}
+}
+
+// WithReannounceInterval sets the interval at which the latest advertisement
+// is re-announced to the announce targets, so that indexers that missed the
+// original announcement eventually learn about it. The advertisement is not
+// re-announced to a target if it was successfully announced to it within the
+// interval. The schedule is jittered to avoid providers re-announcing in
+// lockstep.
+//
+// Re-announcing is disabled if the interval is zero, which is the default.
+func WithReannounceInterval(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid re-announce interval: %s", d)
+		}
+		o.reannounceInterval = d
+		return nil
+	}
+}
+
+// WithListerAudit enables a background worker that checks, every interval,
+// that the registered multihash listers still return the advertised
+// multihashes for batchSize advertised context IDs picked at random. The
+// multihashes are chunked with a throwaway chunker, so the entries cache is
+// unaffected, and the resulting link is compared with the advertised entries.
+//
+// Mismatches are logged, counted in metrics and listed by
+// Engine.ListerMismatches. Otherwise they are only discovered once an indexer
+// fails to sync the evicted entries with ErrEntriesLinkMismatch.
+//
+// Auditing is disabled if the interval is zero, which is the default.
+func WithListerAudit(interval time.Duration, batchSize int) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid lister audit interval: %s", interval)
+		}
+		if interval > 0 && batchSize < 1 {
+			return fmt.Errorf("invalid lister audit batch size: %d", batchSize)
+		}
+		o.auditInterval = interval
+		o.auditBatchSize = batchSize
+		return nil
+	}
+}
+
+// WithExpirySweepInterval sets the interval at which the engine looks for
+// context IDs that have expired, and removes them by publishing one removal
+// advertisement per expired context ID. Expiries are set via
+// provider.WithExpiry or provider.WithTTL when calling Engine.NotifyPut, or
+// via Engine.ExtendTTL. The engine only starts looking once a context ID has
+// an expiry, and looks right away when started with expiries already set in
+// case any expired meanwhile.
+//
+// Defaults to one minute. Expired context IDs are not removed if the interval
+// is zero.
+func WithExpirySweepInterval(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid expiry sweep interval: %s", d)
+		}
+		o.expirySweepInterval = d
+		return nil
+	}
+}
+
+// WithAsyncPublishWorkers sets the number of workers that process the
+// publishes queued via Engine.NotifyPutAsync, i.e. the number of context IDs
+// whose multihashes may be chunked concurrently. Defaults to 4.
+func WithAsyncPublishWorkers(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("invalid number of async publish workers: %d", n)
+		}
+		o.asyncWorkers = n
+		return nil
+	}
+}
+
+// WithMultihashFilters filters the multihashes returned by the registered
+// provider.MultihashLister through the given stages, in order, before they are
+// chunked into advertisement entries. For example, duplicate, identity and
+// malformed multihashes can be dropped without every lister having to do so:
+//
+//	engine.WithMultihashFilters(mhfilter.ValidateEncoding(), mhfilter.DropIdentity(), mhfilter.Dedupe())
+//
+// The filters apply whenever the multihashes are listed, including when
+// regenerating the entries of previously advertised context IDs. Changing the
+// filters therefore changes the regenerated entries of context IDs advertised
+// before the change, which may then no longer match the advertised entries.
+//
+// See: Engine.MultihashFilterStats.
+func WithMultihashFilters(stages ...*mhfilter.Stage) Option {
+	return func(o *options) error {
+		pipeline, err := mhfilter.New(stages...)
+		if err != nil {
+			return err
+		}
+		o.mhFilter = pipeline
+		return nil
+	}
+}
@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipni/go-libipni/announce/httpsender"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/ipni/go-libipni/announce/p2psender"
+)
+
+const (
+	announceOutboxKey = "sync/outbox/"
+
+	// announceSendTimeout is the maximum time a single announce send may
+	// take before it is considered failed.
+	announceSendTimeout = time.Minute
+)
+
+var dsAnnounceOutboxKey = datastore.NewKey(announceOutboxKey)
+
+// AnnounceStatus describes the state of announcing the latest advertisement
+// to an announce target, i.e. a direct HTTP announce URL or the gossip pubsub
+// topic.
+//
+// See: Engine.AnnounceStatus.
+type AnnounceStatus struct {
+	// Target identifies the announce target, as "http:<url>" or
+	// "pubsub:<topic>".
+	Target string `json:"target"`
+	// Pending is the CID of the advertisement that is yet to be announced to
+	// the target, or cid.Undef if there is none.
+	Pending cid.Cid `json:"pending"`
+	// Attempts is the number of failed attempts to announce Pending.
+	Attempts int `json:"attempts,omitempty"`
+	// NextAttempt is the time at which announcing Pending is next attempted.
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	// LastSuccess is the CID of the advertisement most recently announced to
+	// the target successfully, and LastSuccessTime is when it was announced.
+	LastSuccess     cid.Cid   `json:"last_success"`
+	LastSuccessTime time.Time `json:"last_success_time,omitempty"`
+	// LastError is the error of the most recent failed attempt, and
+	// LastErrorTime is when it failed.
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+}
+
+// announceOutbox durably records the latest advertisement to announce to each
+// announce target, and retries failed announcements with exponential backoff
+// until they succeed. Announcements are coalesced: only the latest
+// advertisement is ever announced to a target, since it implies all the
+// previous ones.
+type announceOutbox struct {
+	e       *Engine
+	senders map[string]*eventSender
+
+	// lk guards status.
+	lk     sync.Mutex
+	status map[string]*AnnounceStatus
+	// sendLk serializes rounds of sends.
+	sendLk sync.Mutex
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newAnnounceOutbox creates an outbox with an announce sender per direct
+// announce URL, plus a gossip pubsub sender if there is a libp2p host, and
+// restores the state of the outbox from the datastore.
+func (e *Engine) newAnnounceOutbox(ctx context.Context) (*announceOutbox, error) {
+	o := &announceOutbox{
+		e:       e,
+		senders: make(map[string]*eventSender),
+		status:  make(map[string]*AnnounceStatus),
+		wake:    make(chan struct{}, 1),
+	}
+
+	// Use one sender per URL so that the status of each URL is tracked
+	// separately.
+	for _, u := range e.announceURLs {
+		httpSender, err := httpsender.New([]*url.URL{u}, e.h.ID())
+		if err != nil {
+			o.closeSenders()
+			return nil, fmt.Errorf("cannot create http announce sender: %w", err)
+		}
+		s := e.newEventSender(httpSender, "http", u.String())
+		o.senders[s.name] = s
+	}
+
+	// If there is a libp2p host, then create a gossip pubsub announce sender.
+	if e.h != nil {
+		p2pSender, err := p2psender.New(e.h, e.pubTopicName, p2psender.WithTopic(e.pubTopic))
+		if err != nil {
+			o.closeSenders()
+			return nil, err
+		}
+		s := e.newEventSender(p2pSender, "pubsub", e.pubTopicName)
+		o.senders[s.name] = s
+	}
+
+	// Restore the state of the targets that are still configured.
+	b, err := e.ds.Get(ctx, dsAnnounceOutboxKey)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		o.closeSenders()
+		return nil, fmt.Errorf("could not get announce outbox: %w", err)
+	}
+	var stored []*AnnounceStatus
+	if len(b) != 0 {
+		if err = json.Unmarshal(b, &stored); err != nil {
+			o.closeSenders()
+			return nil, fmt.Errorf("could not decode announce outbox: %w", err)
+		}
+	}
+	for _, s := range stored {
+		if _, ok := o.senders[s.Target]; ok {
+			o.status[s.Target] = s
+		}
+	}
+	for name := range o.senders {
+		if _, ok := o.status[name]; !ok {
+			o.status[name] = &AnnounceStatus{Target: name}
+		}
+	}
+
+	wctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.wg.Add(1)
+	go o.run(wctx)
+	if e.reannounceInterval > 0 {
+		o.wg.Add(1)
+		go o.runReannounce(wctx, e.reannounceInterval)
+	}
+	return o, nil
+}
+
+// announce records the given advertisement CID as pending for all targets,
+// replacing any previously pending advertisement, and wakes up the background
+// loop to announce it. Sends are never made by the caller, since announce is
+// called while holding Engine.cblk. If the outbox cannot be persisted then the
+// advertisement is still announced, but not after a restart.
+func (o *announceOutbox) announce(ctx context.Context, c cid.Cid) error {
+	err := o.record(ctx, c)
+	o.notify()
+	return err
+}
+
+// announceNow records the given advertisement CID as pending for all targets
+// the same way as announce, then announces it right away and returns the
+// combined errors of the targets that failed, which are retried by the
+// background loop. It must not be called while holding Engine.cblk.
+func (o *announceOutbox) announceNow(ctx context.Context, c cid.Cid) error {
+	defer o.notify()
+	o.sendLk.Lock()
+	defer o.sendLk.Unlock()
+	if err := o.record(ctx, c); err != nil {
+		log.Errorw("Failed to persist advertisement to announce", "err", err)
+	}
+	return o.sendDueLocked(ctx)
+}
+
+// record records the given advertisement CID as pending for all targets, and
+// persists the outbox.
+func (o *announceOutbox) record(ctx context.Context, c cid.Cid) error {
+	now := time.Now()
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	for _, s := range o.status {
+		s.Pending = c
+		s.Attempts = 0
+		s.NextAttempt = now
+	}
+	return o.persistLocked(ctx)
+}
+
+// notify wakes up the background loop to send the pending announcements.
+func (o *announceOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendDue sends the pending announcements that are due, and returns the
+// combined errors of the ones that failed.
+func (o *announceOutbox) sendDue(ctx context.Context) error {
+	o.sendLk.Lock()
+	defer o.sendLk.Unlock()
+	return o.sendDueLocked(ctx)
+}
+
+// sendDueLocked is sendDue for callers that hold announceOutbox.sendLk.
+func (o *announceOutbox) sendDueLocked(ctx context.Context) error {
+	type due struct {
+		target string
+		c      cid.Cid
+	}
+	var dues []due
+	now := time.Now()
+	o.lk.Lock()
+	for name, s := range o.status {
+		if s.Pending != cid.Undef && !s.NextAttempt.After(now) {
+			dues = append(dues, due{name, s.Pending})
+		}
+	}
+	o.lk.Unlock()
+	if len(dues) == 0 {
+		return nil
+	}
+
+	msg := message.Message{}
+	if o.e.hasPublisherKind(DataTransferPublisher) {
+		msg.ExtraData = o.e.pubExtraGossipData
+	}
+	msg.SetAddrs(o.e.announceAddrs())
+
+	var errs error
+	for _, d := range dues {
+		msg.Cid = d.c
+		sctx, cancel := context.WithTimeout(ctx, announceSendTimeout)
+		err := o.senders[d.target].Send(sctx, msg)
+		cancel()
+
+		now = time.Now()
+		o.lk.Lock()
+		s := o.status[d.target]
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", d.target, err))
+			s.LastError = err.Error()
+			s.LastErrorTime = now
+			// Only back off if the announcement was not superseded meanwhile.
+			if s.Pending == d.c {
+				s.Attempts++
+				s.NextAttempt = now.Add(o.backoff(s.Attempts))
+			}
+			log.Warnw("Failed to announce advertisement; will retry", "target", d.target, "adCid", d.c, "attempts", s.Attempts, "nextAttempt", s.NextAttempt, "err", err)
+		} else {
+			s.LastSuccess = d.c
+			s.LastSuccessTime = now
+			if s.Pending == d.c {
+				s.Pending = cid.Undef
+				s.Attempts = 0
+				s.NextAttempt = time.Time{}
+			}
+		}
+		o.lk.Unlock()
+	}
+
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	if err := o.persistLocked(ctx); err != nil {
+		log.Errorw("Failed to persist announce outbox", "err", err)
+	}
+	return errs
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// failed attempts.
+func (o *announceOutbox) backoff(attempts int) time.Duration {
+	d := o.e.announceRetryMin
+	for i := 1; i < attempts && d < o.e.announceRetryMax; i++ {
+		d *= 2
+	}
+	if d > o.e.announceRetryMax {
+		d = o.e.announceRetryMax
+	}
+	return d
+}
+
+// run retries the pending announcements as they become due, until the outbox
+// is closed.
+func (o *announceOutbox) run(ctx context.Context) {
+	defer o.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-o.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		if err := o.sendDue(ctx); err != nil && ctx.Err() == nil {
+			log.Debugw("Retried announcements failed", "err", err)
+		}
+		timer.Reset(o.nextDue())
+	}
+}
+
+// nextDue returns the time until the earliest pending announcement is due. If
+// there is none, a long delay is returned since the outbox is woken up when a
+// new announcement is recorded.
+func (o *announceOutbox) nextDue() time.Duration {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	next := time.Hour
+	now := time.Now()
+	for _, s := range o.status {
+		if s.Pending == cid.Undef {
+			continue
+		}
+		if d := s.NextAttempt.Sub(now); d < next {
+			next = d
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func (o *announceOutbox) persistLocked(ctx context.Context) error {
+	stored := make([]*AnnounceStatus, 0, len(o.status))
+	for _, s := range o.status {
+		stored = append(stored, s)
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err = o.e.ds.Put(ctx, dsAnnounceOutboxKey, b); err != nil {
+		return fmt.Errorf("could not store announce outbox: %w", err)
+	}
+	return nil
+}
+
+// statuses returns a copy of the status of all targets, sorted by target.
+func (o *announceOutbox) statuses() []AnnounceStatus {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	statuses := make([]AnnounceStatus, 0, len(o.status))
+	for _, s := range o.status {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Target < statuses[j].Target
+	})
+	return statuses
+}
+
+func (o *announceOutbox) close() error {
+	o.cancel()
+	o.wg.Wait()
+	return o.closeSenders()
+}
+
+func (o *announceOutbox) closeSenders() error {
+	var errs error
+	for _, s := range o.senders {
+		if err := s.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// AnnounceStatus returns the status of announcing the latest advertisement to
+// each announce target. It returns nil if remote announcements are disabled.
+func (e *Engine) AnnounceStatus() []AnnounceStatus {
+	if e.outbox == nil {
+		return nil
+	}
+	return e.outbox.statuses()
+}
@@ -31,6 +31,14 @@ func (p *Policy) Allowed(peerID peer.ID) bool {
 	return p.allow.Eval(peerID)
 }
 
+// AllowedAll returns true if the policy allows every peer to sync content,
+// i.e. it allows by default and has no exceptions.
+func (p *Policy) AllowedAll() bool {
+	p.rwmutex.RLock()
+	defer p.rwmutex.RUnlock()
+	return !p.allow.Any(false)
+}
+
 // Allow alters the policy to allow the specified peer.  Returns true if the
 // policy needed to be updated.
 func (p *Policy) Allow(peerID peer.ID) bool {
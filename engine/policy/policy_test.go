@@ -79,3 +79,18 @@ func TestPolicyAccess(t *testing.T) {
 	p.Block(otherID)
 	require.False(t, p.Allowed(otherID), "peer ID should not be allowed")
 }
+
+func TestPolicyAllowedAll(t *testing.T) {
+	p, err := New(true, nil)
+	require.NoError(t, err)
+	require.True(t, p.AllowedAll())
+
+	p.Block(exceptID)
+	require.False(t, p.AllowedAll(), "policy with exceptions should not allow all")
+	p.Allow(exceptID)
+	require.True(t, p.AllowedAll())
+
+	p, err = New(false, nil)
+	require.NoError(t, err)
+	require.False(t, p.AllowedAll())
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// AdPreview describes the advertisement that Engine.NotifyPut would publish.
+//
+// See: Engine.PreviewNotifyPut.
+type AdPreview struct {
+	// Advertisement is the signed advertisement that would be published,
+	// linked to the current latest advertisement.
+	Advertisement *schema.Advertisement
+	// AdCid is the CID of the advertisement, as long as no other
+	// advertisement is published first.
+	AdCid cid.Cid
+	// AdSize is the size of the encoded advertisement in bytes.
+	AdSize int
+	// Entries is the CID of the root of the entries, or schema.NoEntries if
+	// the lister returns no multihashes.
+	Entries cid.Cid
+	// Reused indicates whether the context ID is already advertised with
+	// different metadata, in which case the advertised entries are reused
+	// rather than generated, and the counts below are zero.
+	Reused bool
+	// ChunkCount is the number of entries chunks that would be generated.
+	ChunkCount int
+	// EntriesSize is the total size of the encoded entries chunks in bytes.
+	EntriesSize int
+	// MultihashCount is the number of multihashes returned by the lister.
+	MultihashCount int
+}
+
+// PreviewNotifyPut returns the advertisement that Engine.NotifyPut would
+// publish for the given arguments, without publishing it. The registered
+// provider.MultihashLister is run and its multihashes chunked into an
+// ephemeral link system, so the advertisement chain, the datastore and the
+// entries cache are left untouched.
+//
+// The same errors as Engine.NotifyPut are returned, e.g.
+// provider.ErrAlreadyAdvertised if the context ID is already advertised with
+// the same metadata.
+func (e *Engine) PreviewNotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (*AdPreview, error) {
+	pID := e.providerID()
+	addrs := e.retrievalAddrs()
+	if provider != nil {
+		pID = provider.ID
+		addrs = provider.Addrs
+	}
+
+	preview, err := e.previewEntries(ctx, pID, contextID, md)
+	if err != nil {
+		return nil, err
+	}
+
+	adv, err := newAdvertisement(pID, addrs, contextID, md, cidlink.Link{Cid: preview.Entries}, false)
+	if err != nil {
+		return nil, err
+	}
+	prevAdvID, err := e.getLatestAdCid(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get latest advertisement: %s", err)
+	}
+	if prevAdvID != cid.Undef {
+		adv.PreviousID = cidlink.Link{Cid: prevAdvID}
+	}
+	if err = adv.Sign(e.signingKey()); err != nil {
+		return nil, err
+	}
+	if err = adv.Validate(); err != nil {
+		return nil, err
+	}
+	adNode, err := adv.ToNode()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &memstore.Store{}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetWriteStorage(store)
+	lnk, err := lsys.Store(ipld.LinkContext{Ctx: ctx}, schema.Linkproto, adNode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate advertisement link: %s", err)
+	}
+	preview.Advertisement = adv
+	preview.AdCid = lnk.(cidlink.Link).Cid
+	preview.AdSize = len(store.Bag[preview.AdCid.KeyString()])
+	return preview, nil
+}
+
+// previewEntries returns the entries that Engine.NotifyPut would advertise
+// for the given provider and context ID. New entries are chunked into an
+// ephemeral link system.
+func (e *Engine) previewEntries(ctx context.Context, p peer.ID, contextID []byte, md metadata.Metadata) (*AdPreview, error) {
+	c, err := e.getKeyCidMap(ctx, p, contextID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("cound not not get entries cid by provider + context id: %s", err)
+	}
+	if c != cid.Undef {
+		prevMetadata, err := e.getKeyMetadataMap(ctx, p, contextID)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return nil, fmt.Errorf("could not get metadata for provider + context id: %s", err)
+		}
+		if md.Equal(prevMetadata) {
+			return nil, provider.ErrAlreadyAdvertised
+		}
+		return &AdPreview{Entries: c, Reused: true}, nil
+	}
+
+	mhLister, err := e.multihashLister(p, contextID, false)
+	if err != nil {
+		return nil, err
+	}
+	mhIter, err := mhLister(ctx, p, contextID)
+	if err != nil {
+		return nil, err
+	}
+	cmhi := &previewIterator{MultihashIterator: mhIter}
+
+	store := &memstore.Store{}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	entriesChunker, err := e.chunker(&lsys)
+	if err != nil {
+		return nil, fmt.Errorf("could not instantiate chunker: %w", err)
+	}
+	lnk, err := entriesChunker.Chunk(ctx, cmhi)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate entries list: %s", err)
+	}
+
+	preview := &AdPreview{
+		Entries:        schema.NoEntries.Cid,
+		ChunkCount:     len(store.Bag),
+		MultihashCount: cmhi.count,
+	}
+	if lnk != nil {
+		preview.Entries = lnk.(cidlink.Link).Cid
+	}
+	for _, chunk := range store.Bag {
+		preview.EntriesSize += len(chunk)
+	}
+	return preview, nil
+}
+
+// previewIterator counts the multihashes returned by a
+// provider.MultihashIterator.
+type previewIterator struct {
+	provider.MultihashIterator
+	count int
+}
+
+func (i *previewIterator) Next() (multihash.Multihash, error) {
+	mh, err := i.MultihashIterator.Next()
+	if err == nil {
+		i.count++
+	}
+	return mh, err
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsn "github.com/ipfs/go-datastore/namespace"
+	"github.com/ipni/go-libipni/dagsync"
+	"github.com/ipni/go-libipni/dagsync/dtsync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// kindPublisher is a dagsync.Publisher of a given kind.
+type kindPublisher struct {
+	dagsync.Publisher
+	kind PublisherKind
+}
+
+// multiPublisher publishes the advertisement chain via several publishers of
+// different kinds that all serve the engine link system. Their roots are kept
+// in sync.
+//
+// Announcements are sent via the announce outbox rather than by the
+// publishers, so that failed announcements are retried. The announce methods
+// therefore only set the root.
+type multiPublisher []kindPublisher
+
+var _ dagsync.Publisher = (multiPublisher)(nil)
+
+// newPublisher instantiates a publisher for each configured publisher kind.
+// It returns nil if no publisher kind is configured.
+func (e *Engine) newPublisher() (dagsync.Publisher, error) {
+	if len(e.pubKinds) == 0 {
+		log.Info("Remote announcements is disabled; all advertisements will only be store locally.")
+		return nil, nil
+	}
+
+	var pubs multiPublisher
+	for _, kind := range e.pubKinds {
+		pub, err := e.newKindPublisher(kind)
+		if err != nil {
+			_ = pubs.Close()
+			return nil, err
+		}
+		pubs = append(pubs, kindPublisher{pub, kind})
+	}
+	return pubs, nil
+}
+
+func (e *Engine) newKindPublisher(kind PublisherKind) (dagsync.Publisher, error) {
+	switch kind {
+	case HttpPublisher:
+		return e.newHttpPublisher()
+	case DataTransferPublisher:
+		dtOpts := []dtsync.Option{
+			dtsync.WithExtraData(e.pubExtraGossipData),
+			dtsync.WithAllowPeer(e.syncPolicy.Allowed),
+		}
+		if e.pubDT != nil {
+			return dtsync.NewPublisherFromExisting(e.pubDT, e.h, e.pubTopicName, e.lsys, dtOpts...)
+		}
+		ds := dsn.Wrap(e.ds, datastore.NewKey("/dagsync/dtsync/pub"))
+		return dtsync.NewPublisher(e.h, ds, e.lsys, e.pubTopicName, dtOpts...)
+	default:
+		return nil, fmt.Errorf("unknown publisher kind: %s", kind)
+	}
+}
+
+// announceAddrs returns the addresses to put into announce messages, i.e. the
+// addresses of all the publishers, so that indexers can sync over whichever
+// kind they support.
+func (e *Engine) announceAddrs() []multiaddr.Multiaddr {
+	pubs, _ := e.publisher.(multiPublisher)
+	var addrs []multiaddr.Multiaddr
+	for _, pub := range pubs {
+		if pub.kind == HttpPublisher && len(e.pubHttpAnnounceAddrs) != 0 {
+			addrs = append(addrs, e.pubHttpAnnounceAddrs...)
+			continue
+		}
+		addrs = append(addrs, pub.Addrs()...)
+	}
+	return addrs
+}
+
+// Addrs returns the addresses of all publishers.
+func (p multiPublisher) Addrs() []multiaddr.Multiaddr {
+	var addrs []multiaddr.Multiaddr
+	for _, pub := range p {
+		addrs = append(addrs, pub.Addrs()...)
+	}
+	return addrs
+}
+
+// ID returns the peer ID of the publishers, which all use the engine identity.
+func (p multiPublisher) ID() peer.ID {
+	if len(p) == 0 {
+		return ""
+	}
+	return p[0].ID()
+}
+
+// Protocol returns the protocol of the first publisher.
+func (p multiPublisher) Protocol() int {
+	if len(p) == 0 {
+		return 0
+	}
+	return p[0].Protocol()
+}
+
+func (p multiPublisher) AnnounceHead(context.Context) error {
+	return nil
+}
+
+func (p multiPublisher) AnnounceHeadWithAddrs(context.Context, []multiaddr.Multiaddr) error {
+	return nil
+}
+
+// SetRoot sets the root of all publishers.
+func (p multiPublisher) SetRoot(ctx context.Context, c cid.Cid) error {
+	var errs error
+	for _, pub := range p {
+		if err := pub.SetRoot(ctx, c); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s publisher: %w", pub.kind, err))
+		}
+	}
+	return errs
+}
+
+func (p multiPublisher) UpdateRoot(ctx context.Context, c cid.Cid) error {
+	return p.SetRoot(ctx, c)
+}
+
+func (p multiPublisher) UpdateRootWithAddrs(ctx context.Context, c cid.Cid, _ []multiaddr.Multiaddr) error {
+	return p.SetRoot(ctx, c)
+}
+
+// Close closes all publishers.
+func (p multiPublisher) Close() error {
+	var errs error
+	for _, pub := range p {
+		if err := pub.Close(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s publisher: %w", pub.kind, err))
+		}
+	}
+	return errs
+}
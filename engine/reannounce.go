@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// reannounceJitter is the fraction of the re-announce interval by which each
+// re-announce is randomly delayed or advanced.
+const reannounceJitter = 0.1
+
+// runReannounce periodically re-announces the latest advertisement to the
+// targets that have not successfully announced it within the given interval,
+// until the context is canceled.
+//
+// The first re-announce happens at a random time within the interval, and the
+// following ones are spread by reannounceJitter around the interval, so that
+// providers started at the same time do not re-announce in lockstep.
+func (o *announceOutbox) runReannounce(ctx context.Context, interval time.Duration) {
+	defer o.wg.Done()
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(interval))))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		c, err := o.e.getLatestAdCid(ctx)
+		if err != nil {
+			log.Errorw("Failed to get latest advertisement to re-announce", "err", err)
+		} else if c != cid.Undef {
+			if err = o.reannounce(ctx, c, interval); err != nil && ctx.Err() == nil {
+				log.Warnw("Failed to re-announce latest advertisement; will retry", "adCid", c, "err", err)
+			}
+		}
+
+		jitter := time.Duration((rand.Float64()*2 - 1) * reannounceJitter * float64(interval))
+		timer.Reset(interval + jitter)
+	}
+}
+
+// reannounce records the given advertisement CID as pending for the targets
+// that have not successfully announced it within the given duration and have
+// no pending announcement, then sends the pending announcements that are due.
+func (o *announceOutbox) reannounce(ctx context.Context, c cid.Cid, within time.Duration) error {
+	now := time.Now()
+	var count int
+	o.lk.Lock()
+	for _, s := range o.status {
+		if s.Pending != cid.Undef {
+			// Already being announced or retried.
+			continue
+		}
+		if s.LastSuccess == c && now.Sub(s.LastSuccessTime) < within {
+			continue
+		}
+		s.Pending = c
+		s.Attempts = 0
+		s.NextAttempt = now
+		count++
+	}
+	var err error
+	if count != 0 {
+		err = o.persistLocked(ctx)
+	}
+	o.lk.Unlock()
+	if count == 0 {
+		log.Debugw("Skipped re-announcing latest advertisement; announced recently", "adCid", c)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infow("Re-announcing latest advertisement", "adCid", c, "targets", count)
+	err = o.sendDue(ctx)
+	o.notify()
+	return err
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/index-provider/engine/xproviders"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// RotateKey switches the key used to sign advertisements to the given key,
+// and moves the content advertised by the default provider to the peer ID of
+// the new key. The default provider ID must be the peer ID of the current key.
+//
+// The following advertisements are published, in order, as a single publish:
+//   - an advertisement with no entries and no context ID, signed by the
+//     current key, that lists both the current and the new peer IDs as
+//     extended providers and is attested to by the new key;
+//   - for each context ID of the default provider, an advertisement that puts
+//     the context ID with the same entries and metadata under the new peer
+//     ID, followed by an advertisement that removes it from the current one.
+//
+// The provider and context ID mappings of the default provider are carried
+// over to the new peer ID, which becomes the default provider ID. From then
+// on, the registered provider.MultihashLister is called with the new peer ID.
+//
+// Publishes that assume the default provider and are made concurrently are
+// either published before the rotation under the current peer ID, and moved
+// by it, or after the rotation under the new peer ID.
+//
+// Note that the identity of the libp2p host, and therefore of the publisher,
+// is not changed. The engine should be restarted with a host that uses the
+// new key once this function returns.
+func (e *Engine) RotateKey(ctx context.Context, newKey crypto.PrivKey) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	oldKey := e.signingKey()
+	oldID := e.providerID()
+	keyID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if keyID != oldID {
+		return cid.Undef, fmt.Errorf("default provider ID %s is not the peer ID of the signing key %s", oldID, keyID)
+	}
+	newID, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid new key: %w", err)
+	}
+	if newID == oldID {
+		return cid.Undef, errors.New("new key must differ from the current key")
+	}
+
+	if err = e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	contextIDs, err := e.listContextIDs(ctx, oldID)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not list context IDs of provider %s: %w", oldID, err)
+	}
+
+	emptyMd := metadata.Default.New()
+	emptyMdBytes, err := emptyMd.MarshalBinary()
+	if err != nil {
+		return cid.Undef, err
+	}
+	addrs := e.retrievalAddrs()
+	var stringAddrs []string
+	for _, addr := range addrs {
+		stringAddrs = append(stringAddrs, addr.String())
+	}
+
+	prevAdvID, err := e.getLatestAdCid(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not get latest advertisement: %s", err)
+	}
+
+	// Both identities attest to serving the content of the current one.
+	adv, err := xproviders.NewAdBuilder(oldID, oldKey, addrs).
+		WithMetadata(emptyMdBytes).
+		WithExtendedProviders(xproviders.NewInfo(newID, newKey, emptyMdBytes, addrs)).
+		WithLastAdID(prevAdvID).
+		BuildAndSign()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not build key rotation advertisement: %w", err)
+	}
+	j := &publishJournal{}
+	if prevAdvID, err = e.storeAdv(ctx, j, *adv); err != nil {
+		return cid.Undef, err
+	}
+
+	for _, contextID := range contextIDs {
+		entries, err := e.getKeyCidMap(ctx, oldID, contextID)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("could not get entries cid by provider + context id: %s", err)
+		}
+		md, err := e.getKeyMetadataMap(ctx, oldID, contextID)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, fmt.Errorf("could not get metadata for provider + context id: %s", err)
+		}
+		mdBytes, err := md.MarshalBinary()
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		putAdv := schema.Advertisement{
+			PreviousID: cidlink.Link{Cid: prevAdvID},
+			Provider:   newID.String(),
+			Addresses:  stringAddrs,
+			Entries:    cidlink.Link{Cid: entries},
+			ContextID:  contextID,
+			Metadata:   mdBytes,
+		}
+		if err = putAdv.Sign(newKey); err != nil {
+			return cid.Undef, err
+		}
+		if prevAdvID, err = e.storeAdv(ctx, j, putAdv); err != nil {
+			return cid.Undef, err
+		}
+		// Mappings of the default provider are not keyed by provider ID, so
+		// only the reverse mapping needs to point at the new peer ID.
+		if err = e.putKeyAdMap(ctx, j, oldID, contextID, prevAdvID); err != nil {
+			return cid.Undef, err
+		}
+		pB, err := newID.Marshal()
+		if err != nil {
+			return cid.Undef, err
+		}
+		m, err := json.Marshal(&providerAndContext{Provider: pB, ContextID: contextID})
+		if err != nil {
+			return cid.Undef, err
+		}
+		if err = j.Put(ctx, e.cidToProviderAndKeyKey(entries), m); err != nil {
+			return cid.Undef, err
+		}
+
+		rmAdv := schema.Advertisement{
+			PreviousID: cidlink.Link{Cid: prevAdvID},
+			Provider:   oldID.String(),
+			Entries:    schema.NoEntries,
+			ContextID:  contextID,
+			Metadata:   emptyMdBytes,
+			IsRm:       true,
+		}
+		if err = rmAdv.Sign(oldKey); err != nil {
+			return cid.Undef, err
+		}
+		if prevAdvID, err = e.storeAdv(ctx, j, rmAdv); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	if err = e.commitLatest(ctx, j, prevAdvID); err != nil {
+		return cid.Undef, err
+	}
+
+	e.idLk.Lock()
+	e.key = newKey
+	e.provider.ID = newID
+	e.idLk.Unlock()
+	log.Infow("Rotated provider key", "oldID", oldID, "newID", newID, "contextIDs", len(contextIDs), "adCid", prevAdvID)
+
+	e.announce(ctx, prevAdvID)
+	return prevAdvID, nil
+}
+
+// signingKey returns the current key used to sign advertisements.
+func (e *Engine) signingKey() crypto.PrivKey {
+	e.idLk.RLock()
+	defer e.idLk.RUnlock()
+	return e.key
+}
+
+// providerID returns the current ID of the default provider.
+func (e *Engine) providerID() peer.ID {
+	e.idLk.RLock()
+	defer e.idLk.RUnlock()
+	return e.provider.ID
+}
+
+// resolveProvider returns the given provider ID and addresses, or the ID of
+// the default provider and, unless removing, its retrieval addresses if the
+// given provider ID is empty.
+//
+// The caller must hold Engine.cblk, so that the default provider cannot be
+// changed by Engine.RotateKey or Engine.UpdateAddrs before the publish is
+// complete.
+func (e *Engine) resolveProvider(p peer.ID, addrs []multiaddr.Multiaddr, isRm bool) (peer.ID, []multiaddr.Multiaddr) {
+	if p != "" {
+		return p, addrs
+	}
+	if isRm {
+		return e.providerID(), nil
+	}
+	return e.providerID(), e.retrievalAddrs()
+}
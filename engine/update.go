@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipni/go-libipni/metadata"
+	provider "github.com/ipni/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// NotifyUpdate publishes an advertisement that replaces the multihashes and
+// metadata advertised for the given context ID, e.g. once the content behind
+// the context ID has changed. Unlike a NotifyRemove followed by a NotifyPut,
+// the context ID remains advertised throughout.
+//
+// The registered provider.MultihashLister is run again, and the returned
+// multihashes are chunked. If the resulting entries differ from the ones
+// advertised, then a single advertisement with the new entries and the given
+// metadata is published, and the mapping from the previous entries to the
+// context ID is deleted. Otherwise, an advertisement is only published if the
+// metadata changed, the same way as Engine.NotifyPut.
+//
+// If the context ID is not currently advertised then
+// provider.ErrContextIDNotFound is returned. If neither the entries nor the
+// metadata changed then provider.ErrAlreadyAdvertised is returned.
+//
+// If provider is nil then the default configured provider will be assumed.
+func (e *Engine) NotifyUpdate(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error) {
+	var pID peer.ID
+	var addrs []multiaddr.Multiaddr
+	if provider != nil {
+		pID = provider.ID
+		addrs = provider.Addrs
+	}
+	return e.publishUpdateForIndex(ctx, pID, addrs, contextID, md)
+}
+
+func (e *Engine) publishUpdateForIndex(ctx context.Context, p peer.ID, addrs []multiaddr.Multiaddr, contextID []byte, md metadata.Metadata) (cid.Cid, error) {
+	e.cblk.Lock()
+	defer e.cblk.Unlock()
+
+	p, addrs = e.resolveProvider(p, addrs, false)
+
+	if err := e.recoverPendingPublish(ctx); err != nil {
+		return cid.Undef, fmt.Errorf("could not recover interrupted publish: %w", err)
+	}
+
+	log := log.With("providerID", p).With("contextID", base64.StdEncoding.EncodeToString(contextID))
+
+	prevEntries, err := e.getKeyCidMap(ctx, p, contextID)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, provider.ErrContextIDNotFound
+		}
+		return cid.Undef, fmt.Errorf("could not get entries cid by provider + context id: %w", err)
+	}
+	prevMetadata, err := e.getKeyMetadataMap(ctx, p, contextID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return cid.Undef, fmt.Errorf("could not get metadata for provider + context id: %w", err)
+	}
+
+	entries, err := e.chunkEntries(ctx, p, contextID)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if entries.Cid == prevEntries && md.Equal(prevMetadata) {
+		return cid.Undef, provider.ErrAlreadyAdvertised
+	}
+
+	j := &publishJournal{}
+	if entries.Cid != prevEntries {
+		log.Infow("Creating advertisement with updated entries", "prevEntries", prevEntries, "entries", entries.Cid)
+		if err = e.putKeyCidMap(ctx, j, p, contextID, entries.Cid); err != nil {
+			return cid.Undef, fmt.Errorf("failed to write provider + context id to entries cid mapping: %w", err)
+		}
+		if err = e.deleteStaleCidKeyMap(ctx, j, p, contextID, prevEntries); err != nil {
+			return cid.Undef, fmt.Errorf("failed to delete previous entries cid to provider + context id mapping: %w", err)
+		}
+	} else {
+		log.Info("Creating advertisement with updated metadata")
+	}
+	if err = e.putKeyMetadataMap(ctx, j, p, contextID, &md); err != nil {
+		return cid.Undef, fmt.Errorf("failed to write provider + context id to metadata mapping: %w", err)
+	}
+
+	adv, err := newAdvertisement(p, addrs, contextID, md, entries, false)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return e.linkAndPublish(ctx, j, p, adv)
+}
+
+// deleteStaleCidKeyMap deletes the mappings of the given entries CID, which
+// are no longer advertised for the given provider and context ID, as long as
+// they still map to them. Identical entries advertised for another context ID
+// may have since been mapped to that context ID instead.
+func (e *Engine) deleteStaleCidKeyMap(ctx context.Context, w datastore.Write, p peer.ID, contextID []byte, c cid.Cid) error {
+	pAndC, err := e.getCidKeyMap(ctx, c)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(pAndC.ContextID, contextID) {
+		return nil
+	}
+	// Legacy mappings carry no provider, and belong to the default provider.
+	if len(pAndC.Provider) != 0 {
+		mapped, err := peer.IDFromBytes(pAndC.Provider)
+		if err != nil || mapped != p {
+			return nil
+		}
+	} else if p != e.providerID() {
+		return nil
+	}
+	return e.deleteCidKeyMap(ctx, w, c)
+}
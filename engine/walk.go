@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/go-libipni/ingest/schema"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrStopWalk can be returned by the function passed to Engine.WalkAdChain to
+// stop walking the chain without failing the walk.
+var ErrStopWalk = errors.New("stop walking advertisement chain")
+
+type (
+	// WalkOption sets a configuration parameter for walking the
+	// advertisement chain.
+	//
+	// See: Engine.WalkAdChain.
+	WalkOption func(*walkOptions)
+
+	walkOptions struct {
+		stopAt    cid.Cid
+		maxDepth  int
+		provider  peer.ID
+		contextID []byte
+		isRm      *bool
+	}
+)
+
+// WithWalkStopAt stops walking the chain once the advertisement with the
+// given CID is reached. The advertisement itself is not visited.
+func WithWalkStopAt(c cid.Cid) WalkOption {
+	return func(o *walkOptions) {
+		o.stopAt = c
+	}
+}
+
+// WithWalkMaxDepth stops walking the chain after the given number of
+// advertisements are traversed, regardless of whether they are filtered out.
+// A depth of zero or less means no limit, which is the default.
+func WithWalkMaxDepth(depth int) WalkOption {
+	return func(o *walkOptions) {
+		o.maxDepth = depth
+	}
+}
+
+// WithWalkProvider only visits the advertisements of the given provider.
+func WithWalkProvider(p peer.ID) WalkOption {
+	return func(o *walkOptions) {
+		o.provider = p
+	}
+}
+
+// WithWalkContextID only visits the advertisements with the given context
+// ID.
+func WithWalkContextID(contextID []byte) WalkOption {
+	return func(o *walkOptions) {
+		o.contextID = contextID
+	}
+}
+
+// WithWalkIsRm only visits the removal advertisements if isRm is true, or
+// only the non-removal ones otherwise.
+func WithWalkIsRm(isRm bool) WalkOption {
+	return func(o *walkOptions) {
+		o.isRm = &isRm
+	}
+}
+
+func (o *walkOptions) visit(ad *schema.Advertisement) bool {
+	if o.provider != "" && ad.Provider != o.provider.String() {
+		return false
+	}
+	if o.contextID != nil && !bytes.Equal(ad.ContextID, o.contextID) {
+		return false
+	}
+	if o.isRm != nil && ad.IsRm != *o.isRm {
+		return false
+	}
+	return true
+}
+
+// WalkAdChain walks the advertisement chain from the given advertisement CID
+// back to the first advertisement by following PreviousID, calling fn for
+// every advertisement that matches the given options. If from is cid.Undef
+// then the walk starts at the latest advertisement.
+//
+// If fn returns an error the walk stops and the error is returned, unless the
+// error is ErrStopWalk in which case nil is returned.
+func (e *Engine) WalkAdChain(ctx context.Context, from cid.Cid, fn func(cid.Cid, *schema.Advertisement) error, o ...WalkOption) error {
+	var opts walkOptions
+	for _, apply := range o {
+		apply(&opts)
+	}
+
+	if from == cid.Undef {
+		var err error
+		from, err = e.getLatestAdCid(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get latest advertisement cid: %w", err)
+		}
+	}
+
+	lsys := e.vanillaLinkSystem()
+	var depth int
+	for c := from; c != cid.Undef && c != opts.stopAt; depth++ {
+		if opts.maxDepth > 0 && depth >= opts.maxDepth {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, schema.AdvertisementPrototype)
+		if err != nil {
+			return fmt.Errorf("cannot load advertisement %s from blockstore with vanilla linksystem: %w", c, err)
+		}
+		ad, err := schema.UnwrapAdvertisement(n)
+		if err != nil {
+			return fmt.Errorf("cannot unwrap advertisement %s: %w", c, err)
+		}
+		if opts.visit(ad) {
+			if err = fn(c, ad); err != nil {
+				if errors.Is(err, ErrStopWalk) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		c = cid.Undef
+		if ad.PreviousID != nil {
+			c = ad.PreviousID.(cidlink.Link).Cid
+		}
+	}
+	return nil
+}
+
+// AdChainStats holds statistics about the advertisements visited while
+// walking the advertisement chain.
+//
+// See: Engine.AdChainStats.
+type AdChainStats struct {
+	// AdCount is the number of advertisements visited.
+	AdCount int
+	// RmCount is the number of removal advertisements visited.
+	RmCount int
+	// ContextIDCount is the number of distinct provider and context ID pairs
+	// across the visited advertisements. Advertisements with no context ID,
+	// such as address updates, are not counted.
+	ContextIDCount int
+	// EntriesChunkCount, EntriesMultihashCount and EntriesSize are the total
+	// number of entries chunks, multihashes and encoded entries bytes across
+	// the distinct cached chained entries of the non-removal advertisements.
+	// Entries shared by several advertisements, e.g. after a metadata
+	// update, are counted once.
+	EntriesChunkCount     int
+	EntriesMultihashCount int
+	EntriesSize           int
+	// EntriesUnavailableCount is the number of distinct entries of
+	// non-removal advertisements that are not cached or not chained, and are
+	// therefore not accounted for in the entries statistics.
+	EntriesUnavailableCount int
+}
+
+// AdChainStats walks the advertisement chain the same way as
+// Engine.WalkAdChain and returns statistics about the visited
+// advertisements.
+//
+// Entries are only read from the entries cache; they are never regenerated
+// via the registered provider.MultihashLister.
+func (e *Engine) AdChainStats(ctx context.Context, from cid.Cid, o ...WalkOption) (*AdChainStats, error) {
+	type providerContextID struct {
+		provider  string
+		contextID string
+	}
+	var stats AdChainStats
+	contextIDs := make(map[providerContextID]struct{})
+	entries := make(map[cid.Cid]struct{})
+	err := e.WalkAdChain(ctx, from, func(_ cid.Cid, ad *schema.Advertisement) error {
+		stats.AdCount++
+		if len(ad.ContextID) != 0 {
+			contextIDs[providerContextID{ad.Provider, string(ad.ContextID)}] = struct{}{}
+		}
+		if ad.IsRm {
+			stats.RmCount++
+			return nil
+		}
+		if ad.Entries == nil || ad.Entries == schema.NoEntries {
+			return nil
+		}
+		entriesCid := ad.Entries.(cidlink.Link).Cid
+		if _, ok := entries[entriesCid]; ok {
+			return nil
+		}
+		entries[entriesCid] = struct{}{}
+		chunks, mhs, size, err := e.cachedEntriesStats(ctx, ad.Entries)
+		if err != nil {
+			log.Debugw("Entries not accounted for in chain stats", "entries", ad.Entries, "err", err)
+			stats.EntriesUnavailableCount++
+			return nil
+		}
+		stats.EntriesChunkCount += chunks
+		stats.EntriesMultihashCount += mhs
+		stats.EntriesSize += size
+		return nil
+	}, o...)
+	if err != nil {
+		return nil, err
+	}
+	stats.ContextIDCount = len(contextIDs)
+	return &stats, nil
+}
+
+// cachedEntriesStats follows the chain of entries chunks starting at the given
+// link using only the cached chunks, and returns the number of chunks,
+// multihashes and encoded bytes.
+func (e *Engine) cachedEntriesStats(ctx context.Context, lnk ipld.Link) (int, int, int, error) {
+	var size int
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		b, err := e.entriesChunker.GetRawCachedChunk(lctx.Ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return nil, datastore.ErrNotFound
+		}
+		size += len(b)
+		return bytes.NewReader(b), nil
+	}
+
+	var chunks, mhs int
+	for lnk != nil {
+		n, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, schema.EntryChunkPrototype)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		chunk, err := schema.UnwrapEntryChunk(n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		chunks++
+		mhs += len(chunk.Entries)
+		lnk = chunk.Next
+	}
+	return chunks, mhs, size, nil
+}
@@ -1,6 +1,11 @@
 package provider
 
-import "errors"
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	// ErrNoMultihashLister signals that no provider.MultihashLister is registered for lookup.
@@ -13,3 +18,34 @@ var (
 	// published.
 	ErrAlreadyAdvertised = errors.New("advertisement already published")
 )
+
+// ContextIDError associates an error to the context ID for which it occurred.
+type ContextIDError struct {
+	// ContextID is the context ID that failed to be processed.
+	ContextID []byte
+	// Err is the cause of failure.
+	Err error
+}
+
+func (e ContextIDError) Error() string {
+	return fmt.Sprintf("context ID %s: %s", base64.StdEncoding.EncodeToString(e.ContextID), e.Err)
+}
+
+func (e ContextIDError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError signals that one or more context IDs in a batch notification
+// failed to be processed. The remaining context IDs in the batch are
+// unaffected.
+//
+// See: Interface.NotifyPutBatch, Interface.NotifyRemoveBatch.
+type BatchError []ContextIDError
+
+func (e BatchError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, cerr := range e {
+		msgs = append(msgs, cerr.Error())
+	}
+	return fmt.Sprintf("%d context IDs failed: %s", len(e), strings.Join(msgs, "; "))
+}
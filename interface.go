@@ -37,7 +37,8 @@ type Interface interface {
 	// RegisterMultihashLister registers the hook that is used by the provider to look up
 	// a list of multihashes by context ID. Only a single registration is
 	// supported; repeated calls to this function will replace the previous
-	// registration.
+	// registration. Providers that implement MultihashListerRouter use it as
+	// the default when no other registration matches.
 	RegisterMultihashLister(MultihashLister)
 
 	// NotifyPut signals the provider that the list of multihashes looked up by
@@ -59,8 +60,11 @@ type Interface interface {
 	//
 	// If provider is nil then the default configured provider will be assumed.
 	//
+	// An expiry may be set via WithExpiry or WithTTL, after which the context
+	// ID is removed as if by NotifyRemove.
+	//
 	// This function returns the ID of the advertisement published.
-	NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error)
+	NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata, opts ...NotifyOption) (cid.Cid, error)
 
 	// NotifyRemove signals to the provider that the multihashes that
 	// corresponded to the given provider and contextID are no longer available.  An advertisement
@@ -74,6 +78,25 @@ type Interface interface {
 	// This function returns the ID of the advertisement published.
 	NotifyRemove(ctx context.Context, providerID peer.ID, contextID []byte) (cid.Cid, error)
 
+	// NotifyPutBatch is the batch equivalent of NotifyPut. It generates one
+	// advertisement per context ID, appends them all to the chain of
+	// advertisements in a single write, and only announces the last one.
+	//
+	// Context IDs that fail to be processed, including the ones that are
+	// already advertised, are skipped and reported via BatchError while the
+	// rest of the batch is published.
+	//
+	// This function returns the ID of the last advertisement published, or
+	// cid.Undef if none was published.
+	NotifyPutBatch(ctx context.Context, provider *peer.AddrInfo, contextIDs [][]byte, md metadata.Metadata) (cid.Cid, error)
+
+	// NotifyRemoveBatch is the batch equivalent of NotifyRemove. Failures are
+	// reported the same way as NotifyPutBatch.
+	//
+	// This function returns the ID of the last advertisement published, or
+	// cid.Undef if none was published.
+	NotifyRemoveBatch(ctx context.Context, providerID peer.ID, contextIDs [][]byte) (cid.Cid, error)
+
 	// GetAdv gets the advertisement that corresponds to the given cid.
 	GetAdv(context.Context, cid.Cid) (*schema.Advertisement, error)
 
@@ -87,6 +110,17 @@ type Interface interface {
 	Shutdown() error
 }
 
+// MultihashListerRouter is implemented by providers that support several
+// MultihashLister registrations, each used to look up the multihashes of a
+// provider ID and/or the context IDs with a given prefix.
+//
+// An empty provider ID matches any provider and an empty prefix matches any
+// context ID. The lister registered via Interface.RegisterMultihashLister is
+// used when no other registration matches.
+type MultihashListerRouter interface {
+	RegisterMultihashListerFor(mhl MultihashLister, providerID peer.ID, contextIDPrefix []byte)
+}
+
 // MultihashIterator iterates over a list of multihashes.
 //
 // See: CarMultihashIterator.
@@ -5,9 +5,46 @@ import "go.opentelemetry.io/otel/attribute"
 var Attributes struct {
 	StatusFailure attribute.KeyValue
 	StatusSuccess attribute.KeyValue
+
+	AdTypePut            attribute.KeyValue
+	AdTypeUpdateMetadata attribute.KeyValue
+	AdTypeUpdateProvider attribute.KeyValue
+	AdTypeRemove         attribute.KeyValue
+
+	ReadTypeAdvertisement attribute.KeyValue
+	ReadTypeEntries       attribute.KeyValue
+
+	AuditMatch    attribute.KeyValue
+	AuditMismatch attribute.KeyValue
+	AuditError    attribute.KeyValue
 }
 
 func init() {
 	Attributes.StatusFailure = attribute.String("status", "failure")
 	Attributes.StatusSuccess = attribute.String("status", "success")
+
+	Attributes.AdTypePut = attribute.String("type", "put")
+	Attributes.AdTypeUpdateMetadata = attribute.String("type", "update-metadata")
+	Attributes.AdTypeUpdateProvider = attribute.String("type", "update-provider")
+	Attributes.AdTypeRemove = attribute.String("type", "remove")
+
+	Attributes.ReadTypeAdvertisement = attribute.String("type", "advertisement")
+	Attributes.ReadTypeEntries = attribute.String("type", "entries")
+
+	Attributes.AuditMatch = attribute.String("result", "match")
+	Attributes.AuditMismatch = attribute.String("result", "mismatch")
+	Attributes.AuditError = attribute.String("result", "error")
+}
+
+// SenderKind returns the attribute that identifies the kind of an announce
+// sender, i.e. "http" or "pubsub". Senders are not identified by their target
+// URLs or topics, which would make the number of attribute values unbounded.
+func SenderKind(kind string) attribute.KeyValue {
+	return attribute.String("sender", kind)
+}
+
+// Filter returns the attribute that identifies a multihash filter by name,
+// e.g. "dedupe".
+func Filter(name string) attribute.KeyValue {
+	return attribute.String("filter", name)
 }
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+var Engine struct {
+	AdsPublished        syncint64.Counter
+	ReadRequests        syncint64.Counter
+	EntriesRegenerated  syncint64.Counter
+	Announces           syncint64.Counter
+	ListerAudits        syncint64.Counter
+	MultihashesFiltered syncint64.Counter
+}
+
+var Chunker struct {
+	ChunkDuration  syncint64.Histogram
+	ChunkedEntries syncint64.Histogram
+	CacheHits      syncint64.Counter
+	CacheMisses    syncint64.Counter
+	CacheEvictions syncint64.Counter
+}
+
+func init() {
+	var err error
+	if Engine.AdsPublished, err = meter.SyncInt64().Counter(
+		"index-provider/engine/ads_published",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of advertisements published, by advertisement type"),
+	); err != nil {
+		panic(err)
+	}
+	if Engine.ReadRequests, err = meter.SyncInt64().Counter(
+		"index-provider/engine/read_requests",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of blocks requested from the engine link system, by advertisement or entries type"),
+	); err != nil {
+		panic(err)
+	}
+	if Engine.EntriesRegenerated, err = meter.SyncInt64().Counter(
+		"index-provider/engine/entries_regenerated",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of times entries were regenerated from the multihash lister to be served, by status"),
+	); err != nil {
+		panic(err)
+	}
+	if Engine.Announces, err = meter.SyncInt64().Counter(
+		"index-provider/engine/announces",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of announcements sent, by sender and status"),
+	); err != nil {
+		panic(err)
+	}
+	if Engine.ListerAudits, err = meter.SyncInt64().Counter(
+		"index-provider/engine/lister_audits",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of context IDs audited for multihash lister consistency, by result"),
+	); err != nil {
+		panic(err)
+	}
+	if Engine.MultihashesFiltered, err = meter.SyncInt64().Counter(
+		"index-provider/engine/multihashes_filtered",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of multihashes dropped from advertisement entries, by filter"),
+	); err != nil {
+		panic(err)
+	}
+
+	if Chunker.ChunkDuration, err = meter.SyncInt64().Histogram(
+		"index-provider/chunker/chunk_duration",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("The time taken to chunk multihashes into advertisement entries in milliseconds"),
+	); err != nil {
+		panic(err)
+	}
+	if Chunker.ChunkedEntries, err = meter.SyncInt64().Histogram(
+		"index-provider/chunker/chunked_entries",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of multihashes chunked into advertisement entries"),
+	); err != nil {
+		panic(err)
+	}
+	if Chunker.CacheHits, err = meter.SyncInt64().Counter(
+		"index-provider/chunker/cache_hits",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of entries chunks found in the entries cache"),
+	); err != nil {
+		panic(err)
+	}
+	if Chunker.CacheMisses, err = meter.SyncInt64().Counter(
+		"index-provider/chunker/cache_misses",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of entries chunks not found in the entries cache"),
+	); err != nil {
+		panic(err)
+	}
+	if Chunker.CacheEvictions, err = meter.SyncInt64().Counter(
+		"index-provider/chunker/cache_evictions",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of entries DAGs evicted from the entries cache"),
+	); err != nil {
+		panic(err)
+	}
+}
@@ -312,6 +312,7 @@ func (m *Mirror) storageReadOpener(lctx linking.LinkContext, lnk datamodel.Link)
 	}
 
 	if b == nil {
+		metrics.Chunker.CacheMisses.Add(ctx, 1)
 		orig, err := m.getOriginalEntriesLinkFromMirror(ctx, lnk)
 		if err != nil {
 			log.Errorw("Failed to get original entries link from mirror link", "link", lnk, "err", err)
@@ -330,6 +331,7 @@ func (m *Mirror) storageReadOpener(lctx linking.LinkContext, lnk datamodel.Link)
 			return nil, errors.New("chunked link does not match the mapping to original entry")
 		}
 	} else {
+		metrics.Chunker.CacheHits.Add(ctx, 1)
 		log.Debugw("Found cache entry for CID", "cid", c)
 	}
 
@@ -72,18 +72,38 @@ func (mr *MockInterfaceMockRecorder) GetLatestAdv(arg0 interface{}) *gomock.Call
 }
 
 // NotifyPut mocks base method.
-func (m *MockInterface) NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error) {
+func (m *MockInterface) NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata, opts ...provider.NotifyOption) (cid.Cid, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NotifyPut", ctx, provider, contextID, md)
+	varargs := []interface{}{ctx, provider, contextID, md}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "NotifyPut", varargs...)
 	ret0, _ := ret[0].(cid.Cid)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // NotifyPut indicates an expected call of NotifyPut.
-func (mr *MockInterfaceMockRecorder) NotifyPut(ctx, provider, contextID, md interface{}) *gomock.Call {
+func (mr *MockInterfaceMockRecorder) NotifyPut(ctx, provider, contextID, md interface{}, opts ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPut", reflect.TypeOf((*MockInterface)(nil).NotifyPut), ctx, provider, contextID, md)
+	varargs := append([]interface{}{ctx, provider, contextID, md}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPut", reflect.TypeOf((*MockInterface)(nil).NotifyPut), varargs...)
+}
+
+// NotifyPutBatch mocks base method.
+func (m *MockInterface) NotifyPutBatch(ctx context.Context, provider *peer.AddrInfo, contextIDs [][]byte, md metadata.Metadata) (cid.Cid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyPutBatch", ctx, provider, contextIDs, md)
+	ret0, _ := ret[0].(cid.Cid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NotifyPutBatch indicates an expected call of NotifyPutBatch.
+func (mr *MockInterfaceMockRecorder) NotifyPutBatch(ctx, provider, contextIDs, md interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPutBatch", reflect.TypeOf((*MockInterface)(nil).NotifyPutBatch), ctx, provider, contextIDs, md)
 }
 
 // NotifyRemove mocks base method.
@@ -101,6 +121,21 @@ func (mr *MockInterfaceMockRecorder) NotifyRemove(ctx, providerID, contextID int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyRemove", reflect.TypeOf((*MockInterface)(nil).NotifyRemove), ctx, providerID, contextID)
 }
 
+// NotifyRemoveBatch mocks base method.
+func (m *MockInterface) NotifyRemoveBatch(ctx context.Context, providerID peer.ID, contextIDs [][]byte) (cid.Cid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyRemoveBatch", ctx, providerID, contextIDs)
+	ret0, _ := ret[0].(cid.Cid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NotifyRemoveBatch indicates an expected call of NotifyRemoveBatch.
+func (mr *MockInterfaceMockRecorder) NotifyRemoveBatch(ctx, providerID, contextIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyRemoveBatch", reflect.TypeOf((*MockInterface)(nil).NotifyRemoveBatch), ctx, providerID, contextIDs)
+}
+
 // Publish mocks base method.
 func (m *MockInterface) Publish(arg0 context.Context, arg1 schema.Advertisement) (cid.Cid, error) {
 	m.ctrl.T.Helper()
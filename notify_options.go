@@ -0,0 +1,43 @@
+package provider
+
+import "time"
+
+// NotifyOption configures a call to Interface.NotifyPut.
+type NotifyOption func(*NotifyOptions)
+
+// NotifyOptions holds the options of a call to Interface.NotifyPut.
+//
+// See: NewNotifyOptions.
+type NotifyOptions struct {
+	// Expiry is the time after which the context ID is automatically removed,
+	// or the zero time if it never expires.
+	Expiry time.Time
+}
+
+// NewNotifyOptions applies the given options, and returns the result.
+func NewNotifyOptions(o ...NotifyOption) NotifyOptions {
+	var opts NotifyOptions
+	for _, apply := range o {
+		apply(&opts)
+	}
+	return opts
+}
+
+// WithExpiry sets the time after which the advertised context ID expires, at
+// which point the provider publishes a removal advertisement for it. The
+// expiry of a context ID that is already advertised is left as is unless this
+// option is given, in which case the expiry is set even if there is no change
+// to advertise.
+func WithExpiry(t time.Time) NotifyOption {
+	return func(o *NotifyOptions) {
+		o.Expiry = t
+	}
+}
+
+// WithTTL sets the expiry of the advertised context ID to the given duration
+// from now.
+//
+// See: WithExpiry.
+func WithTTL(ttl time.Duration) NotifyOption {
+	return WithExpiry(time.Now().Add(ttl))
+}
@@ -72,3 +72,26 @@ func (s *Server) announceHttpHandler(w http.ResponseWriter, r *http.Request) {
 	resp := &AnnounceRes{adCid}
 	respond(w, http.StatusOK, resp)
 }
+
+func (s *Server) announceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	resp := &AnnounceStatusRes{
+		Targets: []AnnounceTargetRes{},
+	}
+	for _, status := range s.e.AnnounceStatus() {
+		resp.Targets = append(resp.Targets, AnnounceTargetRes{
+			Target:          status.Target,
+			Pending:         status.Pending,
+			Attempts:        status.Attempts,
+			NextAttempt:     status.NextAttempt,
+			LastSuccess:     status.LastSuccess,
+			LastSuccessTime: status.LastSuccessTime,
+			LastError:       status.LastError,
+			LastErrorTime:   status.LastErrorTime,
+		})
+	}
+	respond(w, http.StatusOK, resp)
+}
@@ -0,0 +1,25 @@
+package adminserver
+
+import (
+	"net/http"
+)
+
+func (s *Server) listerMismatchesHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	resp := &ListerMismatchesRes{
+		Mismatches: []ListerMismatchRes{},
+	}
+	for _, m := range s.e.ListerMismatches() {
+		resp.Mismatches = append(resp.Mismatches, ListerMismatchRes{
+			Provider:   m.Provider.String(),
+			ContextID:  m.ContextID,
+			Want:       m.Want,
+			Got:        m.Got,
+			DetectedAt: m.DetectedAt,
+		})
+	}
+	respond(w, http.StatusOK, resp)
+}
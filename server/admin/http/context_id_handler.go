@@ -0,0 +1,126 @@
+package adminserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func (s *Server) listContextIDsHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	providerID, ok := providerIDFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	it, err := s.e.ListContextIDs(r.Context(), providerID)
+	if err != nil {
+		err = fmt.Errorf("failed to list context IDs: %w", err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer it.Close()
+
+	resp := &ListContextIDsRes{
+		ContextIDs: []ContextIDRes{},
+	}
+	for {
+		info, err := it.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			err = fmt.Errorf("failed to list context IDs: %w", err)
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res, err := toContextIDRes(info)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.ContextIDs = append(resp.ContextIDs, *res)
+	}
+	respond(w, http.StatusOK, resp)
+}
+
+func (s *Server) getContextIDHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	providerID, ok := providerIDFromQuery(w, r)
+	if !ok {
+		return
+	}
+	b64ContextID := r.URL.Query().Get("contextid")
+	if b64ContextID == "" {
+		http.Error(w, "contextid must be specified", http.StatusBadRequest)
+		return
+	}
+	contextID, err := base64.StdEncoding.DecodeString(b64ContextID)
+	if err != nil {
+		http.Error(w, "contextid is not a valid base64 encoded string", http.StatusBadRequest)
+		return
+	}
+
+	info, err := s.e.GetContextID(r.Context(), providerID, contextID)
+	if err != nil {
+		if errors.Is(err, provider.ErrContextIDNotFound) {
+			http.Error(w, fmt.Sprintf("provider has no context ID %s", b64ContextID), http.StatusNotFound)
+			return
+		}
+		err = fmt.Errorf("failed to get context ID: %w", err)
+		log.Errorw("Failed to get context ID", "err", err, "contextID", b64ContextID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := toContextIDRes(info)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respond(w, http.StatusOK, resp)
+}
+
+// providerIDFromQuery returns the optional provider ID specified in the
+// request query, or an empty ID to use the default provider.
+func providerIDFromQuery(w http.ResponseWriter, r *http.Request) (peer.ID, bool) {
+	p := r.URL.Query().Get("provider")
+	if p == "" {
+		return "", true
+	}
+	providerID, err := peer.Decode(p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid provider ID: %s", err), http.StatusBadRequest)
+		return "", false
+	}
+	return providerID, true
+}
+
+func toContextIDRes(info *engine.ContextIDInfo) (*ContextIDRes, error) {
+	mdBytes, err := info.Metadata.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return &ContextIDRes{
+		Provider:  info.Provider.String(),
+		ContextID: info.ContextID,
+		Entries:   info.Entries,
+		Metadata:  mdBytes,
+		AdvId:     info.AdCid,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package adminserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/go-libipni/test"
+	provider "github.com/ipni/index-provider"
+	"github.com/ipni/index-provider/engine"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contextIDHandlers(t *testing.T) {
+	ctx := context.Background()
+	eng, err := engine.New()
+	require.NoError(t, err)
+	require.NoError(t, eng.Start(ctx))
+	defer eng.Shutdown()
+	eng.RegisterMultihashLister(func(ctx context.Context, p peer.ID, contextID []byte) (provider.MultihashIterator, error) {
+		return provider.SliceMultihashIterator(test.RandomMultihashes(10)), nil
+	})
+
+	wantKey := []byte("lobster")
+	wantMetadata := metadata.Default.New(metadata.Bitswap{})
+	wantAdCid, err := eng.NotifyPut(ctx, nil, wantKey, wantMetadata)
+	require.NoError(t, err)
+	wantMdBytes, err := wantMetadata.MarshalBinary()
+	require.NoError(t, err)
+
+	subject := &Server{e: eng}
+
+	req, err := http.NewRequest(http.MethodGet, "/admin/list/contextid", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(subject.listContextIDsHandler).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	respBytes, err := io.ReadAll(rr.Body)
+	require.NoError(t, err)
+	var listResp ListContextIDsRes
+	require.NoError(t, json.Unmarshal(respBytes, &listResp))
+	require.Len(t, listResp.ContextIDs, 1)
+	require.Equal(t, wantKey, listResp.ContextIDs[0].ContextID)
+	require.Equal(t, wantMdBytes, listResp.ContextIDs[0].Metadata)
+	require.Equal(t, wantAdCid, listResp.ContextIDs[0].AdvId)
+
+	req, err = http.NewRequest(http.MethodGet, "/admin/contextid?contextid="+base64.StdEncoding.EncodeToString(wantKey), nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(subject.getContextIDHandler).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	respBytes, err = io.ReadAll(rr.Body)
+	require.NoError(t, err)
+	var getResp ContextIDRes
+	require.NoError(t, json.Unmarshal(respBytes, &getResp))
+	require.Equal(t, listResp.ContextIDs[0], getResp)
+
+	req, err = http.NewRequest(http.MethodGet, "/admin/contextid?contextid="+base64.StdEncoding.EncodeToString([]byte("fish")), nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(subject.getContextIDHandler).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -1,6 +1,8 @@
 package adminserver
 
 import (
+	"time"
+
 	"github.com/ipfs/go-cid"
 )
 
@@ -54,9 +56,98 @@ type (
 	}
 )
 
+type (
+	// ContextIDRes represents a context ID currently advertised by the provider.
+	ContextIDRes struct {
+		// The ID of the provider the context ID is advertised for.
+		Provider string `json:"provider"`
+		// The advertised context ID.
+		ContextID []byte `json:"context_id"`
+		// The CID of the root of advertised entries.
+		Entries cid.Cid `json:"entries"`
+		// The metadata most recently advertised for the context ID.
+		Metadata []byte `json:"metadata"`
+		// The CID of the advertisement that last put the context ID, if known.
+		AdvId cid.Cid `json:"adv_id"`
+	}
+	// ListContextIDsRes represents the response to list context IDs.
+	ListContextIDsRes struct {
+		ContextIDs []ContextIDRes `json:"context_ids"`
+	}
+)
+
 type (
 	AnnounceRes struct {
 		// The CID of the advertisement announced as latest.
 		AdvId cid.Cid `json:"adv_id"`
 	}
+	// AnnounceTargetRes represents the status of announcing the latest
+	// advertisement to a direct HTTP announce URL or the gossip pubsub topic.
+	AnnounceTargetRes struct {
+		// The announce target, as "http:<url>" or "pubsub:<topic>".
+		Target string `json:"target"`
+		// The CID of the advertisement yet to be announced, if any.
+		Pending cid.Cid `json:"pending"`
+		// The number of failed attempts to announce the pending advertisement.
+		Attempts int `json:"attempts"`
+		// The time of the next attempt to announce the pending advertisement.
+		NextAttempt time.Time `json:"next_attempt"`
+		// The CID of the advertisement most recently announced successfully,
+		// and when it was announced.
+		LastSuccess     cid.Cid   `json:"last_success"`
+		LastSuccessTime time.Time `json:"last_success_time"`
+		// The error of the most recent failed announce, and when it failed.
+		LastError     string    `json:"last_error"`
+		LastErrorTime time.Time `json:"last_error_time"`
+	}
+	// AnnounceStatusRes represents the response to get the announce status.
+	AnnounceStatusRes struct {
+		Targets []AnnounceTargetRes `json:"targets"`
+	}
+)
+
+type (
+	// ListerMismatchRes represents a context ID for which the multihash
+	// lister no longer returns the advertised multihashes.
+	ListerMismatchRes struct {
+		// The ID of the provider the context ID is advertised for.
+		Provider string `json:"provider"`
+		// The advertised context ID.
+		ContextID []byte `json:"context_id"`
+		// The CID of the root of advertised entries.
+		Want cid.Cid `json:"want"`
+		// The CID of the root of the entries chunked from the multihashes
+		// currently returned by the lister, if any.
+		Got cid.Cid `json:"got"`
+		// The time at which the mismatch was last detected.
+		DetectedAt time.Time `json:"detected_at"`
+	}
+	// ListerMismatchesRes represents the response to list lister mismatches.
+	ListerMismatchesRes struct {
+		Mismatches []ListerMismatchRes `json:"mismatches"`
+	}
+)
+
+type (
+	// PublishQueueRes represents the status of the queue of asynchronous
+	// publishes.
+	PublishQueueRes struct {
+		// The number of publishes waiting for a worker.
+		Queued int `json:"queued"`
+		// The number of publishes being processed.
+		Running int `json:"running"`
+		// The number of workers processing publishes.
+		Workers int `json:"workers"`
+	}
+	// PublishTaskRes represents the status of an asynchronous publish.
+	PublishTaskRes struct {
+		// The ID of the publish.
+		ID string `json:"id"`
+		// The state of the publish: queued, running, done or failed.
+		State string `json:"state"`
+		// The CID of the published advertisement, once done.
+		AdvId cid.Cid `json:"adv_id"`
+		// The cause of failure, once failed.
+		Error string `json:"error,omitempty"`
+	}
 )
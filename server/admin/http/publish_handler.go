@@ -0,0 +1,53 @@
+package adminserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ipni/index-provider/engine"
+)
+
+func (s *Server) publishQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	status := s.e.PublishQueueStatus()
+	respond(w, http.StatusOK, &PublishQueueRes{
+		Queued:  status.Queued,
+		Running: status.Running,
+		Workers: status.Workers,
+	})
+}
+
+func (s *Server) publishTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if !methodOK(w, r, http.MethodGet) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id must be specified", http.StatusBadRequest)
+		return
+	}
+	task, err := s.e.GetPublishTask(id)
+	if err != nil {
+		if errors.Is(err, engine.ErrPublishTaskNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := task.Status()
+	resp := &PublishTaskRes{
+		ID:    status.ID,
+		State: status.State.String(),
+		AdvId: status.AdCid,
+	}
+	if status.Err != nil {
+		resp.Error = status.Err.Error()
+	}
+	respond(w, http.StatusOK, resp)
+}
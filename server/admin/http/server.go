@@ -43,9 +43,18 @@ func New(h host.Host, e *engine.Engine, cs *supplier.CarSupplier, o ...Option) (
 	// Set protocol handlers
 	mux.HandleFunc("/admin/announce", s.announceHandler)
 	mux.HandleFunc("/admin/announcehttp", s.announceHttpHandler)
+	mux.HandleFunc("/admin/announce/status", s.announceStatusHandler)
 
 	mux.HandleFunc("/admin/connect", s.connectHandler)
 
+	mux.HandleFunc("/admin/list/contextid", s.listContextIDsHandler)
+	mux.HandleFunc("/admin/contextid", s.getContextIDHandler)
+
+	mux.HandleFunc("/admin/audit/mismatches", s.listerMismatchesHandler)
+
+	mux.HandleFunc("/admin/publish/queue", s.publishQueueHandler)
+	mux.HandleFunc("/admin/publish/task", s.publishTaskHandler)
+
 	cHandler := &carHandler{cs}
 	mux.HandleFunc("/admin/import/car", cHandler.handleImport)
 	mux.HandleFunc("/admin/remove/car", cHandler.handleRemove)